@@ -1,3 +1,5 @@
 module sleepy
 
 go 1.13
+
+require golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
@@ -2,19 +2,54 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"log"
 	"sleepy/network/kad"
 	"os"
+	"time"
 )
 
+const nodesFile = "nodes.dat"
+
 func main() {
-	kadClient := kad.NewClient(4662)
-	kadClient.Start()
+	prefs, err := kad.LoadPreferences(kad.PreferencesFile)
+	if err != nil {
+		log.Fatalf("Kad preferences load error: %s", err)
+	}
+
+	kadClient := kad.NewClient(4662, prefs)
+	kadClient.SetPreferencesFile(kad.PreferencesFile)
+	if err := kadClient.Start(); err != nil {
+		log.Fatalf("Kad start error: %s", err)
+	}
+
+	if err := kadClient.LoadIndex("."); err != nil {
+		log.Printf("Kad index load error: %s", err)
+	}
+
+	if err := kadClient.LoadNodes(nodesFile); err != nil {
+		log.Printf("Kad nodes load error: %s. Downloading them...", err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if _, err := kadClient.BootstrapFromURL(ctx, kad.DefaultNodesURL); err != nil {
+			log.Printf("Kad bootstrap error: %s", err)
+		}
+		cancel()
+	}
 
 	fmt.Println("Listening KAD")
 	reader := bufio.NewReader(os.Stdin)
 	reader.ReadString('\n')
 	fmt.Println("Closing KAD")
 
-	kadClient.Stop()
+	if err := kadClient.SaveNodes(nodesFile); err != nil {
+		log.Printf("Kad nodes save error: %s", err)
+	}
+
+	kadClient.Dispose()
+
+	if err := kadClient.SaveIndex("."); err != nil {
+		log.Printf("Kad index save error: %s", err)
+	}
 }
@@ -8,7 +8,7 @@ const (
 	ProtEd2k2UDP         = 0xf5
 	ProtEmuleTCP         = 0xc5
 	ProtEmuleTCPCompress = 0xd4
-	ProtEmuleUDPR1       = 0xa3 /* For encrypted datagrams */
+	ProtEmuleUDPR1       = 0xa3 /* Reserved, never used as marker of encrypted datagrams */
 	ProtEmuleUDPR2       = 0xb2
 	ProtKadUDP           = 0xe4
 	ProtKadUDPCompress   = 0xe5
@@ -20,4 +20,5 @@ const (
 	ProtocolVersion6     = uint8(6) // eMule 0.48b
 	ProtocolVersion7     = uint8(7) // eMule 0.49a
 	ProtocolVersion8     = uint8(8) // eMule 0.49b
+	ProtocolVersion9     = uint8(9) // eMule 0.50a
 )
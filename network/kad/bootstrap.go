@@ -0,0 +1,99 @@
+package kad
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sleepy/network/kad/router"
+	"strconv"
+)
+
+const (
+	DefaultNodesURL      = "http://upd.emule-security.org/nodes.dat" // Default source of nodes.dat
+	maxNodesFileSize     = 1 << 20                                   // Max size of a downloaded nodes.dat
+	maxBootstrapRequests = 10                                        // Contacts asked for more contacts on bootstrap
+)
+
+// Download the nodes.dat on [url], add its contacts to the router and ask some of them
+// for more contacts. Return the number of valid contacts found
+func (client *Client) BootstrapFromURL(ctx context.Context, url string) (int, error) {
+	if client.router == nil {
+		return 0, errors.New("the client has no router")
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return 0, errors.New("nodes.dat download failed with status " + strconv.Itoa(response.StatusCode))
+	} else if response.ContentLength > maxNodesFileSize {
+		return 0, errors.New("the nodes.dat is too big")
+	}
+
+	nodes, err := router.ReadNodesFile(io.LimitReader(response.Body, maxNodesFileSize))
+	if err != nil {
+		return 0, err
+	} else if len(nodes.Peers) == 0 {
+		return 0, errors.New("the nodes.dat doesn't contain valid contacts")
+	}
+
+	return len(nodes.Peers), client.bootstrapFromNodes(nodes)
+}
+
+// Add the contacts of the nodes.dat on [path] to the routing table and ask some of them
+// for more contacts
+func (client *Client) LoadNodes(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	nodes, err := router.ReadNodesFile(file)
+	if err != nil {
+		return err
+	}
+
+	return client.bootstrapFromNodes(nodes)
+}
+
+// Save the contacts of the routing table on [path] as nodes.dat
+func (client *Client) SaveNodes(path string) error {
+	return client.router.SaveFile(path)
+}
+
+// Add the contacts of [nodes] to the routing table, unless they are only for bootstrap,
+// and ask some of them for more contacts
+func (client *Client) bootstrapFromNodes(nodes *router.NodesFile) error {
+	if !nodes.BootstrapOnly {
+		for _, peer := range nodes.Peers {
+			client.router.AddPeer(peer)
+		}
+	}
+
+	sent := 0
+	for _, peer := range nodes.Peers {
+		if sent >= maxBootstrapRequests {
+			break
+		}
+		if client.Bootstrap(&net.UDPAddr{IP: *peer.IP(), Port: int(peer.UDPPort())}) == nil {
+			sent++
+		}
+	}
+
+	if sent == 0 {
+		return errors.New("the bootstrap request can't be sent to any contact")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package kad
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sleepy/network/kad/router"
+	kadTypes "sleepy/network/kad/types"
+	"testing"
+	"time"
+)
+
+// Serve the [peers] as nodes.dat
+func newTestNodesServer(t *testing.T, peers []*kadTypes.Peer) *httptest.Server {
+	buf := new(bytes.Buffer)
+	if err := router.WriteNodesFile(buf, peers); err != nil {
+		t.Fatalf("Nodes write error: %s", err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	}))
+}
+
+func TestClient_BootstrapFromURL(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+	peer := startTestClient(t)
+	defer closeTestClient(peer)
+
+	for i := 1; i <= 10; i++ {
+		peer.router.AddPeer(newTestPeer(i))
+	}
+
+	server := newTestNodesServer(t, []*kadTypes.Peer{newTestClientPeer(peer)})
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if count, err := client.BootstrapFromURL(ctx, server.URL); err != nil {
+		t.Fatalf("Bootstrap error: %s", err)
+	} else if count != 1 {
+		t.Errorf("The nodes.dat has 1 contact, %d found", count)
+	}
+
+	if !client.router.ContainsPeer(peer.Id()) {
+		t.Errorf("The contacts of the nodes.dat must be added to the router")
+	}
+
+	// The contacts of the bootstrap response are added to the router
+	for start := time.Now(); client.router.CountPeers() < 11; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("The bootstrap response must be handled, %d peers found", client.router.CountPeers())
+		}
+	}
+}
+
+func TestClient_BootstrapFromURL_Invalid(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	empty := newTestNodesServer(t, []*kadTypes.Peer{})
+	defer empty.Close()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte{0, 0, 0, 0, 2, 0, 0, 0, 5, 0, 0, 0, 1, 2, 3})
+	}))
+	defer garbage.Close()
+
+	for _, url := range []string{empty.URL, notFound.URL, garbage.URL} {
+		if _, err := client.BootstrapFromURL(context.Background(), url); err == nil {
+			t.Errorf("Must fail with the nodes.dat of %s", url)
+		}
+	}
+}
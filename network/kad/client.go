@@ -2,6 +2,8 @@ package kad
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -9,25 +11,178 @@ import (
 	"net"
 	"sleepy/network/ed2k"
 	"sleepy/network/kad/router"
+	kadTypes "sleepy/network/kad/types"
+	"sleepy/types"
+	"sleepy/utils/event"
 	"strconv"
+	"sync"
 	"time"
 )
 
+const (
+	kadVersion            = ed2k.ProtocolVersion8 // Kad version announced to other peers
+	kadObfuscationVersion = ed2k.ProtocolVersion6 // First Kad version that supports obfuscation
+	maxBootstrapPeers     = 20                    // Max number of contacts sent on a bootstrap response
+)
+
 type Client struct {
-	router     *router.Router
-	listenPort uint16
-	clientAddr *net.UDPAddr
-	clientConn *net.UDPConn
-	serverAddr *net.UDPAddr
-	serverConn *net.UDPConn
+	id             types.UInt128
+	userHash       types.UInt128
+	udpKey         uint32
+	externalIP     net.IP
+	observedIP     net.IP // Last public IP that a peer saw, waiting for other check to confirm it
+	ipAccess       sync.Mutex
+	prefsPath      string
+	router         *router.Router
+	listenPort     uint16
+	tcpPort        uint16
+	serverAddr     *net.UDPAddr
+	serverConn     *net.UDPConn
+	listening      chan struct{}   // Closed when the listener and its handlers end
+	handlers       sync.WaitGroup  // Handlers of the received datagrams in flight
+	ctx            context.Context // Cancelled on Stop, ends the tasks requested by the router
+	cancel         context.CancelFunc
+	tasks          sync.WaitGroup // Tasks requested by the router in flight
+	tasksAccess    sync.Mutex
+	externPort     portConsensus
+	bootstraps     pendingRequests
+	pings          pendingRequests
+	firewallChecks pendingRequests
+	lookups        lookupRegistry
+	searches       searchRegistry
+	publishes      publishRegistry
+	index          *Index
+	lookupListener *event.Container
+	updateListener *event.Container
 }
 
-func NewClient(port uint16) *Client {
+// Create a client listening on [port] with the id of [prefs]. Without preferences, the
+// client has a random id
+func NewClient(port uint16, prefs *Preferences) *Client {
 	client := new(Client)
 	client.listenPort = port
+	client.tcpPort = port
+	client.index = NewIndex()
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+
+	if prefs == nil {
+		prefs, _ = NewPreferences()
+	}
+	if prefs != nil {
+		client.id = *prefs.Id.Clone()
+		client.externalIP = prefs.ExternalIP
+	}
+	client.router = router.NewRouter(&client.id)
+
+	// FIXME: The user hash must be persisted
+	if hash, err := newUserHash(); err == nil {
+		client.userHash = *hash
+	}
+
+	udpKey := make([]byte, 4)
+	if _, err := rand.Read(udpKey); err == nil {
+		client.udpKey = binary.LittleEndian.Uint32(udpKey)
+	}
+
 	return client
 }
 
+// Get the Kad id of the client
+func (client *Client) Id() *types.UInt128 {
+	return client.id.Clone()
+}
+
+// Get the ed2k user hash of the client, that identifies it as source of files and notes
+func (client *Client) UserHash() *types.UInt128 {
+	return client.userHash.Clone()
+}
+
+// Get the preferences of the client, to persist them
+func (client *Client) Preferences() *Preferences {
+	return &Preferences{Id: client.Id(), ExternalIP: client.ExternalIP()}
+}
+
+// Get our last known public IP, or nil if it's unknown
+func (client *Client) ExternalIP() net.IP {
+	client.ipAccess.Lock()
+	defer client.ipAccess.Unlock()
+
+	if client.externalIP == nil {
+		return nil
+	}
+	ip := make(net.IP, len(client.externalIP))
+	copy(ip, client.externalIP)
+	return ip
+}
+
+// Set our public IP. The UDP verify keys that the peers give us are bound to it
+func (client *Client) SetExternalIP(ip net.IP) {
+	client.ipAccess.Lock()
+	changed := !client.externalIP.Equal(ip)
+	client.externalIP = make(net.IP, len(ip))
+	copy(client.externalIP, ip)
+	client.ipAccess.Unlock()
+
+	if changed && client.prefsPath != "" {
+		if err := client.Preferences().Save(client.prefsPath); err != nil {
+			log.Printf("Preferences save error: %s", err)
+		}
+	}
+}
+
+// Record the public [ip] that a peer saw on our packets. Like eMule, the IP is taken when
+// two checks in a row agree, so a single peer can't change it
+func (client *Client) observeExternalIP(ip net.IP) {
+	client.ipAccess.Lock()
+	confirmed := client.observedIP.Equal(ip)
+	client.observedIP = ip
+	client.ipAccess.Unlock()
+
+	if confirmed {
+		client.SetExternalIP(ip)
+	}
+}
+
+// Check if our public IP must be asked to the peers. It stops once the peers confirm it
+func (client *Client) needsIPCheck() bool {
+	client.ipAccess.Lock()
+	defer client.ipAccess.Unlock()
+	return client.observedIP == nil || !client.observedIP.Equal(client.externalIP)
+}
+
+// Save the preferences on the file on [path] each time they change
+func (client *Client) SetPreferencesFile(path string) {
+	client.prefsPath = path
+}
+
+// Load the values that other peers published to us from the index files of [dir]
+func (client *Client) LoadIndex(dir string) error {
+	return client.index.LoadFiles(dir, &client.id)
+}
+
+// Save the values that other peers published to us on the index files of [dir]
+func (client *Client) SaveIndex(dir string) error {
+	return client.index.SaveFiles(dir, &client.id)
+}
+
+// Get the UDP verify key that we give to the peer with the passed [ip]
+func (client *Client) UDPVerifyKey(ip net.IP) uint32 {
+	return udpVerifyKey(client.udpKey, ip)
+}
+
+// Create a random ed2k user hash, with the marks of eMule user hashes
+func newUserHash() (*types.UInt128, error) {
+	random, err := types.NewRandomUInt128()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := random.ToBytes()
+	hash[5] = 14
+	hash[14] = 111
+	return types.NewUInt128FromByteArray(hash)
+}
+
 func (client *Client) Start() error {
 	serverAddr, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(int(client.listenPort)))
 	if err != nil {
@@ -42,17 +197,91 @@ func (client *Client) Start() error {
 	client.serverAddr = serverAddr
 	client.serverConn = serverConn
 
-	go client.listenUDP()
+	client.lookupListener = client.router.PeerLookupRequestEvent().Listen(client.onPeerLookupRequest)
+	client.updateListener = client.router.PeerUpdateRequestEvent().Listen(client.onPeerUpdateRequest)
+	client.index.Start()
+
+	client.listen()
 	return nil
 }
 
+// Stop listening, waiting for the datagrams in flight, and the maintenance of the routing
+// table and the index
 func (client *Client) Stop() {
-	client.serverConn.SetDeadline(time.Now())
-	client.clientConn.Close()
+	// End the tasks requested by the router before closing the socket that they use
+	client.tasksAccess.Lock()
+	client.cancel()
+	client.tasksAccess.Unlock()
+	client.tasks.Wait()
+
+	if client.listening != nil {
+		// The listener closes the socket when the read fails
+		client.serverConn.SetDeadline(time.Now())
+		<-client.listening
+	}
+
+	if client.lookupListener != nil {
+		client.lookupListener.Ignore()
+		client.lookupListener = nil
+	}
+	if client.updateListener != nil {
+		client.updateListener.Ignore()
+		client.updateListener = nil
+	}
+
+	client.index.Close()
+	client.router.Close()
+}
+
+// Stop the client and dispose the routing table
+func (client *Client) Dispose() {
+	client.Stop()
+	client.router.Dispose()
+}
+
+// Register a task requested by the router, that Stop waits for. Return false if the client
+// is stopped
+func (client *Client) startTask() bool {
+	client.tasksAccess.Lock()
+	defer client.tasksAccess.Unlock()
+
+	if client.ctx.Err() != nil {
+		return false
+	}
+	client.tasks.Add(1)
+	return true
+}
+
+// Check if the oldest contact of a bucket is still alive, asking for its details. The
+// contact is updated when it answers
+func (client *Client) onPeerUpdateRequest(sender interface{}, args event.Args) {
+	peerArgs, ok := args.(router.PeerEventArgs)
+	if !ok {
+		return
+	}
+
+	peer := peerArgs.Peer
+	var targetId *types.UInt128
+	if peer.ProtocolVersion() >= kadObfuscationVersion {
+		targetId = peer.Id()
+	}
+
+	addr := &net.UDPAddr{IP: *peer.IP(), Port: int(peer.UDPPort())}
+	if err := client.Hello(addr, targetId, peer.UDPKey(client.ExternalIP())); err != nil {
+		log.Printf("Peer update error: %s", err)
+	}
+}
+
+// Handle the datagrams of the socket in the background until Stop
+func (client *Client) listen() {
+	client.listening = make(chan struct{})
+	go client.listenUDP()
 }
 
 func (client *Client) listenUDP() {
+	defer close(client.listening)
 	defer client.serverConn.Close()
+	defer client.handlers.Wait()
 
 	buf := make([]byte, 8192)
 
@@ -60,10 +289,19 @@ func (client *Client) listenUDP() {
 		n, addr, err := client.serverConn.ReadFromUDP(buf)
 
 		if err != nil {
+			// Stop on deadline (see Stop) or when the socket is closed
+			if netErr, ok := err.(net.Error); !ok || netErr.Timeout() || !netErr.Temporary() {
+				return
+			}
 			fmt.Println(err)
 		} else {
+			data := make([]byte, n)
+			copy(data, buf[0:n])
+
+			client.handlers.Add(1)
 			go func() {
-				err := client.handleUDP(buf[0:n], addr)
+				defer client.handlers.Done()
+				err := client.handleUDP(data, addr)
 				if err != nil {
 					log.Printf("Datagram handle error: %s", err)
 				}
@@ -72,6 +310,90 @@ func (client *Client) listenUDP() {
 	}
 }
 
+// Ask a known peer for contacts to join the network
+func (client *Client) Bootstrap(addr *net.UDPAddr) error {
+	packet := newResponse(client, addr)
+	packet.SetOpcode(CommKad2BootstrapReq)
+	client.bootstraps.Add(addr, pendingRequestTimeout)
+	return packet.Send()
+}
+
+// Send our details to a peer. If its [targetId] is known, the packet is obfuscated and
+// carries the [receiverKey] that the peer gave us, or 0 if any
+func (client *Client) Hello(addr *net.UDPAddr, targetId *types.UInt128, receiverKey uint32) error {
+	packet := newResponse(client, addr)
+	packet.SetObfuscation(targetId, receiverKey)
+	if err := client.writeHello(packet, CommKad2HelloReq, false); err != nil {
+		return err
+	}
+	return packet.Send()
+}
+
+// Send a ping to a peer, that will answer with the UDP port it sees. If its [targetId]
+// is known, the packet is obfuscated and carries the [receiverKey] that the peer gave us
+func (client *Client) Ping(addr *net.UDPAddr, targetId *types.UInt128, receiverKey uint32) error {
+	packet := newResponse(client, addr)
+	packet.SetOpcode(CommKad2Ping)
+	packet.SetObfuscation(targetId, receiverKey)
+	client.pings.Add(addr, pendingRequestTimeout)
+	return packet.Send()
+}
+
+// Ask a peer for the public IP that it sees on our packets, with a KADEMLIA_FIREWALLED2_REQ.
+// If its [targetId] is known, the packet is obfuscated and carries the [receiverKey] that the
+// peer gave us
+func (client *Client) CheckExternalIP(addr *net.UDPAddr, targetId *types.UInt128, receiverKey uint32) error {
+	packet := newResponse(client, addr)
+	packet.SetOpcode(CommKadFirewalled2Req)
+	packet.SetObfuscation(targetId, receiverKey)
+	packet.WriteUInt16(client.tcpPort)
+	packet.WriteUInt128(client.UserHash())
+	packet.WriteByte(0) // Connection options
+	client.firewallChecks.Add(addr, pendingRequestTimeout)
+	return packet.Send()
+}
+
+// Get our UDP port as seen from internet, and if there is consensus about it
+func (client *Client) ExternalUDPPort() (uint16, bool) {
+	return client.externPort.Port()
+}
+
+// Send a datagram through the listening socket
+func (client *Client) sendPacket(packet []byte, to *net.UDPAddr) error {
+	if client.serverConn == nil {
+		return errors.New("the client is not started")
+	}
+
+	_, err := client.serverConn.WriteToUDP(packet, to)
+	return err
+}
+
+// Get the UDP verify key that the known peer with the [id] gave us for our public IP, or 0
+// if it's unknown
+func (client *Client) peerUDPKey(id *types.UInt128) uint32 {
+	peer, err := client.router.GetPeer(id)
+	if err != nil {
+		return 0
+	}
+	return peer.UDPKey(client.ExternalIP())
+}
+
+// Get the UDP address of [peer]
+func peerAddr(peer *kadTypes.Peer) *net.UDPAddr {
+	return &net.UDPAddr{IP: *peer.IP(), Port: int(peer.UDPPort())}
+}
+
+// Send a packet to [peer], obfuscated if it supports it
+func (client *Client) sendToPeer(peer *kadTypes.Peer, opcode byte, payload []byte) error {
+	packet := newResponse(client, peerAddr(peer))
+	packet.SetOpcode(opcode)
+	if peer.ProtocolVersion() >= kadObfuscationVersion {
+		packet.SetObfuscation(peer.Id(), peer.UDPKey(client.ExternalIP()))
+	}
+	packet.WriteBytes(payload)
+	return packet.Send()
+}
+
 func (client *Client) handleUDP(data []byte, from *net.UDPAddr) error {
 	if from.Port == 53 {
 		return errors.New("Dropping incoming ping from port 53. Possible DNS attack.")
@@ -94,6 +416,19 @@ func (client *Client) handleUDP(data []byte, from *net.UDPAddr) error {
 		},
 	}
 
+	if len(data) > 0 && !isProtocolMarker(data[0]) {
+		plain, receiverKey, senderKey, err := deobfuscatePacket(data, &client.id, client.UDPVerifyKey(from.IP))
+		if err != nil {
+			return err
+		}
+
+		request.body = Reader{data: plain, offset: 0}
+		request.obfuscated = true
+		request.receiverVerifyKey = receiverKey
+		request.senderVerifyKey = senderKey
+		request.validReceiverKey = receiverKey == client.UDPVerifyKey(from.IP)
+	}
+
 	protocolCode, err := request.body.ReadByte()
 	fmt.Printf("Protocol: %s, error: %s", hex.EncodeToString([]byte{protocolCode}), err)
 	if err != nil {
@@ -103,7 +438,7 @@ func (client *Client) handleUDP(data []byte, from *net.UDPAddr) error {
 	switch protocolCode {
 	case ed2k.ProtKadUDPCompress:
 		log.Println("Compressed KAD datagram. Trying decompression...")
-		return client.decompressKad(data, from)
+		return client.decompressKad(request)
 	case ed2k.ProtKadUDP:
 		log.Println("Handling valid Kad UDP packet...")
 		return client.handleKadDatagram(request)
@@ -112,8 +447,20 @@ func (client *Client) handleUDP(data []byte, from *net.UDPAddr) error {
 	}
 }
 
-func (client *Client) decompressKad(data []byte, from *net.UDPAddr) error {
-	return errors.New("decompress kad not implemented yet")
+// Inflate the payload of a compressed Kad datagram and handle it as a plain one
+func (client *Client) decompressKad(request *UDPRequest) error {
+	command, err := request.body.ReadByte()
+	if err != nil {
+		return errors.New("datagram read error")
+	}
+
+	payload, err := decompressPayload(request.body.data[request.body.offset:])
+	if err != nil {
+		return err
+	}
+
+	request.body = Reader{data: append([]byte{command}, payload...), offset: 0}
+	return client.handleKadDatagram(request)
 }
 
 func (client *Client) handleKadDatagram(request *UDPRequest) error {
@@ -123,33 +470,58 @@ func (client *Client) handleKadDatagram(request *UDPRequest) error {
 		return errors.New("datagram read error")
 	}
 
-	response := Response{}
+	response := newReply(client, request)
+
+	if err := client.dispatchKadCommand(command, request, response); err != nil {
+		return err
+	}
+
+	// Any valid packet of a known contact proves that it's alive
+	client.router.SetAlive(request.from)
+	return nil
+}
 
+// Handle a Kad command with its handler
+func (client *Client) dispatchKadCommand(command byte, request *UDPRequest, response *Response) error {
 	switch command {
 	case CommKad2BootstrapReq:
-		HandleBootstrapRequest(client, request, response)
-		return nil
+		return HandleBootstrapRequest(client, request, response)
 	case CommKad2BootstrapRes:
-		HandleBootstrapResponse(client, request, response)
-		return nil
+		return HandleBootstrapResponse(client, request, response)
 	case CommKad2HelloReq:
-		HandleHelloRequest(client, request, response)
-		return nil
+		return HandleHelloRequest(client, request, response)
 	case CommKad2HelloRes:
-		HandleHelloResponse(client, request, response)
-		return nil
+		return HandleHelloResponse(client, request, response)
 	case CommKad2HelloResAck:
-		HandleHelloResponseAck(client, request, response)
-		return nil
+		return HandleHelloResponseAck(client, request, response)
 	case CommKadFirewalled2Req:
-		HandleFirewallRequest(client, request, response)
-		return nil
+		return HandleFirewallRequest(client, request, response)
+	case CommKadFirewalledRes:
+		return HandleFirewallResponse(client, request, response)
+	case CommKad2Req:
+		return HandleLookupRequest(client, request, response)
+	case CommKad2Res:
+		return HandleLookupResponse(client, request, response)
 	case CommKad2Ping:
-		HandlePingRequest(client, request, response)
-		return nil
+		return HandlePingRequest(client, request, response)
 	case CommKad2Pong:
-		HandlePongResponse(client, request, response)
-		return nil
+		return HandlePongResponse(client, request, response)
+	case CommKad2SearchKeyReq:
+		return HandleSearchKeyRequest(client, request, response)
+	case CommKad2SearchSourceReq:
+		return HandleSearchSourceRequest(client, request, response)
+	case CommKad2SearchNotesReq:
+		return HandleSearchNotesRequest(client, request, response)
+	case CommKad2SearchRes:
+		return HandleSearchResponse(client, request, response)
+	case CommKad2PublichKeyReq:
+		return HandlePublishKeyRequest(client, request, response)
+	case CommKad2PublishSourceReq:
+		return HandlePublishSourceRequest(client, request, response)
+	case CommKad2PublishNotesReq:
+		return HandlePublishNotesRequest(client, request, response)
+	case CommKad2PublishRes:
+		return HandlePublishResponse(client, request, response)
 	default:
 		return errors.New("unknown kad command")
 	}
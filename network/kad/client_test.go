@@ -0,0 +1,140 @@
+package kad
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sleepy/network/kad/router"
+	kadTypes "sleepy/network/kad/types"
+	"testing"
+	"time"
+)
+
+func TestClient_StartStop(t *testing.T) {
+	client := NewClient(0, nil)
+	if client.router == nil {
+		t.Fatalf("The router must be created with the client")
+	}
+
+	if err := client.Start(); err != nil {
+		t.Fatalf("Start error: %s", err)
+	}
+	if client.lookupListener == nil || client.updateListener == nil {
+		t.Errorf("The client must listen the router events")
+	}
+
+	client.Stop()
+	if client.lookupListener != nil || client.updateListener != nil {
+		t.Errorf("The client must ignore the router events after stop")
+	}
+
+	to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}
+	for start := time.Now(); client.sendPacket([]byte{0}, to) == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("The socket must be closed after stop")
+		}
+	}
+}
+
+func TestClient_PeerUpdateRequest(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+	peer := newTestClient(t)
+	defer closeTestClient(peer)
+
+	client.onPeerUpdateRequest(client.router, router.PeerEventArgs{Peer: newTestClientPeer(peer)})
+
+	if opcode, _, _ := receiveTestRequest(t, peer); opcode != CommKad2HelloReq {
+		t.Errorf("The oldest peer must be asked with a hello, got opcode %x", opcode)
+	}
+}
+
+func TestClient_SetAliveOnPacket(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+	peer := newTestClient(t)
+	defer closeTestClient(peer)
+
+	client.router.AddPeer(newTestClientPeer(peer))
+	contact, _ := client.router.GetPeer(peer.Id())
+	contact.SetExpiration(time.Now().Add(time.Minute))
+
+	peer.Ping(client.serverConn.LocalAddr().(*net.UDPAddr), nil, 0)
+	relayTestPacket(t, client)
+
+	if contact.Expiration().Before(time.Now().Add(30 * time.Minute)) {
+		t.Errorf("Any valid packet of a contact must set it as alive")
+	}
+}
+
+func TestClient_LoadNodes(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+	peer := newTestClient(t)
+	defer closeTestClient(peer)
+
+	dir, err := ioutil.TempDir("", "kadnodes")
+	if err != nil {
+		t.Fatalf("Temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nodes.dat")
+
+	buf := new(bytes.Buffer)
+	router.WriteNodesFile(buf, []*kadTypes.Peer{newTestClientPeer(peer)})
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	if err := client.LoadNodes(path); err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	if !client.router.ContainsPeer(peer.Id()) {
+		t.Errorf("The contacts must be added to the router")
+	}
+	if opcode, _, _ := receiveTestRequest(t, peer); opcode != CommKad2BootstrapReq {
+		t.Errorf("The contacts must be asked for more contacts, got opcode %x", opcode)
+	}
+
+	if err := client.SaveNodes(path); err != nil {
+		t.Fatalf("Save error: %s", err)
+	}
+}
+
+func TestClient_StopEndsLookupRequest(t *testing.T) {
+	client := newTestClient(t)
+	silent := newTestClient(t)
+	defer closeTestClient(silent)
+
+	client.router.AddPeer(newTestClientPeer(silent))
+
+	finished := make(chan struct{})
+	go func() {
+		client.onPeerLookupRequest(client.router, router.PeerIdEventArgs{Id: *silent.Id()})
+		close(finished)
+	}()
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		client.lookups.access.Lock()
+		running := len(client.lookups.lookups) != 0
+		client.lookups.access.Unlock()
+		if running {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("The lookup requested by the router must start")
+		}
+	}
+
+	closeTestClient(client)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Errorf("The lookup requested by the router must end when the client stops")
+	}
+
+	// The requests after stop return without starting a lookup
+	client.onPeerLookupRequest(client.router, router.PeerIdEventArgs{Id: *silent.Id()})
+}
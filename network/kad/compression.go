@@ -0,0 +1,47 @@
+package kad
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	compressionThreshold = 200   // Payloads bigger than this are compressed before being sent
+	maxDecompressedSize  = 50000 // Max size accepted for an inflated payload
+)
+
+// Deflate a packet payload with zlib
+func compressPayload(payload []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	zWriter := zlib.NewWriter(&compressed)
+
+	if _, err := zWriter.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return compressed.Bytes(), nil
+}
+
+// Inflate a packet payload compressed with zlib
+func decompressPayload(payload []byte) ([]byte, error) {
+	zReader, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zReader.Close()
+
+	inflated, err := ioutil.ReadAll(io.LimitReader(zReader, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(inflated) > maxDecompressedSize {
+		return nil, errors.New("decompressed payload too big")
+	}
+
+	return inflated, nil
+}
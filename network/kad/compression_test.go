@@ -0,0 +1,56 @@
+package kad
+
+import (
+	"bytes"
+	"net"
+	"sleepy/network/ed2k"
+	"testing"
+)
+
+func TestCompression_RoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x01, 0x02, 0x03, 0x04}, 200)
+
+	compressed, err := compressPayload(payload)
+	if err != nil {
+		t.Fatalf("Compress error: %s", err)
+	} else if len(compressed) >= len(payload) {
+		t.Errorf("Compressed payload must be smaller, %d bytes from %d", len(compressed), len(payload))
+	}
+
+	inflated, err := decompressPayload(compressed)
+	if err != nil {
+		t.Fatalf("Decompress error: %s", err)
+	} else if !bytes.Equal(inflated, payload) {
+		t.Errorf("Decompressed payload mismatch")
+	}
+
+	if _, err := decompressPayload([]byte{0x01, 0x02, 0x03}); err == nil {
+		t.Errorf("Must fail with invalid compressed data")
+	}
+}
+
+func TestCompression_MaxSize(t *testing.T) {
+	compressed, _ := compressPayload(make([]byte, maxDecompressedSize+1))
+
+	if _, err := decompressPayload(compressed); err == nil {
+		t.Errorf("Must fail with payloads bigger than %d bytes", maxDecompressedSize)
+	}
+}
+
+func TestClient_HandleCompressedDatagram(t *testing.T) {
+	compressed, _ := compressPayload([]byte{0x36, 0x12})
+	packet := append([]byte{ed2k.ProtKadUDPCompress, CommKad2Pong}, compressed...)
+
+	client := NewClient(0, nil)
+	client.pings.Add(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}, pendingRequestTimeout)
+	err := client.handleUDP(packet, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672})
+	if err != nil {
+		t.Errorf("Compressed datagram handle error: %s", err)
+	}
+
+	packet = append([]byte{ed2k.ProtKadUDPCompress, CommKad2Pong}, 0x01, 0x02)
+	err = client.handleUDP(packet, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672})
+	if err == nil {
+		t.Errorf("Must fail with invalid compressed data")
+	}
+}
@@ -0,0 +1,273 @@
+package kad
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sleepy/types"
+	"sleepy/utils/clock"
+	"sync"
+	"time"
+)
+
+const (
+	keywordLifetime    = 24 * time.Hour   // Time that the keywords published to us are stored
+	sourceLifetime     = 5 * time.Hour    // Time that the sources published to us are stored
+	notesLifetime      = 24 * time.Hour   // Time that the notes published to us are stored
+	maxFilesPerKeyword = 50000            // Max files stored for each keyword
+	maxSourcesPerFile  = 1000             // Max sources stored for each file
+	maxNotesPerFile    = 150              // Max notes stored for each file
+	maxIndexEntries    = 60000            // Max entries stored on each table of the index
+	maxKeywordAnswers  = 300              // Max files answered to a keyword search
+	maxSourceAnswers   = 300              // Max sources answered to a source search
+	indexCleanupPeriod = 30 * time.Minute // Period between removals of expired entries
+)
+
+// A value published to us by other peer
+type indexEntry struct {
+	id      types.UInt128 // File hash on keywords, user hash of the publisher on sources and notes
+	ip      net.IP        // IP of the publisher
+	tags    TagList
+	expires time.Time
+}
+
+// The entries stored for each key, with limits of entries by key and in total
+type indexTable struct {
+	keys       map[types.UInt128][]*indexEntry
+	count      int
+	lifetime   time.Duration
+	maxPerKey  int
+	maxEntries int
+}
+
+func newIndexTable(lifetime time.Duration, maxPerKey int, maxEntries int) *indexTable {
+	return &indexTable{
+		keys:       make(map[types.UInt128][]*indexEntry),
+		lifetime:   lifetime,
+		maxPerKey:  maxPerKey,
+		maxEntries: maxEntries,
+	}
+}
+
+// Store [entry] for [key], replacing the previous entry with the same id. Return the load
+// of the key, from 0 to 100
+func (table *indexTable) add(key *types.UInt128, entry *indexEntry, now time.Time) (byte, error) {
+	entries := table.keys[*key]
+	for ind, stored := range entries {
+		if stored.id.Equal(&entry.id) {
+			entries[ind] = entry
+			return table.load(len(entries)), nil
+		}
+	}
+
+	if len(entries) >= table.maxPerKey {
+		return 100, errors.New("too many entries for the key")
+	} else if table.count >= table.maxEntries {
+		return 100, errors.New("the index is full")
+	}
+
+	table.keys[*key] = append(entries, entry)
+	table.count++
+	return table.load(len(entries) + 1), nil
+}
+
+// Get the load of a key with [count] entries
+func (table *indexTable) load(count int) byte {
+	return byte(count * 100 / table.maxPerKey)
+}
+
+// Get the entries stored for [key] that are not expired
+func (table *indexTable) get(key *types.UInt128, now time.Time) []*indexEntry {
+	entries := make([]*indexEntry, 0, len(table.keys[*key]))
+	for _, entry := range table.keys[*key] {
+		if entry.expires.After(now) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Remove the expired entries. Return the number of entries removed
+func (table *indexTable) cleanup(now time.Time) int {
+	removed := 0
+	for key, entries := range table.keys {
+		alive := entries[:0]
+		for _, entry := range entries {
+			if entry.expires.After(now) {
+				alive = append(alive, entry)
+			}
+		}
+
+		removed += len(entries) - len(alive)
+		if len(alive) == 0 {
+			delete(table.keys, key)
+		} else {
+			table.keys[key] = alive
+		}
+	}
+
+	table.count -= removed
+	return removed
+}
+
+// Index is the local store of the keywords, sources and notes that other peers publish
+// to us, and that we answer to their searches
+type Index struct {
+	keywords *indexTable
+	sources  *indexTable
+	notes    *indexTable
+	clock    clock.Clock
+	access   sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func NewIndex() *Index {
+	return NewIndexWithClock(clock.System)
+}
+
+// Create an index whose entries expire following the [clock]
+func NewIndexWithClock(clock clock.Clock) *Index {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Index{
+		keywords: newIndexTable(keywordLifetime, maxFilesPerKeyword, maxIndexEntries),
+		sources:  newIndexTable(sourceLifetime, maxSourcesPerFile, maxIndexEntries),
+		notes:    newIndexTable(notesLifetime, maxNotesPerFile, maxIndexEntries),
+		clock:    clock,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Store a [file] published on [keyword] by the peer with [ip]. Return the load of the keyword
+func (index *Index) AddKeyword(keyword *types.UInt128, file *types.UInt128, ip net.IP, tags TagList) (byte, error) {
+	if !tags.Contains(TagFileName) || !tags.Contains(TagFileSize) {
+		return 0, errors.New("keyword published without file name or size")
+	}
+
+	return index.add(index.keywords, keyword, file, ip, tags)
+}
+
+// Store the [source] of a [file], published from [ip]. Return the load of the file
+func (index *Index) AddSource(file *types.UInt128, source *types.UInt128, ip net.IP, udpPort uint16, tags TagList) (byte, error) {
+	if !tags.Contains(TagSourceType) {
+		return 0, errors.New("source published without type")
+	}
+
+	// Other peers find the source on the address it published from
+	sourceTags := TagList{NewIPTag(TagSourceIP, ip)}
+	if !tags.Contains(TagSourceUDPPort) {
+		sourceTags = append(sourceTags, NewIntTag(TagSourceUDPPort, uint64(udpPort)))
+	}
+	for _, tag := range tags {
+		if tag.Name != TagSourceIP {
+			sourceTags = append(sourceTags, tag)
+		}
+	}
+
+	return index.add(index.sources, file, source, ip, sourceTags)
+}
+
+// Store the note of the user with [source] hash about a [file]. Return the load of the file
+func (index *Index) AddNote(file *types.UInt128, source *types.UInt128, ip net.IP, tags TagList) (byte, error) {
+	if !tags.Contains(TagFileName) {
+		return 0, errors.New("note published without file name")
+	}
+
+	return index.add(index.notes, file, source, ip, tags)
+}
+
+func (index *Index) add(table *indexTable, key *types.UInt128, id *types.UInt128, ip net.IP, tags TagList) (byte, error) {
+	index.access.Lock()
+	defer index.access.Unlock()
+
+	now := index.clock.Now()
+	entry := &indexEntry{id: *id, ip: ip, tags: tags, expires: now.Add(table.lifetime)}
+	return table.add(key, entry, now)
+}
+
+// Get the files published on [keyword] that match [expr], that can be nil
+func (index *Index) SearchKeyword(keyword *types.UInt128, expr *SearchExpr) []searchEntry {
+	index.access.Lock()
+	defer index.access.Unlock()
+
+	results := make([]searchEntry, 0)
+	for _, entry := range index.keywords.get(keyword, index.clock.Now()) {
+		if len(results) >= maxKeywordAnswers {
+			break
+		}
+		if expr == nil || expr.Matches(entry.tags) {
+			results = append(results, searchEntry{id: entry.id.Clone(), tags: entry.tags})
+		}
+	}
+	return results
+}
+
+// Get the sources of a [file] with [size]. With size 0 all the sources are returned
+func (index *Index) SearchSources(file *types.UInt128, size uint64) []searchEntry {
+	index.access.Lock()
+	defer index.access.Unlock()
+
+	results := make([]searchEntry, 0)
+	for _, entry := range index.sources.get(file, index.clock.Now()) {
+		if len(results) >= maxSourceAnswers {
+			break
+		}
+		if entrySize, ok := entry.tags.GetInt(TagFileSize); size != 0 && ok && entrySize != size {
+			continue
+		}
+		results = append(results, searchEntry{id: entry.id.Clone(), tags: entry.tags})
+	}
+	return results
+}
+
+// Get the notes published about a [file]
+func (index *Index) SearchNotes(file *types.UInt128) []searchEntry {
+	index.access.Lock()
+	defer index.access.Unlock()
+
+	results := make([]searchEntry, 0)
+	for _, entry := range index.notes.get(file, index.clock.Now()) {
+		results = append(results, searchEntry{id: entry.id.Clone(), tags: entry.tags})
+	}
+	return results
+}
+
+// Remove the expired entries of the index
+func (index *Index) Cleanup() {
+	index.access.Lock()
+	defer index.access.Unlock()
+
+	now := index.clock.Now()
+	index.keywords.cleanup(now)
+	index.sources.cleanup(now)
+	index.notes.cleanup(now)
+}
+
+// Start removing the expired entries periodically
+func (index *Index) Start() {
+	index.done = make(chan struct{})
+	ticker := index.clock.NewTicker(indexCleanupPeriod)
+	go func() {
+		defer close(index.done)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				index.Cleanup()
+			case <-index.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop the periodic cleanup
+func (index *Index) Close() {
+	index.cancel()
+	if index.done != nil {
+		<-index.done
+	}
+}
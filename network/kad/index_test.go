@@ -0,0 +1,185 @@
+package kad
+
+import (
+	"context"
+	"net"
+	"sleepy/types"
+	"sleepy/utils/clock"
+	"testing"
+	"time"
+)
+
+func TestIndexTable(t *testing.T) {
+	table := newIndexTable(time.Hour, 2, 3)
+	now := time.Now()
+	key := types.NewUInt128FromInt(1)
+	newEntry := func(id int, name string) *indexEntry {
+		return &indexEntry{id: *types.NewUInt128FromInt(id), tags: TagList{NewStringTag(TagFileName, name)}, expires: now.Add(time.Hour)}
+	}
+
+	if load, err := table.add(key, newEntry(2, "a"), now); err != nil || load != 50 {
+		t.Errorf("Add error: %v, load: %d", err, load)
+	}
+	table.add(key, newEntry(2, "b"), now)
+	if entries := table.get(key, now); len(entries) != 1 {
+		t.Fatalf("The entries with the same id must be replaced, %d found", len(entries))
+	} else if name, _ := entries[0].tags.GetString(TagFileName); name != "b" {
+		t.Errorf("The last entry must be kept, got %s", name)
+	}
+
+	table.add(key, newEntry(3, "c"), now)
+	if load, err := table.add(key, newEntry(4, "d"), now); err == nil || load != 100 {
+		t.Errorf("Must fail when the key is full")
+	}
+
+	table.add(types.NewUInt128FromInt(5), newEntry(6, "e"), now)
+	if _, err := table.add(types.NewUInt128FromInt(5), newEntry(7, "f"), now); err == nil {
+		t.Errorf("Must fail when the table is full")
+	}
+
+	later := now.Add(2 * time.Hour)
+	if entries := table.get(key, later); len(entries) != 0 {
+		t.Errorf("Expired entries can't be returned")
+	}
+	if removed := table.cleanup(later); removed != 3 || table.count != 0 || len(table.keys) != 0 {
+		t.Errorf("The expired entries must be removed, %d removed", removed)
+	}
+}
+
+func TestIndex_SearchKeyword(t *testing.T) {
+	index := NewIndex()
+	keyword := KeywordHash("kademlia")
+	ip := net.IPv4(10, 0, 0, 1)
+
+	index.AddKeyword(keyword, types.NewUInt128FromInt(1), ip, TagList{
+		NewStringTag(TagFileName, "Kademlia paper.pdf"), NewIntTag(TagFileSize, 1000), NewStringTag(TagFileType, "Doc"),
+	})
+	index.AddKeyword(keyword, types.NewUInt128FromInt(2), ip, TagList{
+		NewStringTag(TagFileName, "kademlia talk.avi"), NewIntTag(TagFileSize, 500000), NewStringTag(TagFileType, "Video"),
+	})
+	if _, err := index.AddKeyword(keyword, types.NewUInt128FromInt(3), ip, TagList{NewIntTag(TagFileSize, 1)}); err == nil {
+		t.Errorf("Must fail with files without name")
+	}
+
+	if results := index.SearchKeyword(keyword, nil); len(results) != 2 {
+		t.Errorf("All the files must be found without expression, %d found", len(results))
+	}
+
+	tests := []struct {
+		expr *SearchExpr
+		id   int
+	}{
+		{SearchKeywordExpr("paper"), 1},
+		{SearchMetaExpr(TagFileType, "video"), 2},
+		{SearchNumericExpr(TagFileSize, SearchGreater, 1000), 2},
+		{SearchNotExpr(SearchKeywordExpr("kademlia"), SearchKeywordExpr("talk")), 1},
+		{SearchAndExpr(SearchKeywordExpr("kademlia"), SearchNumericExpr(TagFileSize, SearchLessEqual, 1000)), 1},
+	}
+	for _, test := range tests {
+		results := index.SearchKeyword(keyword, test.expr)
+		if len(results) != 1 || !results[0].id.Equal(types.NewUInt128FromInt(test.id)) {
+			t.Errorf("Only the file %d must match, %d found", test.id, len(results))
+		}
+	}
+}
+
+func TestIndex_SearchSources(t *testing.T) {
+	index := NewIndex()
+	file := types.NewUInt128FromInt(1)
+
+	_, err := index.AddSource(file, types.NewUInt128FromInt(2), net.IPv4(10, 0, 0, 1), 4672, TagList{
+		NewIntTag(TagSourceType, uint64(SourceTypeHighId)), NewIntTag(TagSourcePort, 4662), NewIntTag(TagFileSize, 1000),
+		NewIPTag(TagSourceIP, net.IPv4(1, 2, 3, 4)),
+	})
+	if err != nil {
+		t.Fatalf("Add error: %s", err)
+	}
+
+	if results := index.SearchSources(file, 2000); len(results) != 0 {
+		t.Errorf("Sources of other size can't be found")
+	}
+
+	results := index.SearchSources(file, 1000)
+	if len(results) != 1 {
+		t.Fatalf("The source must be found")
+	}
+	if ip, _ := results[0].tags.GetIP(TagSourceIP); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("The source ip must be the address of the publisher, got %s", ip)
+	}
+	if port, _ := results[0].tags.GetInt(TagSourceUDPPort); port != 4672 {
+		t.Errorf("The source UDP port must be the port of the publisher, got %d", port)
+	}
+}
+
+func TestIndex_Start(t *testing.T) {
+	index := NewIndex()
+	index.Start()
+	index.Close()
+
+	// Close without start must not block
+	NewIndex().Close()
+}
+
+func TestClient_PublishAndSearchKeyword(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+
+	// A keyword in the tolerance zone of the peer
+	keyword := "kademlia"
+	peer := newTestClientWithId(t, types.Xor(KeywordHash(keyword), types.NewUInt128FromInt(0xf11e)))
+	peer.listen()
+	defer closeTestClient(peer)
+	client.router.AddPeer(newTestClientPeer(peer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	files := []*SharedFile{
+		{Hash: types.NewUInt128FromInt(1), Name: "kademlia paper.pdf", Size: 1000},
+		{Hash: types.NewUInt128FromInt(2), Name: "kademlia talk.avi", Size: 5000},
+	}
+	if result, err := client.PublishKeyword(ctx, keyword, files); err != nil {
+		t.Fatalf("Publish error: %s", err)
+	} else if result.Peers != 1 {
+		t.Errorf("The peer must confirm the publish")
+	}
+
+	results, err := client.SearchKeyword(ctx, "Kademlia talk")
+	if err != nil {
+		t.Fatalf("Search error: %s", err)
+	}
+
+	if result := <-results; result == nil || !result.Hash.Equal(files[1].Hash) {
+		t.Errorf("Only the file that matches all the keywords must be found, got %+v", result)
+	}
+}
+
+func TestIndex_CleanupClock(t *testing.T) {
+	testClock := clock.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	index := NewIndexWithClock(testClock)
+	index.Start()
+	defer index.Close()
+
+	keyword := KeywordHash("kademlia")
+	index.AddKeyword(keyword, types.NewUInt128FromInt(1), net.IPv4(10, 0, 0, 1), TagList{
+		NewStringTag(TagFileName, "kademlia.pdf"), NewIntTag(TagFileSize, 1000),
+	})
+
+	testClock.Advance(indexCleanupPeriod)
+	if results := index.SearchKeyword(keyword, nil); len(results) != 1 {
+		t.Errorf("The keyword must be found before its lifetime")
+	}
+
+	// The expired entries are removed on the next cleanup period of the clock
+	testClock.Advance(keywordLifetime)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		index.access.Lock()
+		count := index.keywords.count
+		index.access.Unlock()
+		if count == 0 {
+			break
+		} else if time.Since(start) > time.Second {
+			t.Fatalf("The expired keywords must be removed")
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package kad
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sleepy/types"
+	"time"
+)
+
+// Files where the index is persisted. The keyword, source and load files use the formats
+// of eMule, and the notes file uses the format of the source file
+const (
+	KeywordIndexFile = "key_index.dat"
+	SourceIndexFile  = "src_index.dat"
+	NotesIndexFile   = "notes_index.dat"
+	LoadIndexFile    = "load_index.dat"
+
+	indexFileVersion             = uint32(2) // Version written, without publish tracking data
+	indexFileVersionWithTracking = uint32(3) // First version with publish tracking data on the keyword files
+	indexFileVersionWithAICH     = uint32(4) // Last version that can be read, with AICH hashes on the tracking data
+	aichHashSize                 = 20        // Size of the AICH hashes of the tracking data
+)
+
+// Save the index on the files of [dir]. The keyword file is bound to our [localId]
+func (index *Index) SaveFiles(dir string, localId *types.UInt128) error {
+	index.access.Lock()
+	defer index.access.Unlock()
+
+	now := index.clock.Now()
+
+	keywords := NewWriter()
+	keywords.WriteUInt32(indexFileVersion)
+	keywords.WriteUInt32(uint32(now.Add(keywordLifetime).Unix()))
+	keywords.WriteUInt128(localId)
+	if err := writeIndexTable(keywords, index.keywords, now); err != nil {
+		return err
+	}
+
+	sources := NewWriter()
+	sources.WriteUInt32(indexFileVersion)
+	sources.WriteUInt32(uint32(now.Add(sourceLifetime).Unix()))
+	if err := writeIndexTable(sources, index.sources, now); err != nil {
+		return err
+	}
+
+	notes := NewWriter()
+	notes.WriteUInt32(indexFileVersion)
+	notes.WriteUInt32(uint32(now.Add(notesLifetime).Unix()))
+	if err := writeIndexTable(notes, index.notes, now); err != nil {
+		return err
+	}
+
+	// The load of the keys is calculated from the stored entries, so there are no loads
+	// to persist. The file is written for compatibility, as eMule does
+	load := NewWriter()
+	load.WriteUInt32(indexFileVersion)
+	load.WriteUInt32(uint32(now.Add(keywordLifetime).Unix()))
+	load.WriteUInt32(0)
+
+	files := map[string]*Writer{
+		KeywordIndexFile: keywords,
+		SourceIndexFile:  sources,
+		NotesIndexFile:   notes,
+		LoadIndexFile:    load,
+	}
+	for name, writer := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), writer.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write the entries of [table] that are not expired, grouped by key and id
+func writeIndexTable(writer *Writer, table *indexTable, now time.Time) error {
+	keys := make(map[types.UInt128][]*indexEntry)
+	for key := range table.keys {
+		if entries := table.get(&key, now); len(entries) > 0 {
+			keys[key] = entries
+		}
+	}
+
+	writer.WriteUInt32(uint32(len(keys)))
+	for key, entries := range keys {
+		writer.WriteUInt128(&key)
+		writer.WriteUInt32(uint32(len(entries)))
+		for _, entry := range entries {
+			writer.WriteUInt128(&entry.id)
+			writer.WriteUInt32(1) // Names of the entry
+			writer.WriteUInt32(uint32(entry.expires.Unix()))
+			if err := writer.WriteTags(entry.tags); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Load the index from the files of [dir], dropping the expired entries. Missing files and
+// keyword files of other id than our [localId] are ignored
+func (index *Index) LoadFiles(dir string, localId *types.UInt128) error {
+	index.access.Lock()
+	defer index.access.Unlock()
+
+	now := index.clock.Now()
+
+	if reader, version, err := readIndexFile(filepath.Join(dir, KeywordIndexFile), now); err != nil {
+		return err
+	} else if reader != nil {
+		id, err := reader.ReadUInt128()
+		if err != nil {
+			return err
+		}
+		if id.Equal(localId) {
+			if err := readIndexTable(reader, index.keywords, now, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	if reader, _, err := readIndexFile(filepath.Join(dir, SourceIndexFile), now); err != nil {
+		return err
+	} else if reader != nil {
+		if err := readIndexTable(reader, index.sources, now, 0); err != nil {
+			return err
+		}
+	}
+
+	if reader, _, err := readIndexFile(filepath.Join(dir, NotesIndexFile), now); err != nil {
+		return err
+	} else if reader != nil {
+		if err := readIndexTable(reader, index.notes, now, 0); err != nil {
+			return err
+		}
+	}
+
+	if reader, _, err := readIndexFile(filepath.Join(dir, LoadIndexFile), now); err != nil {
+		return err
+	} else if reader != nil {
+		// Only validated, see SaveFiles
+		count, err := reader.ReadUInt32()
+		if err != nil {
+			return err
+		}
+		for ; count > 0; count-- {
+			if _, err := reader.ReadUInt128(); err != nil {
+				return err
+			}
+			if _, err := reader.ReadUInt32(); err != nil { // Load time
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Read the header of an index file and get its version. Return a nil reader when the file doesn't exist or
+// its content is expired
+func readIndexFile(path string, now time.Time) (*Reader, uint32, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	reader := NewReader(data)
+	version, err := reader.ReadUInt32()
+	if err != nil {
+		return nil, 0, err
+	} else if version > indexFileVersionWithAICH {
+		return nil, 0, errors.New("unsupported index file version")
+	}
+
+	saveTime, err := reader.ReadUInt32()
+	if err != nil {
+		return nil, 0, err
+	} else if int64(saveTime) <= now.Unix() {
+		return nil, 0, nil
+	}
+
+	return reader, version, nil
+}
+
+// Read the entries of an index file into [table]. The keyword files of version 3 and later
+// have publish tracking data after the lifetime of each entry. The other files pass a
+// [keywordVersion] of 0
+func readIndexTable(reader *Reader, table *indexTable, now time.Time, keywordVersion uint32) error {
+	keyCount, err := reader.ReadUInt32()
+	if err != nil {
+		return err
+	}
+
+	for ; keyCount > 0; keyCount-- {
+		key, err := reader.ReadUInt128()
+		if err != nil {
+			return err
+		}
+
+		idCount, err := reader.ReadUInt32()
+		if err != nil {
+			return err
+		}
+
+		for ; idCount > 0; idCount-- {
+			id, err := reader.ReadUInt128()
+			if err != nil {
+				return err
+			}
+
+			nameCount, err := reader.ReadUInt32()
+			if err != nil {
+				return err
+			}
+
+			for ; nameCount > 0; nameCount-- {
+				lifetime, err := reader.ReadUInt32()
+				if err != nil {
+					return err
+				}
+
+				if keywordVersion >= indexFileVersionWithTracking {
+					withAICH := keywordVersion >= indexFileVersionWithAICH
+					if err := skipPublishTracking(reader, withAICH); err != nil {
+						return err
+					}
+				}
+
+				tags, err := reader.ReadTags()
+				if err != nil {
+					return err
+				}
+
+				expires := time.Unix(int64(lifetime), 0)
+				if !expires.After(now) {
+					continue
+				}
+
+				ip, _ := tags.GetIP(TagSourceIP)
+				table.add(key, &indexEntry{id: *id, ip: ip, tags: tags, expires: expires}, now)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Skip the file names and publisher IPs tracked by eMule for each keyword entry. Since
+// version 4 they come [withAICH] hashes, and each publisher has the index of its hash
+func skipPublishTracking(reader *Reader, withAICH bool) error {
+	if withAICH {
+		hashCount, err := reader.ReadUInt16()
+		if err != nil {
+			return err
+		}
+		if err := reader.Discard(int64(hashCount) * aichHashSize); err != nil {
+			return err
+		}
+	}
+
+	nameCount, err := reader.ReadUInt32()
+	if err != nil {
+		return err
+	}
+
+	for ; nameCount > 0; nameCount-- {
+		if _, err := reader.ReadLengthString(); err != nil {
+			return err
+		}
+		if _, err := reader.ReadUInt32(); err != nil { // Popularity
+			return err
+		}
+	}
+
+	ipCount, err := reader.ReadUInt32()
+	if err != nil {
+		return err
+	}
+
+	// IP and time of the last publish, and the index of the AICH hash
+	publisherSize := int64(4 + 4)
+	if withAICH {
+		publisherSize += 2
+	}
+	return reader.Discard(int64(ipCount) * publisherSize)
+}
@@ -0,0 +1,197 @@
+package kad
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sleepy/types"
+	"sleepy/utils/clock"
+	"testing"
+	"time"
+)
+
+func newTestIndexDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kadindex")
+	if err != nil {
+		t.Fatalf("Temp dir error: %s", err)
+	}
+	return dir
+}
+
+func TestIndex_SaveAndLoadFiles(t *testing.T) {
+	dir := newTestIndexDir(t)
+	defer os.RemoveAll(dir)
+
+	localId := types.NewUInt128FromInt(1)
+	keyword := KeywordHash("kademlia")
+	file := types.NewUInt128FromInt(2)
+	ip := net.IPv4(10, 0, 0, 1)
+
+	index := NewIndex()
+	index.AddKeyword(keyword, file, ip, TagList{NewStringTag(TagFileName, "kademlia.pdf"), NewIntTag(TagFileSize, 100)})
+	index.AddKeyword(keyword, types.NewUInt128FromInt(3), ip, TagList{NewStringTag(TagFileName, "old.pdf"), NewIntTag(TagFileSize, 100)})
+	index.keywords.keys[*keyword][1].expires = time.Now().Add(-time.Minute)
+	index.AddSource(file, types.NewUInt128FromInt(4), ip, 4672, TagList{NewIntTag(TagSourceType, uint64(SourceTypeHighId))})
+	index.AddNote(file, types.NewUInt128FromInt(5), ip, TagList{NewStringTag(TagFileName, "kademlia.pdf")})
+
+	if err := index.SaveFiles(dir, localId); err != nil {
+		t.Fatalf("Save error: %s", err)
+	}
+
+	loaded := NewIndex()
+	if err := loaded.LoadFiles(dir, localId); err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+
+	if results := loaded.SearchKeyword(keyword, nil); len(results) != 1 || !results[0].id.Equal(file) {
+		t.Errorf("Only the alive keyword entries must be loaded, %d found", len(results))
+	} else if name, _ := results[0].tags.GetString(TagFileName); name != "kademlia.pdf" {
+		t.Errorf("File name mismatch, got %s", name)
+	}
+	if results := loaded.SearchSources(file, 0); len(results) != 1 {
+		t.Errorf("The source must be loaded")
+	} else if entry := loaded.sources.keys[*file][0]; !entry.ip.Equal(ip) {
+		t.Errorf("The source ip must be loaded from its tags, got %s", entry.ip)
+	}
+	if results := loaded.SearchNotes(file); len(results) != 1 {
+		t.Errorf("The note must be loaded")
+	}
+
+	other := NewIndex()
+	if err := other.LoadFiles(dir, types.NewUInt128FromInt(9)); err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	if len(other.keywords.keys) != 0 || len(other.sources.keys) != 1 {
+		t.Errorf("The keywords stored for other id can't be loaded")
+	}
+}
+
+func TestIndex_LoadFilesWithTracking(t *testing.T) {
+	dir := newTestIndexDir(t)
+	defer os.RemoveAll(dir)
+
+	localId := types.NewUInt128FromInt(1)
+	now := time.Now()
+
+	writer := NewWriter()
+	writer.WriteUInt32(indexFileVersionWithTracking)
+	writer.WriteUInt32(uint32(now.Add(time.Hour).Unix()))
+	writer.WriteUInt128(localId)
+	writer.WriteUInt32(1)
+	writer.WriteUInt128(KeywordHash("kademlia"))
+	writer.WriteUInt32(1)
+	writer.WriteUInt128(types.NewUInt128FromInt(2))
+	writer.WriteUInt32(1)
+	writer.WriteUInt32(uint32(now.Add(time.Hour).Unix()))
+	writer.WriteUInt32(1) // Tracked names
+	writer.WriteLengthString("kademlia.pdf")
+	writer.WriteUInt32(3)
+	writer.WriteUInt32(1) // Tracked publishers
+	writer.WriteIPv4(net.IPv4(10, 0, 0, 1))
+	writer.WriteUInt32(uint32(now.Unix()))
+	writer.WriteTags(TagList{NewStringTag(TagFileName, "kademlia.pdf"), NewIntTag(TagFileSize, 100)})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, KeywordIndexFile), writer.Bytes(), 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	index := NewIndex()
+	if err := index.LoadFiles(dir, localId); err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	if results := index.SearchKeyword(KeywordHash("kademlia"), nil); len(results) != 1 {
+		t.Errorf("The keyword entry must be loaded")
+	}
+}
+
+func TestIndex_LoadFilesWithAICH(t *testing.T) {
+	dir := newTestIndexDir(t)
+	defer os.RemoveAll(dir)
+
+	localId := types.NewUInt128FromInt(1)
+	now := time.Now()
+
+	// Keyword file of version 4, as written by current eMule versions
+	writer := NewWriter()
+	writer.WriteUInt32(indexFileVersionWithAICH)
+	writer.WriteUInt32(uint32(now.Add(time.Hour).Unix()))
+	writer.WriteUInt128(localId)
+	writer.WriteUInt32(1)
+	writer.WriteUInt128(KeywordHash("kademlia"))
+	writer.WriteUInt32(1)
+	writer.WriteUInt128(types.NewUInt128FromInt(2))
+	writer.WriteUInt32(1)
+	writer.WriteUInt32(uint32(now.Add(time.Hour).Unix()))
+	writer.WriteUInt16(1) // AICH hashes
+	writer.WriteBytes(make([]byte, aichHashSize))
+	writer.WriteUInt32(1) // Tracked names
+	writer.WriteLengthString("kademlia.pdf")
+	writer.WriteUInt32(3)
+	writer.WriteUInt32(1) // Tracked publishers
+	writer.WriteIPv4(net.IPv4(10, 0, 0, 1))
+	writer.WriteUInt32(uint32(now.Unix()))
+	writer.WriteUInt16(0) // AICH hash index
+	writer.WriteTags(TagList{NewStringTag(TagFileName, "kademlia.pdf"), NewIntTag(TagFileSize, 100)})
+
+	if err := ioutil.WriteFile(filepath.Join(dir, KeywordIndexFile), writer.Bytes(), 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	index := NewIndex()
+	if err := index.LoadFiles(dir, localId); err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	if results := index.SearchKeyword(KeywordHash("kademlia"), nil); len(results) != 1 {
+		t.Errorf("The keyword entry must be loaded")
+	} else if name, _ := results[0].tags.GetString(TagFileName); name != "kademlia.pdf" {
+		t.Errorf("File name mismatch, got %s", name)
+	}
+}
+
+func TestIndex_FilesClock(t *testing.T) {
+	dir := newTestIndexDir(t)
+	defer os.RemoveAll(dir)
+
+	localId := types.NewUInt128FromInt(1)
+	file := types.NewUInt128FromInt(2)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	index := NewIndexWithClock(clock.NewManual(start))
+	index.AddSource(file, types.NewUInt128FromInt(3), net.IPv4(10, 0, 0, 1), 4672, TagList{NewIntTag(TagSourceType, uint64(SourceTypeHighId))})
+	if err := index.SaveFiles(dir, localId); err != nil {
+		t.Fatalf("Save error: %s", err)
+	}
+
+	fresh := NewIndexWithClock(clock.NewManual(start.Add(sourceLifetime / 2)))
+	if err := fresh.LoadFiles(dir, localId); err != nil {
+		t.Fatalf("Load error: %s", err)
+	} else if len(fresh.sources.keys) != 1 {
+		t.Errorf("The entries alive on the clock time must be loaded")
+	}
+
+	late := NewIndexWithClock(clock.NewManual(start.Add(sourceLifetime)))
+	if err := late.LoadFiles(dir, localId); err != nil {
+		t.Fatalf("Load error: %s", err)
+	} else if len(late.sources.keys) != 0 {
+		t.Errorf("The entries expired on the clock time can't be loaded")
+	}
+}
+
+func TestIndex_LoadFilesExpired(t *testing.T) {
+	dir := newTestIndexDir(t)
+	defer os.RemoveAll(dir)
+
+	writer := NewWriter()
+	writer.WriteUInt32(indexFileVersion)
+	writer.WriteUInt32(uint32(time.Now().Add(-time.Hour).Unix()))
+	writer.WriteUInt32(1) // Truncated content that mustn't be read
+
+	if err := ioutil.WriteFile(filepath.Join(dir, SourceIndexFile), writer.Bytes(), 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	if err := NewIndex().LoadFiles(dir, types.NewUInt128FromInt(1)); err != nil {
+		t.Errorf("Expired files must be ignored, got %s", err)
+	}
+}
@@ -0,0 +1,351 @@
+package kad
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sleepy/network/kad/router"
+	kadTypes "sleepy/network/kad/types"
+	"sleepy/types"
+	"sleepy/utils/event"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lookup types sent on KADEMLIA2_REQ. The value is also the number of contacts requested
+const (
+	LookupFindValue = byte(0x02)
+	LookupStore     = byte(0x04)
+	LookupFindNode  = byte(0x0B)
+)
+
+const (
+	maxLookupResponses = 64              // Responses buffered for each in-flight lookup
+	lookupAlpha        = 3               // Requests sent in parallel on each round
+	lookupK            = 10              // Closest peers that must answer to end a lookup
+	lookupTimeout      = 3 * time.Second // Time to wait for the response of each peer
+	maxLookupPeers     = 50              // Max candidates tracked by a lookup
+	refreshLookupTime  = time.Minute     // Max duration of the lookups requested by the router
+)
+
+// State of a lookup candidate
+const (
+	candidatePending = iota
+	candidateQueried
+	candidateAnswered
+	candidateFailed
+)
+
+// Peer that can be asked on a lookup
+type lookupCandidate struct {
+	peer     *kadTypes.Peer
+	distance *types.UInt128
+	state    int
+	deadline time.Time
+}
+
+// Iterative Kademlia lookup. Each round asks the [alpha] closest pending candidates for
+// contacts closer to the target, until the [k] closest candidates have answered
+type lookup struct {
+	client     *Client
+	target     *types.UInt128
+	lookupType byte
+	alpha      int
+	k          int
+	timeout    time.Duration
+	candidates []*lookupCandidate
+	waiter     *lookupWaiter
+}
+
+func newLookup(client *Client, target *types.UInt128, lookupType byte) *lookup {
+	return &lookup{
+		client:     client,
+		target:     target.Clone(),
+		lookupType: lookupType,
+		alpha:      lookupAlpha,
+		k:          lookupK,
+		timeout:    lookupTimeout,
+		candidates: make([]*lookupCandidate, 0, maxLookupPeers),
+	}
+}
+
+// Run an iterative lookup of [target] and get the closest peers to it that answered,
+// ordered by distance. [lookupType] is the KADEMLIA2_REQ type (LookupFindNode,
+// LookupFindValue or LookupStore) and sets how many contacts each peer returns
+func (client *Client) Lookup(ctx context.Context, target *types.UInt128, lookupType byte) ([]*kadTypes.Peer, error) {
+	if client.router == nil {
+		return nil, errors.New("the client has no router")
+	}
+
+	return newLookup(client, target, lookupType).run(ctx)
+}
+
+// Add peers to the candidates, keeping them ordered by distance
+func (lookup *lookup) addCandidates(peers []*kadTypes.Peer) {
+	localId := lookup.client.Id()
+
+	for _, peer := range peers {
+		if peer.Id().Equal(localId) || lookup.findById(peer.Id()) != nil {
+			continue
+		}
+
+		lookup.candidates = append(lookup.candidates, &lookupCandidate{
+			peer:     peer,
+			distance: peer.GetDistance(lookup.target),
+			state:    candidatePending,
+		})
+	}
+
+	sort.SliceStable(lookup.candidates, func(i int, j int) bool {
+		return lookup.candidates[i].distance.Compare(lookup.candidates[j].distance) < 0
+	})
+
+	// Forget the farthest candidates that were never asked
+	for len(lookup.candidates) > maxLookupPeers {
+		last := len(lookup.candidates) - 1
+		if lookup.candidates[last].state == candidateQueried {
+			break
+		}
+		lookup.candidates = lookup.candidates[:last]
+	}
+}
+
+func (lookup *lookup) findById(id *types.UInt128) *lookupCandidate {
+	for _, candidate := range lookup.candidates {
+		if candidate.peer.Id().Equal(id) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+func (lookup *lookup) findByAddr(addr *net.UDPAddr) *lookupCandidate {
+	for _, candidate := range lookup.candidates {
+		if candidate.state == candidateQueried && candidate.peer.IP().Equal(addr.IP) && int(candidate.peer.UDPPort()) == addr.Port {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// Check if the [k] closest candidates that didn't fail have answered
+func (lookup *lookup) isDone() bool {
+	alive := 0
+	for _, candidate := range lookup.candidates {
+		if alive >= lookup.k {
+			break
+		}
+		switch candidate.state {
+		case candidateFailed:
+			continue
+		case candidateAnswered:
+			alive++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Mark as failed the queried candidates without answer, and ask the closest pending ones
+func (lookup *lookup) nextRound(now time.Time) {
+	inFlight := 0
+	for _, candidate := range lookup.candidates {
+		if candidate.state == candidateQueried {
+			if now.After(candidate.deadline) {
+				candidate.state = candidateFailed
+			} else {
+				inFlight++
+			}
+		}
+	}
+
+	for _, candidate := range lookup.candidates {
+		if inFlight >= lookup.alpha {
+			break
+		}
+		if candidate.state == candidatePending {
+			lookup.client.lookups.query(lookup.waiter, peerAddr(candidate.peer))
+			err := lookup.client.sendLookupRequest(candidate.peer, lookup.target, lookup.lookupType)
+			if err != nil {
+				candidate.state = candidateFailed
+				continue
+			}
+
+			candidate.state = candidateQueried
+			candidate.deadline = now.Add(lookup.timeout)
+			inFlight++
+		}
+	}
+}
+
+// Get the peers that answered, ordered by distance
+func (lookup *lookup) answered() []*kadTypes.Peer {
+	peers := make([]*kadTypes.Peer, 0, lookup.k)
+	for _, candidate := range lookup.candidates {
+		if candidate.state == candidateAnswered && len(peers) < lookup.k {
+			peers = append(peers, candidate.peer)
+		}
+	}
+	return peers
+}
+
+func (lookup *lookup) run(ctx context.Context) ([]*kadTypes.Peer, error) {
+	lookup.waiter = lookup.client.lookups.register(lookup.target)
+	defer lookup.client.lookups.unregister(lookup.target, lookup.waiter)
+
+	lookup.addCandidates(lookup.client.router.GetClosestPeers(lookup.target, lookup.k))
+	if len(lookup.candidates) == 0 {
+		return nil, errors.New("there are no peers to start the lookup")
+	}
+
+	ticker := time.NewTicker(lookup.timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		lookup.nextRound(time.Now())
+		if lookup.isDone() {
+			peers := lookup.answered()
+			if len(peers) == 0 {
+				return nil, errors.New("no peer answered the lookup")
+			}
+			return peers, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return lookup.answered(), ctx.Err()
+		case response := <-lookup.waiter.responses:
+			candidate := lookup.findByAddr(response.from)
+			if candidate != nil {
+				candidate.state = candidateAnswered
+				lookup.addCandidates(response.contacts)
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// Contacts received on a KADEMLIA2_RES
+type lookupResponse struct {
+	from     *net.UDPAddr
+	contacts []*kadTypes.Peer
+}
+
+// Lookup waiting for KADEMLIA2_RES, with the addresses of the peers that it asked
+type lookupWaiter struct {
+	responses chan lookupResponse
+	queried   map[string]bool
+}
+
+// In-flight lookups waiting for KADEMLIA2_RES, by target. Several lookups of the same
+// target can run at once, each one only gets the responses of the peers that it asked
+type lookupRegistry struct {
+	lookups map[types.UInt128][]*lookupWaiter
+	access  sync.Mutex
+}
+
+// Register a lookup for [target] and get the waiter where the responses will be delivered
+func (registry *lookupRegistry) register(target *types.UInt128) *lookupWaiter {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	if registry.lookups == nil {
+		registry.lookups = make(map[types.UInt128][]*lookupWaiter)
+	}
+
+	waiter := &lookupWaiter{
+		responses: make(chan lookupResponse, maxLookupResponses),
+		queried:   make(map[string]bool),
+	}
+	registry.lookups[*target] = append(registry.lookups[*target], waiter)
+	return waiter
+}
+
+// Remove the [waiter] of a lookup for [target]
+func (registry *lookupRegistry) unregister(target *types.UInt128, waiter *lookupWaiter) {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	waiters := registry.lookups[*target]
+	for index := range waiters {
+		if waiters[index] == waiter {
+			waiters = append(waiters[:index:index], waiters[index+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(registry.lookups, *target)
+	} else {
+		registry.lookups[*target] = waiters
+	}
+}
+
+// Record that the lookup of [waiter] asked the peer on [addr], so its response is expected
+func (registry *lookupRegistry) query(waiter *lookupWaiter, addr *net.UDPAddr) {
+	registry.access.Lock()
+	waiter.queried[addr.String()] = true
+	registry.access.Unlock()
+}
+
+// Deliver a response to the lookups for [target] that asked its sender. Return false if
+// nobody is waiting for it
+func (registry *lookupRegistry) deliver(target *types.UInt128, response lookupResponse) bool {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	if response.from == nil {
+		return false
+	}
+
+	delivered := false
+	for _, waiter := range registry.lookups[*target] {
+		if !waiter.queried[response.from.String()] {
+			continue
+		}
+
+		select {
+		case waiter.responses <- response:
+			// Each peer only answers once
+			delete(waiter.queried, response.from.String())
+			delivered = true
+		default:
+			// The lookup is not consuming responses, drop it
+		}
+	}
+	return delivered
+}
+
+// Ask [peer] for the contacts it knows closest to [target]
+func (client *Client) sendLookupRequest(peer *kadTypes.Peer, target *types.UInt128, lookupType byte) error {
+	payload := NewWriter()
+	payload.WriteByte(lookupType)
+	payload.WriteUInt128(target)
+	payload.WriteUInt128(peer.Id())
+	return client.sendToPeer(peer, CommKad2Req, payload.Bytes())
+}
+
+// Run a lookup of the random id requested by the router, to refresh a zone. The
+// contacts found are added to the router when the responses are handled. The lookup
+// ends when the client stops
+func (client *Client) onPeerLookupRequest(sender interface{}, args event.Args) {
+	idArgs, ok := args.(router.PeerIdEventArgs)
+	if !ok {
+		return
+	}
+
+	if !client.startTask() {
+		return
+	}
+	defer client.tasks.Done()
+
+	ctx, cancel := context.WithTimeout(client.ctx, refreshLookupTime)
+	defer cancel()
+
+	if _, err := client.Lookup(ctx, &idArgs.Id, LookupFindNode); err != nil {
+		log.Printf("Refresh lookup error: %s", err)
+	}
+}
@@ -0,0 +1,254 @@
+package kad
+
+import (
+	"context"
+	"net"
+	"sleepy/network/ed2k"
+	"sleepy/network/kad/router"
+	kadTypes "sleepy/network/kad/types"
+	"sleepy/types"
+	"testing"
+	"time"
+)
+
+// Create the peer that represents [client] on the routing table of other clients
+func newTestClientPeer(client *Client) *kadTypes.Peer {
+	addr := client.serverConn.LocalAddr().(*net.UDPAddr)
+	peer := kadTypes.NewPeer(client.Id())
+	peer.SetIP(addr.IP, true)
+	peer.SetUDPPort(uint16(addr.Port))
+	peer.SetProtocolVersion(kadVersion)
+	return peer
+}
+
+func TestLookupRegistry(t *testing.T) {
+	registry := lookupRegistry{}
+	target := types.NewUInt128FromInt(1)
+
+	if registry.deliver(target, lookupResponse{}) {
+		t.Errorf("Responses without lookup can't be delivered")
+	}
+
+	waiter := registry.register(target)
+	other := registry.register(target)
+
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 4672}
+	if registry.deliver(target, lookupResponse{from: from}) {
+		t.Errorf("Responses from peers that were not asked can't be delivered")
+	}
+
+	registry.query(waiter, from)
+	if !registry.deliver(target, lookupResponse{from: from, contacts: []*kadTypes.Peer{newTestPeer(2)}}) {
+		t.Errorf("Response must be delivered")
+	} else if response := <-waiter.responses; len(response.contacts) != 1 {
+		t.Errorf("Response contacts mismatch")
+	} else if len(other.responses) != 0 {
+		t.Errorf("Only the lookups that asked the peer get its response")
+	} else if registry.deliver(target, lookupResponse{from: from}) {
+		t.Errorf("Each peer only can answer once")
+	}
+
+	registry.query(waiter, from)
+	registry.unregister(target, waiter)
+	if registry.deliver(target, lookupResponse{from: from}) {
+		t.Errorf("Responses after unregister can't be delivered")
+	}
+
+	registry.query(other, from)
+	if !registry.deliver(target, lookupResponse{from: from}) {
+		t.Errorf("The other lookup of the target must keep its responses")
+	}
+	registry.unregister(target, other)
+	if len(registry.lookups) != 0 {
+		t.Errorf("The targets without lookups must be removed")
+	}
+}
+
+func TestHandleLookup(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+	otherClient := newTestClient(t)
+	defer closeTestClient(otherClient)
+
+	for i := 1; i <= 10; i++ {
+		otherClient.router.AddPeer(newTestPeer(i))
+	}
+
+	target := types.NewUInt128FromInt(3)
+	waiter := client.lookups.register(target)
+	defer client.lookups.unregister(target, waiter)
+
+	otherPeer := newTestClientPeer(otherClient)
+	client.lookups.query(waiter, peerAddr(otherPeer))
+	if err := client.sendLookupRequest(otherPeer, target, LookupFindValue); err != nil {
+		t.Fatalf("Lookup request error: %s", err)
+	}
+	relayTestPacket(t, otherClient)
+	relayTestPacket(t, client)
+
+	response := <-waiter.responses
+	if len(response.contacts) != int(LookupFindValue) {
+		t.Fatalf("Must receive %d contacts, %d found", LookupFindValue, len(response.contacts))
+	}
+	if !response.contacts[0].Id().Equal(target) {
+		t.Errorf("The first contact must be the target, 0x%s found", response.contacts[0].Id().ToHexString())
+	}
+	for _, contact := range response.contacts {
+		if !client.router.ContainsPeer(contact.Id()) {
+			t.Errorf("The received contacts must be added to the router")
+		}
+	}
+}
+
+func TestHandleLookupRequest_WrongCheck(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	writer := NewWriter()
+	writer.WriteByte(LookupFindNode)
+	writer.WriteUInt128(types.NewUInt128FromInt(3))
+	writer.WriteUInt128(types.NewUInt128FromInt(4))
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}
+	if HandleLookupRequest(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)) == nil {
+		t.Errorf("Must fail with requests sent to other id")
+	}
+}
+
+func TestHandleLookupResponse_Unexpected(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	writer := NewWriter()
+	writer.WriteUInt128(types.NewUInt128FromInt(3))
+	writer.WriteByte(1)
+	writer.WritePeer(newTestPeer(3))
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}
+	packet := append([]byte{ed2k.ProtKadUDP, CommKad2Res}, writer.Bytes()...)
+	if client.handleUDP(packet, from) == nil {
+		t.Errorf("Must fail with responses without lookup in progress")
+	}
+
+	// A lookup in progress doesn't accept the responses of peers that it didn't ask
+	target := types.NewUInt128FromInt(3)
+	waiter := client.lookups.register(target)
+	defer client.lookups.unregister(target, waiter)
+
+	if client.handleUDP(packet, from) == nil {
+		t.Errorf("Must fail with responses from peers that were not asked")
+	} else if client.router.ContainsPeer(target) {
+		t.Errorf("The contacts of unexpected responses can't be added to the router")
+	}
+}
+
+func TestHandleLookupResponse_KnownContact(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	known := newTestPeer(3)
+	client.router.AddPeer(known)
+
+	// The response lists the known id with other address
+	moved := newTestPeer(3)
+	moved.SetIP(net.IPv4(10, 9, 9, 9), true)
+	writer := NewWriter()
+	writer.WriteUInt128(types.NewUInt128FromInt(3))
+	writer.WriteByte(1)
+	writer.WritePeer(moved)
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}
+	target := types.NewUInt128FromInt(3)
+	waiter := client.lookups.register(target)
+	defer client.lookups.unregister(target, waiter)
+	client.lookups.query(waiter, from)
+
+	packet := append([]byte{ed2k.ProtKadUDP, CommKad2Res}, writer.Bytes()...)
+	if err := client.handleUDP(packet, from); err != nil {
+		t.Fatalf("Lookup response error: %s", err)
+	}
+
+	peer, err := client.router.GetPeer(target)
+	if err != nil {
+		t.Fatalf("The known contact must be kept: %s", err)
+	}
+	if !peer.IP().Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Errorf("The contacts of a response can't change the known ones, IP %s found", peer.IP())
+	}
+}
+
+// Create a client with router that handles the datagrams it receives
+func startTestClient(t *testing.T) *Client {
+	client := newTestClient(t)
+	client.listen()
+	return client
+}
+
+func TestClient_Lookup(t *testing.T) {
+	clients := make([]*Client, 5)
+	for i := range clients {
+		clients[i] = startTestClient(t)
+		defer closeTestClient(clients[i])
+	}
+
+	// Each client only knows the next ones, the last two don't know anybody
+	clients[0].router.AddPeer(newTestClientPeer(clients[1]))
+	clients[1].router.AddPeer(newTestClientPeer(clients[2]))
+	clients[1].router.AddPeer(newTestClientPeer(clients[3]))
+	clients[2].router.AddPeer(newTestClientPeer(clients[4]))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	peers, err := clients[0].Lookup(ctx, clients[4].Id(), LookupFindNode)
+	if err != nil {
+		t.Fatalf("Lookup error: %s", err)
+	} else if len(peers) != 4 {
+		t.Errorf("The 4 other clients must answer, %d found", len(peers))
+	} else if !peers[0].Id().Equal(clients[4].Id()) {
+		t.Errorf("The closest peer must be the target")
+	}
+
+	for i := 1; i < len(peers); i++ {
+		if peers[i-1].GetDistance(clients[4].Id()).Compare(peers[i].GetDistance(clients[4].Id())) > 0 {
+			t.Errorf("The peers must be ordered by distance")
+		}
+	}
+}
+
+func TestClient_LookupTimeout(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+
+	// A peer that never answers
+	silent := newTestClient(t)
+	client.router.AddPeer(newTestClientPeer(silent))
+	closeTestClient(silent)
+
+	lookup := newLookup(client, types.NewUInt128FromInt(1), LookupFindNode)
+	lookup.timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	if _, err := lookup.run(context.Background()); err == nil {
+		t.Errorf("Must fail when no peer answers")
+	} else if time.Since(start) > time.Second {
+		t.Errorf("The lookup must end after the request timeout")
+	}
+}
+
+func TestClient_LookupRequestEvent(t *testing.T) {
+	clients := make([]*Client, 3)
+	for i := range clients {
+		clients[i] = startTestClient(t)
+		defer closeTestClient(clients[i])
+	}
+
+	clients[0].router.AddPeer(newTestClientPeer(clients[1]))
+	clients[1].router.AddPeer(newTestClientPeer(clients[2]))
+
+	clients[0].onPeerLookupRequest(clients[0].router, router.PeerIdEventArgs{Id: *clients[2].Id()})
+
+	if !clients[0].router.ContainsPeer(clients[2].Id()) {
+		t.Errorf("The contacts found by the refresh lookup must be added to the router")
+	}
+}
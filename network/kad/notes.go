@@ -0,0 +1,103 @@
+package kad
+
+import (
+	"context"
+	"errors"
+	"sleepy/types"
+)
+
+const (
+	maxNoteResults = 50 // Max results returned by a notes search
+)
+
+// Note is a comment and rating about a file
+type Note struct {
+	FileName string
+	Rating   byte // From 1 (fake) to 5 (excellent), or 0 if not rated
+	Comment  string
+}
+
+// NoteResult is a note published by other peer
+type NoteResult struct {
+	Note
+	Id   *types.UInt128 // User hash of the author
+	Tags TagList
+}
+
+// Create a note result from the entry of a search response
+func newNoteResult(entry searchEntry) (*NoteResult, error) {
+	name, ok := entry.tags.GetString(TagFileName)
+	if !ok {
+		return nil, errors.New("note without file name")
+	}
+
+	rating, _ := entry.tags.GetInt(TagFileRating)
+	if rating > 5 {
+		return nil, errors.New("note with invalid rating")
+	}
+
+	comment, _ := entry.tags.GetString(TagDescription)
+
+	return &NoteResult{
+		Note: Note{FileName: name, Rating: byte(rating), Comment: comment},
+		Id:   entry.id,
+		Tags: entry.tags,
+	}, nil
+}
+
+// Get the tags that publish [note] for a file of [size]
+func (note *Note) tags(size uint64) TagList {
+	tags := TagList{NewStringTag(TagFileName, note.FileName)}
+	if note.Rating != 0 {
+		tags = append(tags, NewIntTag(TagFileRating, uint64(note.Rating)))
+	}
+	if note.Comment != "" {
+		tags = append(tags, NewStringTag(TagDescription, note.Comment))
+	}
+	return append(tags, NewIntTag(TagFileSize, size))
+}
+
+// Search the notes published about the file with the ed2k [fileHash] and [size]. The
+// results are streamed over the returned channel, that is closed when the search ends
+func (client *Client) SearchNotes(ctx context.Context, fileHash *types.UInt128, size uint64) (<-chan *NoteResult, error) {
+	payload := NewWriter()
+	payload.WriteUInt128(fileHash)
+	payload.WriteUInt64(size)
+
+	results := make(chan *NoteResult)
+	err := client.streamSearchResults(ctx, fileHash, CommKad2SearchNotesReq, payload.Bytes(), maxNoteResults, func(ctx context.Context, entry searchEntry) bool {
+		result, err := newNoteResult(entry)
+		if err != nil {
+			return false
+		}
+
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+		return true
+	}, func() { close(results) })
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Publish our [note] about the file with the ed2k [fileHash] and [size] on the peers
+// closest to the file hash
+func (client *Client) PublishNote(ctx context.Context, fileHash *types.UInt128, size uint64, note Note) (*PublishResult, error) {
+	if note.FileName == "" {
+		return nil, errors.New("the note must have the file name")
+	} else if note.Rating > 5 {
+		return nil, errors.New("the note rating must be between 0 and 5")
+	}
+
+	payload := NewWriter()
+	payload.WriteUInt128(fileHash)
+	payload.WriteUInt128(&client.userHash)
+	if err := payload.WriteTags(note.tags(size)); err != nil {
+		return nil, err
+	}
+
+	return client.publish(ctx, fileHash, CommKad2PublishNotesReq, payload.Bytes())
+}
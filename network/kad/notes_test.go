@@ -0,0 +1,96 @@
+package kad
+
+import (
+	"context"
+	"sleepy/types"
+	"testing"
+	"time"
+)
+
+func TestClient_PublishAndSearchNotes(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+	peer := startTestClient(t)
+	defer closeTestClient(peer)
+
+	client.router.AddPeer(newTestClientPeer(peer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A file hash in the tolerance zone of the peer
+	fileHash := types.Xor(peer.Id(), types.NewUInt128FromInt(0xf11e))
+	note := Note{FileName: "file.txt", Rating: 4, Comment: "Good quality"}
+	if result, err := client.PublishNote(ctx, fileHash, 1000, note); err != nil {
+		t.Fatalf("Publish error: %s", err)
+	} else if result.Peers != 1 {
+		t.Errorf("The peer must confirm the publish")
+	}
+
+	results, err := client.SearchNotes(ctx, fileHash, 1000)
+	if err != nil {
+		t.Fatalf("Search error: %s", err)
+	}
+
+	result := <-results
+	if result == nil {
+		t.Fatalf("The published note must be found")
+	}
+	if result.Note != note || !result.Id.Equal(client.UserHash()) {
+		t.Errorf("Note mismatch: %+v", result)
+	}
+}
+
+func TestClient_PublishNoteOutOfTolerance(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	writer := NewWriter()
+	writer.WriteUInt128(types.Not(client.Id()))
+	writer.WriteUInt128(types.NewUInt128FromInt(2))
+	writer.WriteTags(TagList{NewStringTag(TagFileName, "file.txt")})
+
+	if HandlePublishNotesRequest(client, newTestRequest(nil, writer.Bytes()), nil) == nil {
+		t.Errorf("Must fail with notes far from our id")
+	}
+}
+
+func TestClient_SearchSourcesAndNotes(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+	peer := startTestClient(t)
+	defer closeTestClient(peer)
+
+	client.tcpPort = 4662
+	client.router.AddPeer(newTestClientPeer(peer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fileHash := types.Xor(peer.Id(), types.NewUInt128FromInt(0xf11e))
+	file := &SharedFile{Hash: fileHash, Name: "file.txt", Size: 1000}
+	note := Note{FileName: "file.txt", Rating: 4, Comment: "Good quality"}
+	if _, err := client.PublishSource(ctx, file); err != nil {
+		t.Fatalf("Source publish error: %s", err)
+	}
+	if _, err := client.PublishNote(ctx, fileHash, 1000, note); err != nil {
+		t.Fatalf("Note publish error: %s", err)
+	}
+
+	// Both searches of the same file run at once, each one gets its own results
+	sources, err := client.SearchSources(ctx, fileHash, 1000)
+	if err != nil {
+		t.Fatalf("Source search error: %s", err)
+	}
+	notes, err := client.SearchNotes(ctx, fileHash, 1000)
+	if err != nil {
+		t.Fatalf("Notes search error: %s", err)
+	}
+
+	if source := <-sources; source == nil || !source.Id.Equal(client.UserHash()) || source.TCPPort != 4662 {
+		t.Errorf("Source mismatch: %+v", source)
+	}
+	if result := <-notes; result == nil || result.Note != note {
+		t.Errorf("Note mismatch: %+v", result)
+	}
+}
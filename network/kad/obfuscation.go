@@ -0,0 +1,170 @@
+package kad
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sleepy/network/ed2k"
+	"sleepy/types"
+)
+
+// Kad UDP obfuscation, compatible with eMule's EncryptedDatagramSocket.
+//
+// An obfuscated Kad datagram has the following layout:
+//
+//	[marker 1][random key part 2] and, RC4 encrypted,
+//	[magic 4][padding length 1][padding][receiver verify key 4][sender verify key 4][packet]
+//
+// The RC4 key is the MD5 of the receiver Kad ID, or of his UDP verify key when the
+// sender doesn't know the ID, followed by the random key part.
+const (
+	magicValueUDPSyncClient   = uint32(0x395F2EC1)
+	cryptHeaderWithoutPadding = 8
+	kadVerifyKeysSize         = 8
+
+	obfuscationMarkerKad       = byte(0x01) // Marker bit to 0 on Kad packets and to 1 on ed2k
+	obfuscationMarkerVerifyKey = byte(0x02) // Marker bit to 1 if the receiver verify key was used
+)
+
+// Check if the byte is a protocol header, so the datagram is not obfuscated
+func isProtocolMarker(marker byte) bool {
+	switch marker {
+	case ed2k.ProtEmuleTCP, ed2k.ProtKadUDPCompress, ed2k.ProtKadUDP, ed2k.ProtEmuleUDPR1, ed2k.ProtEmuleUDPR2, ed2k.ProtEmuleTCPCompress:
+		return true
+	default:
+		return false
+	}
+}
+
+// Calculate the UDP verify key that we give to the peer with the passed [ip]
+func udpVerifyKey(baseKey uint32, ip net.IP) uint32 {
+	buffer := make([]byte, 8)
+	copy(buffer[0:4], ip.To4())
+	binary.LittleEndian.PutUint32(buffer[4:8], baseKey)
+
+	hash := md5.Sum(buffer)
+	key := binary.LittleEndian.Uint32(hash[0:4]) ^ binary.LittleEndian.Uint32(hash[4:8]) ^
+		binary.LittleEndian.Uint32(hash[8:12]) ^ binary.LittleEndian.Uint32(hash[12:16])
+
+	return key%0xFFFFFFFE + 1
+}
+
+// Create the RC4 cipher from the Kad [id] and the random key part
+func kadIdCipher(id *types.UInt128, randomKeyPart []byte) (*rc4.Cipher, error) {
+	hash := md5.Sum(append(id.ToKadBytes(), randomKeyPart...))
+	return rc4.NewCipher(hash[:])
+}
+
+// Create the RC4 cipher from the verify key and the random key part
+func verifyKeyCipher(verifyKey uint32, randomKeyPart []byte) (*rc4.Cipher, error) {
+	keyData := make([]byte, 4, 6)
+	binary.LittleEndian.PutUint32(keyData, verifyKey)
+	hash := md5.Sum(append(keyData, randomKeyPart...))
+	return rc4.NewCipher(hash[:])
+}
+
+// Obfuscate a Kad [packet]. If [targetId] is nil, the [receiverKey] is used to create the key
+func obfuscatePacket(packet []byte, targetId *types.UInt128, receiverKey uint32, senderKey uint32) ([]byte, error) {
+	random := make([]byte, 3)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+
+	var cipher *rc4.Cipher
+	var err error
+	marker := random[0] &^ obfuscationMarkerKad
+
+	if targetId != nil {
+		marker &^= obfuscationMarkerVerifyKey
+		cipher, err = kadIdCipher(targetId, random[1:3])
+	} else if receiverKey != 0 {
+		marker |= obfuscationMarkerVerifyKey
+		cipher, err = verifyKeyCipher(receiverKey, random[1:3])
+	} else {
+		return nil, errors.New("the target id or the receiver key are required to obfuscate")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the two low bits are significant, so the others can be changed to avoid protocol markers
+	for isProtocolMarker(marker) {
+		marker += 0x04
+	}
+
+	header := NewWriter()
+	header.WriteUInt32(magicValueUDPSyncClient)
+	header.WriteByte(0) // Padding length. Padding is disabled for UDP
+	header.WriteUInt32(receiverKey)
+	header.WriteUInt32(senderKey)
+	header.WriteBytes(packet)
+
+	obfuscated := make([]byte, 3+header.Len())
+	obfuscated[0] = marker
+	copy(obfuscated[1:3], random[1:3])
+	cipher.XORKeyStream(obfuscated[3:], header.Bytes())
+
+	return obfuscated, nil
+}
+
+// Deobfuscate a Kad [packet] trying the keys derived from our [localId] and from the
+// [localKey] that we gave to the sender. Return the plain packet and the verify keys
+func deobfuscatePacket(packet []byte, localId *types.UInt128, localKey uint32) (plain []byte, receiverKey uint32, senderKey uint32, err error) {
+	if len(packet) <= cryptHeaderWithoutPadding+kadVerifyKeysSize {
+		return nil, 0, 0, errors.New("datagram too short to be obfuscated")
+	} else if isProtocolMarker(packet[0]) {
+		return nil, 0, 0, errors.New("the datagram is not obfuscated")
+	}
+
+	randomKeyPart := packet[1:3]
+	idCipher, err := kadIdCipher(localId, randomKeyPart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	keyCipher, err := verifyKeyCipher(localKey, randomKeyPart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// The marker is only an indicator of the key to try first, old clients set it random
+	ciphers := []*rc4.Cipher{idCipher, keyCipher}
+	if packet[0]&obfuscationMarkerVerifyKey != 0 {
+		ciphers[0], ciphers[1] = ciphers[1], ciphers[0]
+	}
+
+	magic := make([]byte, 4)
+	var cipher *rc4.Cipher
+	for _, candidate := range ciphers {
+		candidate.XORKeyStream(magic, packet[3:7])
+		if binary.LittleEndian.Uint32(magic) == magicValueUDPSyncClient {
+			cipher = candidate
+			break
+		}
+	}
+
+	if cipher == nil {
+		return nil, 0, 0, errors.New("the datagram can't be deobfuscated with our keys")
+	}
+
+	padLen := make([]byte, 1)
+	cipher.XORKeyStream(padLen, packet[7:8])
+	remaining := packet[cryptHeaderWithoutPadding:]
+	if len(remaining) <= int(padLen[0])+kadVerifyKeysSize {
+		return nil, 0, 0, errors.New("obfuscated datagram with mismatching size")
+	}
+
+	padding := make([]byte, padLen[0])
+	cipher.XORKeyStream(padding, remaining[:padLen[0]])
+	remaining = remaining[padLen[0]:]
+
+	plain = make([]byte, len(remaining))
+	cipher.XORKeyStream(plain, remaining)
+
+	receiverKey = binary.LittleEndian.Uint32(plain[0:4])
+	senderKey = binary.LittleEndian.Uint32(plain[4:8])
+	return plain[kadVerifyKeysSize:], receiverKey, senderKey, nil
+}
@@ -0,0 +1,147 @@
+package kad
+
+import (
+	"bytes"
+	"net"
+	"sleepy/network/ed2k"
+	kadTypes "sleepy/network/kad/types"
+	"sleepy/types"
+	"testing"
+)
+
+func TestObfuscation_KadId(t *testing.T) {
+	localId := types.NewUInt128(0x0123456789abcdef, 0xfedcba9876543210)
+	packet := []byte{ed2k.ProtKadUDP, CommKad2Ping}
+
+	obfuscated, err := obfuscatePacket(packet, localId, 0, 5678)
+	if err != nil {
+		t.Fatalf("Obfuscation error: %s", err)
+	} else if isProtocolMarker(obfuscated[0]) || obfuscated[0]&0x03 != 0 {
+		t.Errorf("Invalid marker for Kad id obfuscation: %x", obfuscated[0])
+	}
+
+	plain, receiverKey, senderKey, err := deobfuscatePacket(obfuscated, localId, 1234)
+	if err != nil {
+		t.Fatalf("Deobfuscation error: %s", err)
+	} else if !bytes.Equal(plain, packet) {
+		t.Errorf("Packet mismatch, got: %x, want: %x", plain, packet)
+	} else if receiverKey != 0 || senderKey != 5678 {
+		t.Errorf("Verify keys mismatch, got: %d and %d", receiverKey, senderKey)
+	}
+
+	if _, _, _, err := deobfuscatePacket(obfuscated, types.NewUInt128FromInt(1), 1234); err == nil {
+		t.Errorf("Must fail with other Kad id")
+	}
+}
+
+func TestObfuscation_VerifyKey(t *testing.T) {
+	localId := types.NewUInt128FromInt(1)
+	packet := []byte{ed2k.ProtKadUDP, CommKad2Pong, 0x36, 0x12}
+
+	obfuscated, err := obfuscatePacket(packet, nil, 1234, 5678)
+	if err != nil {
+		t.Fatalf("Obfuscation error: %s", err)
+	} else if isProtocolMarker(obfuscated[0]) || obfuscated[0]&0x03 != 0x02 {
+		t.Errorf("Invalid marker for verify key obfuscation: %x", obfuscated[0])
+	}
+
+	plain, receiverKey, senderKey, err := deobfuscatePacket(obfuscated, localId, 1234)
+	if err != nil {
+		t.Fatalf("Deobfuscation error: %s", err)
+	} else if !bytes.Equal(plain, packet) {
+		t.Errorf("Packet mismatch, got: %x, want: %x", plain, packet)
+	} else if receiverKey != 1234 || senderKey != 5678 {
+		t.Errorf("Verify keys mismatch, got: %d and %d", receiverKey, senderKey)
+	}
+
+	if _, err := obfuscatePacket(packet, nil, 0, 5678); err == nil {
+		t.Errorf("Must fail without keys")
+	}
+	if _, _, _, err := deobfuscatePacket(packet, localId, 1234); err == nil {
+		t.Errorf("Must fail with plain packets")
+	}
+}
+
+func TestObfuscation_UDPVerifyKey(t *testing.T) {
+	ip1 := net.IPv4(100, 101, 102, 103)
+	ip2 := net.IPv4(100, 101, 102, 104)
+
+	if udpVerifyKey(1, ip1) != udpVerifyKey(1, ip1) {
+		t.Errorf("The verify key must be stable")
+	} else if udpVerifyKey(1, ip1) == udpVerifyKey(1, ip2) || udpVerifyKey(1, ip1) == udpVerifyKey(2, ip1) {
+		t.Errorf("The verify key must depend on the IP and the base key")
+	} else if udpVerifyKey(1, ip1) == 0 {
+		t.Errorf("The verify key can't be 0")
+	}
+}
+
+func TestClient_HandleObfuscatedDatagram(t *testing.T) {
+	client, peerConn := newTestClientPair(t)
+	defer client.serverConn.Close()
+	defer peerConn.Close()
+
+	from := peerConn.LocalAddr().(*net.UDPAddr)
+	packet, _ := obfuscatePacket([]byte{ed2k.ProtKadUDP, CommKad2Pong, 0x36, 0x12}, client.Id(), 0, 5678)
+	client.pings.Add(from, pendingRequestTimeout)
+	if err := client.handleUDP(packet, from); err != nil {
+		t.Errorf("Obfuscated datagram handle error: %s", err)
+	}
+
+	packet, _ = obfuscatePacket([]byte{ed2k.ProtKadUDP, CommKad2Pong, 0x36, 0x12}, nil, client.UDPVerifyKey(from.IP), 5678)
+	client.pings.Add(from, pendingRequestTimeout)
+	if err := client.handleUDP(packet, from); err != nil {
+		t.Errorf("Obfuscated datagram handle error: %s", err)
+	}
+}
+
+func TestResponse_SendObfuscated(t *testing.T) {
+	client, peerConn := newTestClientPair(t)
+	defer client.serverConn.Close()
+	defer peerConn.Close()
+
+	peerId := types.NewUInt128FromInt(42)
+	response := newResponse(client, peerConn.LocalAddr().(*net.UDPAddr))
+	response.SetOpcode(CommKad2Ping)
+	response.SetObfuscation(peerId, 0)
+
+	if err := response.Send(); err != nil {
+		t.Fatalf("Send error: %s", err)
+	}
+
+	packet := receiveTestPacket(t, peerConn)
+	plain, _, senderKey, err := deobfuscatePacket(packet, peerId, 0)
+	if err != nil {
+		t.Fatalf("Deobfuscation error: %s", err)
+	} else if !bytes.Equal(plain, []byte{ed2k.ProtKadUDP, CommKad2Ping}) {
+		t.Errorf("Packet mismatch, got: %x", plain)
+	} else if senderKey != client.UDPVerifyKey(peerConn.LocalAddr().(*net.UDPAddr).IP) {
+		t.Errorf("The sender key must be our verify key for the receiver IP")
+	}
+}
+
+func TestClient_SendToPeerReceiverKey(t *testing.T) {
+	client, peerConn := newTestClientPair(t)
+	defer client.serverConn.Close()
+	defer peerConn.Close()
+
+	publicIp := net.IPv4(80, 1, 2, 3)
+	client.SetExternalIP(publicIp)
+
+	addr := peerConn.LocalAddr().(*net.UDPAddr)
+	peer := kadTypes.NewPeer(types.NewUInt128FromInt(42))
+	peer.SetIP(addr.IP, true)
+	peer.SetUDPPort(uint16(addr.Port))
+	peer.SetProtocolVersion(kadVersion)
+	peer.SetUDPKey(1234, publicIp)
+
+	if err := client.sendToPeer(peer, CommKad2Ping, nil); err != nil {
+		t.Fatalf("Send error: %s", err)
+	}
+
+	_, receiverKey, _, err := deobfuscatePacket(receiveTestPacket(t, peerConn), peer.Id(), 0)
+	if err != nil {
+		t.Fatalf("Deobfuscation error: %s", err)
+	} else if receiverKey != 1234 {
+		t.Errorf("The receiver key must be the one the peer gave us, got: %d", receiverKey)
+	}
+}
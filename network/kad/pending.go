@@ -0,0 +1,52 @@
+package kad
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pendingRequestTimeout = time.Second * 30 // Time to wait the answer of a peer to our request
+)
+
+// Requests sent to peers that are waiting for an answer, by address. The answers that
+// don't match any of them are unsolicited and must be dropped
+type pendingRequests struct {
+	deadlines map[string]time.Time
+	access    sync.Mutex
+}
+
+// Register a request sent to [addr], that must be answered before the [timeout]
+func (pending *pendingRequests) Add(addr *net.UDPAddr, timeout time.Duration) {
+	pending.access.Lock()
+	defer pending.access.Unlock()
+
+	if pending.deadlines == nil {
+		pending.deadlines = make(map[string]time.Time)
+	}
+
+	// Forget the expired requests, so peers that never answer don't stay forever
+	now := time.Now()
+	for key, deadline := range pending.deadlines {
+		if deadline.Before(now) {
+			delete(pending.deadlines, key)
+		}
+	}
+
+	pending.deadlines[addr.String()] = now.Add(timeout)
+}
+
+// Remove the request sent to [addr], and check if it was waiting for an answer
+func (pending *pendingRequests) Take(addr *net.UDPAddr) bool {
+	pending.access.Lock()
+	defer pending.access.Unlock()
+
+	deadline, found := pending.deadlines[addr.String()]
+	if !found {
+		return false
+	}
+
+	delete(pending.deadlines, addr.String())
+	return !deadline.Before(time.Now())
+}
@@ -0,0 +1,63 @@
+package kad
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	maxPortSamples = 3 // Number of peers whose answer is kept to find the external port
+)
+
+// A port seen by a peer
+type portSample struct {
+	ip   net.IP
+	port uint16
+}
+
+// Find the external UDP port from the ports that the peers see on our packets. The port
+// is accepted when two different peers see the same one
+type portConsensus struct {
+	samples []portSample
+	port    uint16
+	found   bool
+	access  sync.Mutex
+}
+
+// Add the [port] seen by the peer with the IP [from]
+func (consensus *portConsensus) Add(port uint16, from net.IP) {
+	if port == 0 {
+		return
+	}
+
+	consensus.access.Lock()
+	defer consensus.access.Unlock()
+
+	for index, sample := range consensus.samples {
+		if sample.ip.Equal(from) {
+			// Each peer only can vote once, keep the last one
+			consensus.samples = append(consensus.samples[:index], consensus.samples[index+1:]...)
+			break
+		}
+	}
+
+	for _, sample := range consensus.samples {
+		if sample.port == port {
+			consensus.port = port
+			consensus.found = true
+			break
+		}
+	}
+
+	consensus.samples = append(consensus.samples, portSample{ip: from, port: port})
+	if len(consensus.samples) > maxPortSamples {
+		consensus.samples = consensus.samples[1:]
+	}
+}
+
+// Get the external port, and if it was found
+func (consensus *portConsensus) Port() (uint16, bool) {
+	consensus.access.Lock()
+	defer consensus.access.Unlock()
+	return consensus.port, consensus.found
+}
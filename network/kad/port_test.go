@@ -0,0 +1,90 @@
+package kad
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPortConsensus_Add(t *testing.T) {
+	consensus := portConsensus{}
+
+	consensus.Add(4672, net.IPv4(10, 0, 0, 1))
+	if _, found := consensus.Port(); found {
+		t.Errorf("One peer is not enough to find the port")
+	}
+
+	consensus.Add(4672, net.IPv4(10, 0, 0, 1))
+	if _, found := consensus.Port(); found {
+		t.Errorf("The same peer can't vote twice")
+	}
+
+	consensus.Add(4673, net.IPv4(10, 0, 0, 2))
+	if _, found := consensus.Port(); found {
+		t.Errorf("Two different ports are not a consensus")
+	}
+
+	consensus.Add(4673, net.IPv4(10, 0, 0, 3))
+	if port, found := consensus.Port(); !found || port != 4673 {
+		t.Errorf("External port mismatch, got: %d, want: %d", port, 4673)
+	}
+
+	if len(consensus.samples) > maxPortSamples {
+		t.Errorf("Only %d samples must be kept, %d found", maxPortSamples, len(consensus.samples))
+	}
+}
+
+func TestHandlePing(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+	otherClient := newTestClient(t)
+	defer closeTestClient(otherClient)
+	thirdClient := newTestClient(t)
+	defer closeTestClient(thirdClient)
+
+	for _, peer := range []*Client{otherClient, thirdClient} {
+		if err := client.Ping(peer.serverConn.LocalAddr().(*net.UDPAddr), peer.Id(), 0); err != nil {
+			t.Fatalf("Ping error: %s", err)
+		}
+		relayTestPacket(t, peer)
+		relayTestPacket(t, client)
+	}
+
+	// Both peers see us on the same IP, so only the first one votes
+	if _, found := client.ExternalUDPPort(); found {
+		t.Errorf("Peers with the same IP can't reach a consensus")
+	}
+
+	client.externPort.Add(uint16(client.serverConn.LocalAddr().(*net.UDPAddr).Port), net.IPv4(10, 0, 0, 1))
+	if port, found := client.ExternalUDPPort(); !found || int(port) != client.serverConn.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("External port mismatch, got: %d, want: %d", port, client.serverConn.LocalAddr().(*net.UDPAddr).Port)
+	}
+}
+
+func TestHandlePongResponse_Unsolicited(t *testing.T) {
+	client := NewClient(0, nil)
+	defer client.router.Dispose()
+
+	pong := []byte{0x36, 0x12}
+	for index := byte(1); index <= 2; index++ {
+		from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, index), Port: 4672}
+		if HandlePongResponse(client, newTestRequest(from, pong), newResponse(client, from)) == nil {
+			t.Errorf("Must fail with pongs to pings that we didn't send")
+		}
+	}
+
+	if _, found := client.ExternalUDPPort(); found {
+		t.Errorf("The unsolicited pongs can't vote for the external port")
+	}
+
+	for index := byte(1); index <= 2; index++ {
+		from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, index), Port: 4672}
+		client.pings.Add(from, pendingRequestTimeout)
+		if err := HandlePongResponse(client, newTestRequest(from, pong), newResponse(client, from)); err != nil {
+			t.Fatalf("Pong response error: %s", err)
+		}
+	}
+
+	if port, found := client.ExternalUDPPort(); !found || port != 4662 {
+		t.Errorf("External port mismatch, got: %d, want: %d", port, 4662)
+	}
+}
@@ -0,0 +1,87 @@
+package kad
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sleepy/types"
+)
+
+// File where the preferences are persisted, in the format of eMule
+const PreferencesFile = "preferencesKad.dat"
+
+// Preferences are the Kad settings that must survive restarts
+type Preferences struct {
+	Id         *types.UInt128 // Our position in the keyspace
+	ExternalIP net.IP         // Last public IP known, or nil
+}
+
+// Create preferences with a random id
+func NewPreferences() (*Preferences, error) {
+	id, err := types.NewRandomUInt128()
+	if err != nil {
+		return nil, err
+	}
+	return &Preferences{Id: id}, nil
+}
+
+// Load the preferences from the file on [path]. If it doesn't exist, new preferences are
+// created and saved at once, so the id survives a crash
+func LoadPreferences(path string) (*Preferences, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		prefs, err := NewPreferences()
+		if err != nil {
+			return nil, err
+		}
+		return prefs, prefs.Save(path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	reader := NewReader(data)
+	ip, err := reader.ReadIPv4()
+	if err != nil {
+		return nil, err
+	}
+
+	// Unused since eMule 0.47
+	if _, err := reader.ReadUInt16(); err != nil {
+		return nil, err
+	}
+
+	id, err := reader.ReadUInt128()
+	if err != nil {
+		return nil, err
+	}
+
+	prefs := &Preferences{Id: id}
+	if !ip.Equal(net.IPv4zero) {
+		prefs.ExternalIP = ip
+	}
+
+	// Old versions could store an invalid id
+	if id.Equal(types.NewUInt128FromInt(0)) {
+		if prefs.Id, err = types.NewRandomUInt128(); err != nil {
+			return nil, err
+		}
+		return prefs, prefs.Save(path)
+	}
+
+	return prefs, nil
+}
+
+// Save the preferences on the file on [path]
+func (prefs *Preferences) Save(path string) error {
+	if prefs.Id == nil {
+		return errors.New("the preferences must have an id")
+	}
+
+	writer := NewWriter()
+	writer.WriteIPv4(prefs.ExternalIP)
+	writer.WriteUInt16(0)
+	writer.WriteUInt128(prefs.Id)
+	writer.WriteByte(0) // Tag count, for old versions
+	return ioutil.WriteFile(path, writer.Bytes(), 0644)
+}
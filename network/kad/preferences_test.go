@@ -0,0 +1,160 @@
+package kad
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sleepy/types"
+	"testing"
+)
+
+func TestPreferences_Save(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kadprefs")
+	if err != nil {
+		t.Fatalf("Temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, PreferencesFile)
+
+	prefs, err := LoadPreferences(path)
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	} else if prefs.Id == nil || prefs.Id.Equal(types.NewUInt128FromInt(0)) || prefs.ExternalIP != nil {
+		t.Fatalf("Without file, a random id must be generated")
+	}
+
+	// The new id is saved at once
+	if saved, err := LoadPreferences(path); err != nil {
+		t.Fatalf("Load error: %s", err)
+	} else if !saved.Id.Equal(prefs.Id) {
+		t.Errorf("The generated id must be saved, got: %s, want: %s", saved.Id.ToHexString(), prefs.Id.ToHexString())
+	}
+
+	prefs.ExternalIP = net.IPv4(1, 2, 3, 4)
+	if err := prefs.Save(path); err != nil {
+		t.Fatalf("Save error: %s", err)
+	}
+
+	if data, _ := ioutil.ReadFile(path); len(data) != 23 || data[0] != 4 || data[3] != 1 {
+		t.Errorf("File mismatch: %x", data)
+	}
+
+	loaded, err := LoadPreferences(path)
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	if !loaded.Id.Equal(prefs.Id) || !loaded.ExternalIP.Equal(prefs.ExternalIP) {
+		t.Errorf("Preferences mismatch, id: %s, ip: %s", loaded.Id.ToHexString(), loaded.ExternalIP)
+	}
+
+	client := NewClient(0, loaded)
+	if !client.Id().Equal(prefs.Id) || !client.Preferences().ExternalIP.Equal(prefs.ExternalIP) {
+		t.Errorf("The client must use the preferences")
+	}
+}
+
+func TestLoadPreferences_ZeroId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kadprefs")
+	if err != nil {
+		t.Fatalf("Temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, PreferencesFile)
+
+	if err := ioutil.WriteFile(path, make([]byte, 23), 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	prefs, err := LoadPreferences(path)
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	if prefs.Id.Equal(types.NewUInt128FromInt(0)) || prefs.ExternalIP != nil {
+		t.Errorf("The zero id must be replaced by a random one")
+	}
+	if saved, err := LoadPreferences(path); err != nil || !saved.Id.Equal(prefs.Id) {
+		t.Errorf("The replaced id must be saved")
+	}
+
+	if err := ioutil.WriteFile(path, make([]byte, 10), 0644); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+	if _, err := LoadPreferences(path); err == nil {
+		t.Errorf("Must fail with truncated files")
+	}
+}
+
+func TestClient_SetPreferencesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kadprefs")
+	if err != nil {
+		t.Fatalf("Temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, PreferencesFile)
+
+	prefs, err := LoadPreferences(path)
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+
+	client := NewClient(0, prefs)
+	defer client.router.Dispose()
+	client.SetPreferencesFile(path)
+	client.SetExternalIP(net.IPv4(1, 2, 3, 4))
+
+	saved, err := LoadPreferences(path)
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	} else if !saved.Id.Equal(prefs.Id) || !saved.ExternalIP.Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("The preferences must be saved when they change, id: %s, ip: %s", saved.Id.ToHexString(), saved.ExternalIP)
+	}
+}
+
+func TestHandleFirewallResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kadprefs")
+	if err != nil {
+		t.Fatalf("Temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, PreferencesFile)
+
+	client := NewClient(0, nil)
+	defer client.router.Dispose()
+	client.SetPreferencesFile(path)
+
+	// The IP seen by each peer that we asked
+	handleResponse := func(from *net.UDPAddr, ip net.IP) error {
+		writer := NewWriter()
+		writer.WriteIPv4(ip)
+		return HandleFirewallResponse(client, newTestRequest(from, writer.Bytes()), newResponse(client, from))
+	}
+
+	first := &net.UDPAddr{IP: net.IPv4(80, 0, 0, 1), Port: 4672}
+	if handleResponse(first, net.IPv4(1, 2, 3, 4)) == nil {
+		t.Errorf("Must fail with responses to checks that we didn't send")
+	}
+
+	client.firewallChecks.Add(first, pendingRequestTimeout)
+	if err := handleResponse(first, net.IPv4(1, 2, 3, 4)); err != nil {
+		t.Fatalf("Firewall response error: %s", err)
+	} else if client.ExternalIP() != nil {
+		t.Errorf("The IP seen by a single peer can't be taken")
+	}
+
+	second := &net.UDPAddr{IP: net.IPv4(80, 0, 0, 2), Port: 4672}
+	client.firewallChecks.Add(second, pendingRequestTimeout)
+	if err := handleResponse(second, net.IPv4(1, 2, 3, 4)); err != nil {
+		t.Fatalf("Firewall response error: %s", err)
+	} else if !client.ExternalIP().Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("The IP confirmed by other peer must be taken, %s found", client.ExternalIP())
+	} else if client.needsIPCheck() {
+		t.Errorf("The confirmed IP doesn't need more checks")
+	}
+
+	if saved, err := LoadPreferences(path); err != nil {
+		t.Fatalf("Load error: %s", err)
+	} else if !saved.ExternalIP.Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("The learned IP must be saved, %s found", saved.ExternalIP)
+	}
+}
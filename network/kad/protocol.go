@@ -1,40 +1,625 @@
 package kad
 
 import (
+	"errors"
 	"log"
+	"sleepy/network/ed2k"
+	kadTypes "sleepy/network/kad/types"
+	"sleepy/types"
+	"strconv"
 )
 
-func HandleBootstrapRequest(client *Client, r *UDPRequest, w Response) {
+// Flags of the TagKadMiscOptions tag sent on HELLO packets
+const (
+	helloUDPFirewalled = 0x01
+	helloTCPFirewalled = 0x02
+	helloRequestAck    = 0x04
+)
+
+// Create the peer that sent the request from his announced data. Its UDP verify key is
+// bound to our current public IP
+func (client *Client) newRequestPeer(r *UDPRequest, id *types.UInt128, tcpPort uint16, version uint8) *kadTypes.Peer {
+	peer := kadTypes.NewPeer(id)
+	peer.SetIP(r.from.IP, r.validReceiverKey)
+	peer.SetUDPPort(uint16(r.from.Port))
+	peer.SetTCPPort(tcpPort)
+	peer.SetProtocolVersion(version)
+	if r.senderVerifyKey != 0 {
+		peer.SetUDPKey(r.senderVerifyKey, client.ExternalIP())
+	}
+	return peer
+}
+
+func HandleBootstrapRequest(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Bootstrap request")
 
-	contacts := client.router.GetBootstrapPeers(20)
-	log.Println("Se van a enviar " + string(len(contacts)) + " contactos.")
+	contacts := client.router.GetBootstrapPeers(maxBootstrapPeers)
+
+	w.SetOpcode(CommKad2BootstrapRes)
+	w.WriteUInt128(client.Id())
+	w.WriteUInt16(client.tcpPort)
+	w.WriteByte(kadVersion)
+	w.WriteUInt16(uint16(len(contacts)))
+	for _, contact := range contacts {
+		w.WritePeer(contact)
+	}
+
+	return w.Send()
 }
 
-func HandleBootstrapResponse(client *Client, r *UDPRequest, w Response) {
+func HandleBootstrapResponse(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Bootstrap response")
+
+	if !client.bootstraps.Take(r.from) {
+		return errors.New("unexpected bootstrap response")
+	}
+
+	id, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	tcpPort, err := r.body.ReadUInt16()
+	if err != nil {
+		return err
+	}
+
+	version, err := r.body.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	contactCount, err := r.body.ReadUInt16()
+	if err != nil {
+		return err
+	}
+
+	contacts := make([]*kadTypes.Peer, 0, contactCount)
+	for ind := uint16(0); ind < contactCount; ind++ {
+		contact, err := r.body.ReadPeer()
+		if err != nil {
+			return err
+		}
+		contacts = append(contacts, contact)
+	}
+
+	// The sender is added too, as it has answered to us
+	if err := client.router.AddPeer(client.newRequestPeer(r, id, tcpPort, version)); err != nil {
+		log.Printf("Bootstrap peer not added: %s", err)
+	}
+
+	// The listed contacts come from a third party, so they can't change the known ones
+	added := 0
+	for _, contact := range contacts {
+		if client.router.AddNewPeer(contact) == nil {
+			added++
+		}
+	}
+	log.Println("Added " + strconv.Itoa(added) + " of " + strconv.Itoa(len(contacts)) + " bootstrap contacts")
+
+	return nil
 }
 
-func HandleFirewallRequest(client *Client, r *UDPRequest, w Response) {
+// Handle a KADEMLIA_FIREWALLED2_REQ answering with the public IP of the sender. Unlike eMule,
+// its TCP port isn't checked
+func HandleFirewallRequest(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Firewall request")
+
+	if _, err := r.body.ReadUInt16(); err != nil {
+		return err
+	}
+	if _, err := r.body.ReadUInt128(); err != nil {
+		return err
+	}
+	if _, err := r.body.ReadByte(); err != nil {
+		return err
+	}
+
+	w.SetOpcode(CommKadFirewalledRes)
+	w.WriteIPv4(r.from.IP)
+	return w.Send()
 }
 
-func HandleHelloRequest(client *Client, r *UDPRequest, w Response) {
+// Handle a KADEMLIA_FIREWALLED_RES with our public IP as seen by the peer
+func HandleFirewallResponse(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Firewall response")
+
+	// Only the peers that we asked can tell us our IP
+	if !client.firewallChecks.Take(r.from) {
+		return errors.New("unexpected firewall response")
+	}
+
+	ip, err := r.body.ReadIPv4()
+	if err != nil {
+		return err
+	}
+
+	client.observeExternalIP(ip)
+	return nil
+}
+
+// Peer details sent on the Kad2 HELLO packets
+type helloDetails struct {
+	id            *types.UInt128
+	tcpPort       uint16
+	udpPort       uint16
+	version       uint8
+	udpFirewalled bool
+	tcpFirewalled bool
+	requestsAck   bool
+}
+
+// Read the details of a HELLO packet. The UDP port is the source one unless a tag says other
+func readHello(r *UDPRequest) (*helloDetails, error) {
+	id, err := r.body.ReadUInt128()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpPort, err := r.body.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := r.body.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := r.body.ReadTags()
+	if err != nil {
+		return nil, err
+	}
+
+	details := &helloDetails{id: id, tcpPort: tcpPort, udpPort: uint16(r.from.Port), version: version}
+
+	if port, ok := tags.GetInt(TagSourceUDPPort); ok && port > 0 && port <= 0xffff {
+		details.udpPort = uint16(port)
+	}
+
+	if options, ok := tags.GetInt(TagKadMiscOptions); ok {
+		details.udpFirewalled = options&helloUDPFirewalled != 0
+		details.tcpFirewalled = options&helloTCPFirewalled != 0
+		details.requestsAck = options&helloRequestAck != 0 && version >= ed2k.ProtocolVersion8
+	}
+
+	return details, nil
+}
+
+// Write our details for a HELLO packet of type [opcode]
+func (client *Client) writeHello(w *Response, opcode byte, requestAck bool) error {
+	tags := TagList{}
+	if requestAck {
+		tags = append(tags, NewIntTag(TagKadMiscOptions, helloRequestAck))
+	}
+
+	w.SetOpcode(opcode)
+	w.WriteUInt128(client.Id())
+	w.WriteUInt16(client.tcpPort)
+	w.WriteByte(kadVersion)
+	return w.WriteTags(tags)
+}
+
+// Add or update the peer that sent a HELLO packet. Return if the router accepted it
+func (client *Client) addHelloPeer(r *UDPRequest, details *helloDetails) bool {
+	if details.udpFirewalled {
+		// The peer can't be contacted by others, so it is useless on the routing table
+		return false
+	}
+
+	peer := client.newRequestPeer(r, details.id, details.tcpPort, details.version)
+	peer.SetUDPPort(details.udpPort)
+
+	err := client.router.AddPeer(peer)
+	if err != nil {
+		log.Printf("Hello peer not added: %s", err)
+	}
+	return err == nil
+}
+
+func HandleHelloRequest(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Hello request")
+
+	details, err := readHello(r)
+	if err != nil {
+		return err
+	}
+
+	added := client.addHelloPeer(r, details)
+
+	if r.senderVerifyKey == 0 && details.version >= kadObfuscationVersion {
+		w.SetObfuscation(details.id, client.peerUDPKey(details.id))
+	}
+
+	// Ask for an ack, obfuscated with our key, to verify the IP of the peer
+	requestAck := added && !r.validReceiverKey && details.version >= ed2k.ProtocolVersion8
+	if err := client.writeHello(w, CommKad2HelloRes, requestAck); err != nil {
+		return err
+	}
+
+	return w.Send()
 }
 
-func HandleHelloResponse(client *Client, r *UDPRequest, w Response) {
+func HandleHelloResponse(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Hello response")
+
+	details, err := readHello(r)
+	if err != nil {
+		return err
+	}
+
+	client.addHelloPeer(r, details)
+
+	if details.requestsAck {
+		w.SetOpcode(CommKad2HelloResAck)
+		w.WriteUInt128(client.Id())
+		if err := w.WriteTags(TagList{}); err != nil {
+			return err
+		}
+		if err := w.Send(); err != nil {
+			return err
+		}
+	}
+
+	// Like eMule, ask the peers that answer us for our public IP until it's confirmed
+	if client.needsIPCheck() && details.version >= ed2k.ProtocolVersion7 {
+		if err := client.CheckExternalIP(r.from, details.id, r.senderVerifyKey); err != nil {
+			log.Printf("External IP check error: %s", err)
+		}
+	}
+
+	return nil
 }
 
-func HandleHelloResponseAck(client *Client, r *UDPRequest, w Response) {
+func HandleHelloResponseAck(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Hello response ack")
+
+	if !r.validReceiverKey {
+		return errors.New("hello ack received without a valid receiver key")
+	}
+
+	id, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.body.ReadTags(); err != nil {
+		return err
+	}
+
+	if !client.router.VerifyPeer(id, r.from.IP) {
+		return errors.New("the hello ack sender can't be verified")
+	}
+
+	return nil
 }
 
-func HandlePingRequest(client *Client, r *UDPRequest, w Response) {
+func HandlePingRequest(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Ping request")
+
+	// Answer with the port we see, so the sender can learn his external port
+	w.SetOpcode(CommKad2Pong)
+	w.WriteUInt16(uint16(r.from.Port))
+	return w.Send()
 }
 
-func HandlePongResponse(client *Client, r *UDPRequest, w Response) {
+func HandlePongResponse(client *Client, r *UDPRequest, w *Response) error {
 	log.Println("Pong response")
+
+	// Only the peers that we asked can vote for our external port
+	if !client.pings.Take(r.from) {
+		return errors.New("unexpected pong response")
+	}
+
+	port, err := r.body.ReadUInt16()
+	if err != nil {
+		return err
+	}
+
+	client.externPort.Add(port, r.from.IP)
+	return nil
+}
+
+func HandleLookupRequest(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Lookup request")
+
+	lookupType, err := r.body.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	// The low bits are the number of contacts requested
+	maxContacts := int(lookupType & 0x1F)
+	if maxContacts == 0 {
+		return errors.New("lookup request without contacts requested")
+	}
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	check, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	if !check.Equal(client.Id()) {
+		return errors.New("lookup request sent to other id")
+	}
+
+	contacts := client.router.GetClosestPeers(target, maxContacts)
+
+	w.SetOpcode(CommKad2Res)
+	w.WriteUInt128(target)
+	w.WriteByte(byte(len(contacts)))
+	for _, contact := range contacts {
+		w.WritePeer(contact)
+	}
+
+	return w.Send()
+}
+
+func HandleLookupResponse(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Lookup response")
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	contactCount, err := r.body.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	contacts := make([]*kadTypes.Peer, 0, contactCount)
+	for ind := byte(0); ind < contactCount; ind++ {
+		contact, err := r.body.ReadPeer()
+		if err != nil {
+			return err
+		}
+		contacts = append(contacts, contact)
+	}
+
+	// Only the peers asked by a lookup in progress can give us contacts
+	if !client.lookups.deliver(target, lookupResponse{from: r.from, contacts: contacts}) {
+		return errors.New("lookup response without lookup in progress")
+	}
+
+	// The contacts come from a third party, so they can't change the known ones
+	for _, contact := range contacts {
+		client.router.AddNewPeer(contact)
+	}
+
+	return nil
+}
+
+// Handle a KADEMLIA2_SEARCH_RES with the results of a keyword, source or notes search
+func HandleSearchResponse(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Search response")
+
+	if _, err := r.body.ReadUInt128(); err != nil {
+		return err
+	}
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	count, err := r.body.ReadUInt16()
+	if err != nil {
+		return err
+	}
+
+	entries := make([]searchEntry, 0, count)
+	for ind := uint16(0); ind < count; ind++ {
+		id, err := r.body.ReadUInt128()
+		if err != nil {
+			return err
+		}
+
+		tags, err := r.body.ReadTags()
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, searchEntry{id: id, tags: tags})
+	}
+
+	if !client.searches.deliver(target, searchResponse{from: r.from, entries: entries}) {
+		return errors.New("search response without search in progress")
+	}
+
+	return nil
+}
+
+// Handle a KADEMLIA2_SEARCH_KEY_REQ answering with the files stored for the keyword that
+// match the search expression
+func HandleSearchKeyRequest(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Keyword search request")
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	start, err := r.body.ReadUInt16()
+	if err != nil {
+		return err
+	}
+
+	var expr *SearchExpr
+	if start&searchExprFollowFlag != 0 {
+		if expr, err = r.body.ReadSearchExpr(); err != nil {
+			return err
+		}
+	}
+
+	return client.answerSearch(r, target, client.index.SearchKeyword(target, expr))
+}
+
+// Handle a KADEMLIA2_SEARCH_SOURCE_REQ answering with the sources stored for the file
+func HandleSearchSourceRequest(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Source search request")
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.body.ReadUInt16(); err != nil {
+		return err
+	}
+
+	size, err := r.body.ReadUInt64()
+	if err != nil {
+		return err
+	}
+
+	return client.answerSearch(r, target, client.index.SearchSources(target, size))
+}
+
+// Handle a KADEMLIA2_SEARCH_NOTES_REQ answering with the notes stored about the file
+func HandleSearchNotesRequest(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Notes search request")
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.body.ReadUInt64(); err != nil {
+		return err
+	}
+
+	return client.answerSearch(r, target, client.index.SearchNotes(target))
+}
+
+// Handle a KADEMLIA2_PUBLISH_KEY_REQ storing the files and answering with our load
+func HandlePublishKeyRequest(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Keyword publish request")
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	if !client.isInTolerance(target) {
+		return errors.New("keyword published out of our tolerance zone")
+	}
+
+	count, err := r.body.ReadUInt16()
+	if err != nil {
+		return err
+	}
+
+	var load byte
+	for ind := uint16(0); ind < count; ind++ {
+		file, err := r.body.ReadUInt128()
+		if err != nil {
+			return err
+		}
+
+		tags, err := r.body.ReadTags()
+		if err != nil {
+			return err
+		}
+
+		// Full keywords are answered with the max load, so the publisher backs off
+		load, err = client.index.AddKeyword(target, file, r.from.IP, tags)
+		if err != nil {
+			log.Printf("Keyword publish error: %s", err)
+		}
+	}
+
+	return sendPublishResponse(w, target, load)
+}
+
+// Handle a KADEMLIA2_PUBLISH_SOURCE_REQ storing the source and answering with our load
+func HandlePublishSourceRequest(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Source publish request")
+
+	target, source, tags, err := readPublishRequest(client, r)
+	if err != nil {
+		return err
+	}
+
+	load, err := client.index.AddSource(target, source, r.from.IP, uint16(r.from.Port), tags)
+	if err != nil && load == 0 {
+		return err
+	}
+
+	return sendPublishResponse(w, target, load)
+}
+
+// Handle a KADEMLIA2_PUBLISH_NOTES_REQ storing the note and answering with our load
+func HandlePublishNotesRequest(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Notes publish request")
+
+	target, source, tags, err := readPublishRequest(client, r)
+	if err != nil {
+		return err
+	}
+
+	load, err := client.index.AddNote(target, source, r.from.IP, tags)
+	if err != nil && load == 0 {
+		return err
+	}
+
+	return sendPublishResponse(w, target, load)
+}
+
+// Read the file id, the publisher id and the tags of a source or notes publish request
+func readPublishRequest(client *Client, r *UDPRequest) (*types.UInt128, *types.UInt128, TagList, error) {
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	source, err := r.body.ReadUInt128()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tags, err := r.body.ReadTags()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !client.isInTolerance(target) {
+		return nil, nil, nil, errors.New("value published out of our tolerance zone")
+	}
+
+	return target, source, tags, nil
+}
+
+// Answer a publish request with our [load] for the [target]
+func sendPublishResponse(w *Response, target *types.UInt128, load byte) error {
+	w.SetOpcode(CommKad2PublishRes)
+	w.WriteUInt128(target)
+	w.WriteByte(load)
+	return w.Send()
+}
+
+// Handle a KADEMLIA2_PUBLISH_RES with the load of a peer where we published
+func HandlePublishResponse(client *Client, r *UDPRequest, w *Response) error {
+	log.Println("Publish response")
+
+	target, err := r.body.ReadUInt128()
+	if err != nil {
+		return err
+	}
+
+	load, err := r.body.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if !client.publishes.deliver(target, publishResponse{from: r.from, load: load}) {
+		return errors.New("publish response without publish in progress")
+	}
+
+	return nil
 }
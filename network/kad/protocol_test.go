@@ -0,0 +1,323 @@
+package kad
+
+import (
+	"net"
+	"sleepy/network/ed2k"
+	kadTypes "sleepy/network/kad/types"
+	"sleepy/types"
+	"testing"
+	"time"
+)
+
+// Create a peer with a public address derived from his [id]
+func newTestPeer(id int) *kadTypes.Peer {
+	peer := kadTypes.NewPeer(types.NewUInt128FromInt(id))
+	peer.SetIP(net.IPv4(10, byte(id>>16), byte(id>>8), byte(id)), true)
+	peer.SetUDPPort(4672)
+	peer.SetTCPPort(4662)
+	peer.SetProtocolVersion(ed2k.ProtocolVersion8)
+	return peer
+}
+
+// Create a request as if it were received from [from]
+func newTestRequest(from *net.UDPAddr, payload []byte) *UDPRequest {
+	return &UDPRequest{
+		from:    from,
+		Request: Request{body: Reader{data: payload, offset: 0}},
+	}
+}
+
+// Create a client with router, listening on a random local port
+func newTestClient(t *testing.T) *Client {
+	return newTestClientWithId(t, nil)
+}
+
+// Create a client with the [id], or a random one if nil, listening on a random local port
+func newTestClientWithId(t *testing.T, id *types.UInt128) *Client {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+
+	var prefs *Preferences
+	if id != nil {
+		prefs = &Preferences{Id: id}
+	}
+	client := NewClient(0, prefs)
+	client.serverConn = serverConn
+	return client
+}
+
+// Stop the listener of [client], waiting for its handlers, and dispose it
+func closeTestClient(client *Client) {
+	if client.listening == nil {
+		client.serverConn.Close()
+	}
+	client.Dispose()
+}
+
+// Receive the next datagram of [to] and handle it
+func relayTestPacket(t *testing.T, to *Client) {
+	buf := make([]byte, 8192)
+	to.serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := to.serverConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Receive error: %s", err)
+	}
+
+	if err := to.handleUDP(buf[:n], addr); err != nil {
+		t.Fatalf("Datagram handle error: %s", err)
+	}
+}
+
+func TestHandleBootstrap(t *testing.T) {
+	client, peerConn := newTestClientPair(t)
+	defer client.serverConn.Close()
+	defer peerConn.Close()
+
+	defer client.router.Dispose()
+	for i := 1; i <= 10; i++ {
+		client.router.AddPeer(newTestPeer(i))
+	}
+
+	// The peer asks us for contacts
+	peerAddr := peerConn.LocalAddr().(*net.UDPAddr)
+	request := newTestRequest(peerAddr, []byte{})
+	if err := HandleBootstrapRequest(client, request, newResponse(client, peerAddr)); err != nil {
+		t.Fatalf("Bootstrap request error: %s", err)
+	}
+
+	packet := receiveTestPacket(t, peerConn)
+	if packet[1] != CommKad2BootstrapRes {
+		t.Fatalf("Bootstrap response opcode mismatch, got: %x", packet[1])
+	}
+
+	// Other client processes the response as if sent by us
+	otherClient := NewClient(0, nil)
+	defer otherClient.router.Dispose()
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 4672}
+	otherClient.bootstraps.Add(clientAddr, pendingRequestTimeout)
+	if err := otherClient.handleUDP(packet, clientAddr); err != nil {
+		t.Fatalf("Bootstrap response error: %s", err)
+	}
+
+	if otherClient.router.CountPeers() != 11 {
+		t.Errorf("The router must contain the 10 contacts and the sender, %d found", otherClient.router.CountPeers())
+	}
+
+	sender, err := otherClient.router.GetPeer(client.Id())
+	if err != nil {
+		t.Fatalf("The sender must be added to the router: %s", err)
+	} else if !sender.IP().Equal(clientAddr.IP) || sender.UDPPort() != 4672 || sender.TCPPort() != client.tcpPort || sender.ProtocolVersion() != kadVersion {
+		t.Errorf("The sender data mismatch")
+	}
+
+	contact, err := otherClient.router.GetPeer(types.NewUInt128FromInt(5))
+	if err != nil {
+		t.Fatalf("The contact must be added to the router: %s", err)
+	} else if !contact.IP().Equal(net.IPv4(10, 0, 0, 5)) || contact.UDPPort() != 4672 || contact.TCPPort() != 4662 {
+		t.Errorf("The contact data mismatch")
+	} else if contact.IsIpVerified() {
+		t.Errorf("The contacts received on a bootstrap are not verified")
+	}
+}
+
+func TestHandleBootstrapResponse_Truncated(t *testing.T) {
+	client := NewClient(0, nil)
+	defer client.router.Dispose()
+
+	writer := NewWriter()
+	writer.WriteUInt128(types.NewUInt128FromInt(1))
+	writer.WriteUInt16(4662)
+	writer.WriteByte(kadVersion)
+	writer.WriteUInt16(2)
+	writer.WritePeer(newTestPeer(2))
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 4672}
+	client.bootstraps.Add(from, pendingRequestTimeout)
+	if HandleBootstrapResponse(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)) == nil {
+		t.Errorf("Must fail with less contacts than announced")
+	} else if client.router.CountPeers() != 0 {
+		t.Errorf("No contact must be added from an invalid response")
+	}
+}
+
+func TestHandleBootstrapResponse_Unsolicited(t *testing.T) {
+	client := NewClient(0, nil)
+	defer client.router.Dispose()
+
+	writer := NewWriter()
+	writer.WriteUInt128(types.NewUInt128FromInt(1))
+	writer.WriteUInt16(4662)
+	writer.WriteByte(kadVersion)
+	writer.WriteUInt16(1)
+	writer.WritePeer(newTestPeer(2))
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 4672}
+	if HandleBootstrapResponse(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)) == nil {
+		t.Errorf("Must fail with responses to bootstraps that we didn't send")
+	} else if client.router.CountPeers() != 0 {
+		t.Errorf("No contact must be added from an unsolicited response")
+	}
+
+	// Other peer can't answer to the bootstrap sent to the first one
+	client.bootstraps.Add(from, pendingRequestTimeout)
+	other := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 3), Port: 4672}
+	if HandleBootstrapResponse(client, newTestRequest(other, writer.Bytes()), newResponse(client, other)) == nil {
+		t.Errorf("Must fail with responses from peers that we didn't ask")
+	}
+
+	if err := HandleBootstrapResponse(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)); err != nil {
+		t.Fatalf("Bootstrap response error: %s", err)
+	} else if client.router.CountPeers() != 2 {
+		t.Errorf("The router must contain the contact and the sender, %d found", client.router.CountPeers())
+	}
+
+	// Each request is answered only once
+	if HandleBootstrapResponse(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)) == nil {
+		t.Errorf("Must fail with repeated responses")
+	}
+}
+
+func TestHandleBootstrapResponse_KnownContact(t *testing.T) {
+	client := NewClient(0, nil)
+	defer client.router.Dispose()
+	client.router.AddPeer(newTestPeer(2))
+
+	// The response lists the known id with other address
+	moved := newTestPeer(2)
+	moved.SetIP(net.IPv4(10, 9, 9, 9), true)
+	writer := NewWriter()
+	writer.WriteUInt128(types.NewUInt128FromInt(1))
+	writer.WriteUInt16(4662)
+	writer.WriteByte(kadVersion)
+	writer.WriteUInt16(1)
+	writer.WritePeer(moved)
+
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 4672}
+	client.bootstraps.Add(from, pendingRequestTimeout)
+	if err := HandleBootstrapResponse(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)); err != nil {
+		t.Fatalf("Bootstrap response error: %s", err)
+	}
+
+	if peer, err := client.router.GetPeer(types.NewUInt128FromInt(2)); err != nil {
+		t.Fatalf("The known contact must be kept: %s", err)
+	} else if !peer.IP().Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("The contacts of a response can't change the known ones, IP %s found", peer.IP())
+	}
+	if !client.router.ContainsPeer(types.NewUInt128FromInt(1)) {
+		t.Errorf("The sender must be added")
+	}
+}
+
+func TestHandleHelloRequest_KnownPeer(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+	client.router.AddPeer(newTestPeer(2))
+
+	// Other address claims the id of the verified peer
+	writer := NewWriter()
+	writer.WriteUInt128(types.NewUInt128FromInt(2))
+	writer.WriteUInt16(4662)
+	writer.WriteByte(kadVersion)
+	writer.WriteTags(TagList{})
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}
+	if err := HandleHelloRequest(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)); err != nil {
+		t.Fatalf("Hello request error: %s", err)
+	}
+
+	if peer, err := client.router.GetPeer(types.NewUInt128FromInt(2)); err != nil {
+		t.Fatalf("The known peer must be kept: %s", err)
+	} else if !peer.IP().Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("A hello from other IP can't move a verified peer, IP %s found", peer.IP())
+	}
+}
+
+func TestHandleHello(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+	otherClient := newTestClient(t)
+	defer closeTestClient(otherClient)
+
+	// HELLO_REQ
+	if err := client.Hello(otherClient.serverConn.LocalAddr().(*net.UDPAddr), nil, 0); err != nil {
+		t.Fatalf("Hello error: %s", err)
+	}
+	relayTestPacket(t, otherClient)
+
+	peer, err := otherClient.router.GetPeer(client.Id())
+	if err != nil {
+		t.Fatalf("The hello sender must be added: %s", err)
+	} else if peer.IsIpVerified() {
+		t.Errorf("The hello sender can't be verified yet")
+	} else if peer.UDPPort() != uint16(client.serverConn.LocalAddr().(*net.UDPAddr).Port) {
+		t.Errorf("The hello sender UDP port mismatch")
+	}
+
+	// HELLO_RES, requesting an ack
+	relayTestPacket(t, client)
+	if !client.router.ContainsPeer(otherClient.Id()) {
+		t.Errorf("The hello responder must be added")
+	}
+
+	// HELLO_RES_ACK, obfuscated with the verify key
+	relayTestPacket(t, otherClient)
+	if !peer.IsIpVerified() {
+		t.Errorf("The hello sender must be verified after the ack")
+	}
+
+	// KADEMLIA_FIREWALLED2_REQ and KADEMLIA_FIREWALLED_RES with the IP seen by the responder
+	relayTestPacket(t, otherClient)
+	relayTestPacket(t, client)
+	if client.ExternalIP() != nil {
+		t.Errorf("The IP seen by a single peer can't be taken")
+	} else if !client.needsIPCheck() {
+		t.Errorf("The IP must be checked until other peer confirms it")
+	}
+}
+
+func TestHandleHelloRequest_Firewalled(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	writer := NewWriter()
+	writer.WriteUInt128(types.NewUInt128FromInt(1))
+	writer.WriteUInt16(4662)
+	writer.WriteByte(ed2k.ProtocolVersion8)
+	writer.WriteTags(TagList{NewIntTag(TagKadMiscOptions, helloUDPFirewalled), NewIntTag(TagSourceUDPPort, 4673)})
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}
+	request := newTestRequest(from, writer.Bytes())
+	details, err := readHello(request)
+	if err != nil {
+		t.Fatalf("Hello read error: %s", err)
+	} else if details.udpPort != 4673 || !details.udpFirewalled || details.tcpFirewalled || details.requestsAck {
+		t.Errorf("Hello details mismatch: %+v", details)
+	}
+
+	if client.addHelloPeer(request, details) || client.router.CountPeers() != 0 {
+		t.Errorf("UDP firewalled peers must not be added")
+	}
+}
+
+func TestHandleHelloResponseAck_InvalidKey(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	peer := newTestPeer(1)
+	peer.SetIP(net.IPv4(127, 0, 0, 1), false)
+	client.router.AddPeer(peer)
+
+	writer := NewWriter()
+	writer.WriteUInt128(peer.Id())
+	writer.WriteTags(TagList{})
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4672}
+	if HandleHelloResponseAck(client, newTestRequest(from, writer.Bytes()), newResponse(client, from)) == nil {
+		t.Errorf("Must fail without a valid receiver key")
+	} else if peer.IsIpVerified() {
+		t.Errorf("The peer can't be verified without a valid receiver key")
+	}
+}
@@ -0,0 +1,215 @@
+package kad
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sleepy/types"
+	"sync"
+	"time"
+)
+
+const (
+	maxPublishResponses = 16              // Responses buffered for each in-flight publish
+	publishTimeout      = 5 * time.Second // Time to wait for the peers to confirm a publish
+)
+
+// Load answered on a KADEMLIA2_PUBLISH_RES
+type publishResponse struct {
+	from *net.UDPAddr
+	load byte
+}
+
+// Publish waiting for KADEMLIA2_PUBLISH_RES, with the addresses of the peers that it asked
+type publishWaiter struct {
+	responses chan publishResponse
+	queried   map[string]bool
+}
+
+// In-flight publishes waiting for KADEMLIA2_PUBLISH_RES, by target. Several publishes of
+// the same target can run at once, each one only gets the responses of the peers that it asked
+type publishRegistry struct {
+	publishes map[types.UInt128][]*publishWaiter
+	access    sync.Mutex
+}
+
+// Register a publish for [target] and get the waiter where the responses will be delivered
+func (registry *publishRegistry) register(target *types.UInt128) *publishWaiter {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	if registry.publishes == nil {
+		registry.publishes = make(map[types.UInt128][]*publishWaiter)
+	}
+
+	waiter := &publishWaiter{
+		responses: make(chan publishResponse, maxPublishResponses),
+		queried:   make(map[string]bool),
+	}
+	registry.publishes[*target] = append(registry.publishes[*target], waiter)
+	return waiter
+}
+
+// Remove the [waiter] of a publish for [target]
+func (registry *publishRegistry) unregister(target *types.UInt128, waiter *publishWaiter) {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	waiters := registry.publishes[*target]
+	for index := range waiters {
+		if waiters[index] == waiter {
+			waiters = append(waiters[:index:index], waiters[index+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(registry.publishes, *target)
+	} else {
+		registry.publishes[*target] = waiters
+	}
+}
+
+// Record that the publish of [waiter] asked the peer on [addr], so its response is expected
+func (registry *publishRegistry) query(waiter *publishWaiter, addr *net.UDPAddr) {
+	registry.access.Lock()
+	waiter.queried[addr.String()] = true
+	registry.access.Unlock()
+}
+
+// Deliver a response to the publishes for [target] that asked its sender. Return false if
+// nobody is waiting for it
+func (registry *publishRegistry) deliver(target *types.UInt128, response publishResponse) bool {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	if response.from == nil {
+		return false
+	}
+
+	delivered := false
+	for _, waiter := range registry.publishes[*target] {
+		if !waiter.queried[response.from.String()] {
+			continue
+		}
+
+		select {
+		case waiter.responses <- response:
+			// Each peer only confirms once
+			delete(waiter.queried, response.from.String())
+			delivered = true
+		default:
+		}
+	}
+	return delivered
+}
+
+// PublishResult is the outcome of a publish on the peers closest to the target
+type PublishResult struct {
+	Peers int  // Peers that confirmed the publish
+	Load  byte // Average load of those peers, from 0 to 100
+}
+
+// Run a lookup of [target] and send the publish request [opcode] with [payload] to the
+// closest peers, waiting for their confirmations
+func (client *Client) publish(ctx context.Context, target *types.UInt128, opcode byte, payload []byte) (*PublishResult, error) {
+	waiter := client.publishes.register(target)
+	defer client.publishes.unregister(target, waiter)
+
+	peers, err := client.Lookup(ctx, target, LookupStore)
+	if err != nil {
+		return nil, err
+	}
+
+	sent := 0
+	for _, peer := range peers {
+		client.publishes.query(waiter, peerAddr(peer))
+		if client.sendToPeer(peer, opcode, payload) == nil {
+			sent++
+		}
+	}
+
+	if sent == 0 {
+		return nil, errors.New("the publish request can't be sent to any peer")
+	}
+
+	timeout := time.NewTimer(publishTimeout)
+	defer timeout.Stop()
+
+	answered := make(map[string]bool)
+	totalLoad := 0
+	waiting := true
+	for waiting && len(answered) < sent {
+		select {
+		case response := <-waiter.responses:
+			if !answered[response.from.String()] {
+				answered[response.from.String()] = true
+				totalLoad += int(response.load)
+			}
+		case <-timeout.C:
+			waiting = false
+		case <-ctx.Done():
+			waiting = false
+		}
+	}
+
+	if len(answered) == 0 {
+		return nil, errors.New("no peer confirmed the publish")
+	}
+
+	return &PublishResult{Peers: len(answered), Load: byte(totalLoad / len(answered))}, nil
+}
+
+// Publish on Kad that the [files] contain [keyword] on their names
+func (client *Client) PublishKeyword(ctx context.Context, keyword string, files []*SharedFile) (*PublishResult, error) {
+	if len(files) == 0 {
+		return nil, errors.New("there are no files to publish")
+	} else if len(files) > maxFilesPerKeywordPublish {
+		files = files[:maxFilesPerKeywordPublish]
+	}
+
+	target := KeywordHash(keyword)
+	payload := NewWriter()
+	payload.WriteUInt128(target)
+	payload.WriteUInt16(uint16(len(files)))
+	for _, file := range files {
+		payload.WriteUInt128(file.Hash)
+		if err := payload.WriteTags(file.keywordTags()); err != nil {
+			return nil, err
+		}
+	}
+
+	return client.publish(ctx, target, CommKad2PublichKeyReq, payload.Bytes())
+}
+
+// Publish on Kad that we are a source of [file]
+func (client *Client) PublishSource(ctx context.Context, file *SharedFile) (*PublishResult, error) {
+	payload := NewWriter()
+	payload.WriteUInt128(file.Hash)
+	payload.WriteUInt128(&client.userHash)
+	if err := payload.WriteTags(client.sourceTags(file)); err != nil {
+		return nil, err
+	}
+
+	return client.publish(ctx, file.Hash, CommKad2PublishSourceReq, payload.Bytes())
+}
+
+// Get the tags that publish us as reachable source of [file]
+func (client *Client) sourceTags(file *SharedFile) TagList {
+	sourceType := SourceTypeHighId
+	if file.Size > 0xffffffff {
+		sourceType = SourceTypeHighIdLarge
+	}
+
+	udpPort := client.listenPort
+	if port, ok := client.ExternalUDPPort(); ok {
+		udpPort = port
+	}
+
+	return TagList{
+		NewIntTag(TagSourceType, uint64(sourceType)),
+		NewIntTag(TagSourcePort, uint64(client.tcpPort)),
+		NewIntTag(TagSourceUDPPort, uint64(udpPort)),
+		NewIntTag(TagFileSize, file.Size),
+	}
+}
@@ -0,0 +1,166 @@
+package kad
+
+import (
+	"context"
+	"sleepy/types"
+	"sleepy/utils/clock"
+	"testing"
+	"time"
+)
+
+func TestClient_PublishKeyword(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+	peer := newTestClient(t)
+	defer closeTestClient(peer)
+
+	client.router.AddPeer(newTestClientPeer(peer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	file := &SharedFile{Hash: types.NewUInt128FromInt(0xf11e), Name: "kademlia.pdf", Size: 5000, Type: "Doc"}
+	published := make(chan *PublishResult)
+	go func() {
+		result, err := client.PublishKeyword(ctx, "kademlia", []*SharedFile{file})
+		if err != nil {
+			t.Errorf("Publish error: %s", err)
+		}
+		published <- result
+	}()
+
+	relayTestPacket(t, peer)
+	opcode, request, addr := receiveTestRequest(t, peer)
+	if opcode != CommKad2PublichKeyReq {
+		t.Fatalf("Keyword publish request expected, got opcode %x", opcode)
+	}
+
+	target, _ := request.ReadUInt128()
+	count, _ := request.ReadUInt16()
+	fileId, _ := request.ReadUInt128()
+	tags, err := request.ReadTags()
+	if err != nil {
+		t.Fatalf("Tags read error: %s", err)
+	}
+	if !target.Equal(KeywordHash("kademlia")) || count != 1 || !fileId.Equal(file.Hash) {
+		t.Errorf("Request mismatch, target: %s, count: %d", target.ToHexString(), count)
+	}
+	if name, _ := tags.GetString(TagFileName); name != file.Name {
+		t.Errorf("File name mismatch, got %s", name)
+	}
+	if fileType, _ := tags.GetString(TagFileType); fileType != file.Type {
+		t.Errorf("File type mismatch, got %s", fileType)
+	}
+
+	response := newResponse(peer, addr)
+	response.SetOpcode(CommKad2PublishRes)
+	response.WriteUInt128(target)
+	response.WriteByte(40)
+	response.Send()
+
+	if result := <-published; result == nil || result.Peers != 1 || result.Load != 40 {
+		t.Errorf("Result mismatch: %+v", result)
+	}
+}
+
+func TestClient_PublishSource(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+	peer := newTestClient(t)
+	defer closeTestClient(peer)
+
+	client.tcpPort = 4662
+	client.router.AddPeer(newTestClientPeer(peer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	file := &SharedFile{Hash: types.NewUInt128FromInt(0xf11e), Name: "big.iso", Size: 0x100000000}
+	go client.PublishSource(ctx, file)
+
+	relayTestPacket(t, peer)
+	opcode, request, _ := receiveTestRequest(t, peer)
+	if opcode != CommKad2PublishSourceReq {
+		t.Fatalf("Source publish request expected, got opcode %x", opcode)
+	}
+
+	fileId, _ := request.ReadUInt128()
+	sourceId, _ := request.ReadUInt128()
+	tags, err := request.ReadTags()
+	if err != nil {
+		t.Fatalf("Tags read error: %s", err)
+	}
+	if !fileId.Equal(file.Hash) || !sourceId.Equal(client.UserHash()) {
+		t.Errorf("The source must be published with our user hash")
+	}
+	if sourceType, _ := tags.GetInt(TagSourceType); byte(sourceType) != SourceTypeHighIdLarge {
+		t.Errorf("Source type mismatch, got %d", sourceType)
+	}
+	if port, _ := tags.GetInt(TagSourcePort); port != 4662 {
+		t.Errorf("TCP port mismatch, got %d", port)
+	}
+}
+
+func TestPublisher_PublishPending(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	publisher := NewPublisher(client)
+	publisher.AddFile(&SharedFile{Hash: types.NewUInt128FromInt(1), Name: "kad.txt", Size: 10})
+	publisher.AddFile(&SharedFile{Hash: types.NewUInt128FromInt(2), Name: "other.txt", Size: 10})
+	publisher.RemoveFile(types.NewUInt128FromInt(2))
+
+	// Without peers the publishes fail, but they are retried on the next period
+	publisher.publishPending()
+
+	entry := publisher.files[*types.NewUInt128FromInt(1)]
+	if len(publisher.files) != 1 || entry == nil {
+		t.Fatalf("Only the added files must be published")
+	}
+	if time.Since(entry.keywordPublished) > time.Second || time.Since(entry.sourcePublished) > time.Second {
+		t.Errorf("The publish time must be updated")
+	}
+
+	publisher.Start()
+	publisher.Close()
+}
+
+func TestFileKeywords(t *testing.T) {
+	keywords := fileKeywords("Kad.Kad-Network_kad.txt")
+	if len(keywords) != 3 || keywords[0] != "kad" || keywords[1] != "network" || keywords[2] != "txt" {
+		t.Errorf("Keywords mismatch, got %v", keywords)
+	}
+}
+
+func TestPublisher_Clock(t *testing.T) {
+	client := newTestClient(t)
+	defer closeTestClient(client)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	testClock := clock.NewManual(start)
+	publisher := NewPublisherWithClock(client, testClock)
+	publisher.AddFile(&SharedFile{Hash: types.NewUInt128FromInt(1), Name: "kad.txt", Size: 10})
+
+	// Wait until the file was published at [keywordTime] and [sourceTime]
+	waitPublished := func(keywordTime time.Time, sourceTime time.Time) {
+		for wait := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+			publisher.access.Lock()
+			entry := *publisher.files[*types.NewUInt128FromInt(1)]
+			publisher.access.Unlock()
+
+			if entry.keywordPublished.Equal(keywordTime) && entry.sourcePublished.Equal(sourceTime) {
+				return
+			} else if time.Since(wait) > time.Second {
+				t.Fatalf("Publish time mismatch, keywords: %s, sources: %s", entry.keywordPublished, entry.sourcePublished)
+			}
+		}
+	}
+
+	publisher.Start()
+	defer publisher.Close()
+	waitPublished(start, start)
+
+	// Only the sources are republished when the clock reaches their republish time
+	testClock.Advance(sourceRepublishTime)
+	waitPublished(start, start.Add(sourceRepublishTime))
+}
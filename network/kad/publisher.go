@@ -0,0 +1,208 @@
+package kad
+
+import (
+	"context"
+	"log"
+	"sleepy/types"
+	"sleepy/utils/clock"
+	"sync"
+	"time"
+)
+
+const (
+	keywordRepublishTime      = 24 * time.Hour  // Period between keyword publishes of a file
+	sourceRepublishTime       = 5 * time.Hour   // Period between source publishes of a file
+	publisherCheckPeriod      = time.Minute     // Period between checks for pending publishes
+	publisherPublishTime      = 2 * time.Minute // Max duration of each publish
+	maxFilesPerKeywordPublish = 150             // Max files sent on each KADEMLIA2_PUBLISH_KEY_REQ
+)
+
+// SharedFile is a file that we share and announce on Kad
+type SharedFile struct {
+	Hash *types.UInt128 // Its ToBytes() is the ed2k file hash
+	Name string
+	Size uint64
+	Type string  // ed2k file type (Audio, Video, Image, Doc, Pro, Arc or Iso), can be empty
+	Tags TagList // Other tags published with the keywords, like the media details
+}
+
+// Get the tags that publish the file on its keywords
+func (file *SharedFile) keywordTags() TagList {
+	tags := TagList{
+		NewStringTag(TagFileName, file.Name),
+		NewIntTag(TagFileSize, file.Size),
+		NewIntTag(TagSources, 1),
+	}
+	if file.Type != "" {
+		tags = append(tags, NewStringTag(TagFileType, file.Type))
+	}
+	return append(tags, file.Tags...)
+}
+
+// A shared file and when it was published for last time
+type publisherFile struct {
+	file             *SharedFile
+	keywordPublished time.Time
+	sourcePublished  time.Time
+}
+
+// Publisher announces the shared files on Kad and republishes them periodically, the
+// keywords every 24 hours and the sources every 5 hours
+type Publisher struct {
+	client *Client
+	files  map[types.UInt128]*publisherFile
+	clock  clock.Clock
+	access sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewPublisher(client *Client) *Publisher {
+	return NewPublisherWithClock(client, clock.System)
+}
+
+// Create a publisher that republishes the files following the [clock]
+func NewPublisherWithClock(client *Client, clock clock.Clock) *Publisher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Publisher{
+		client: client,
+		files:  make(map[types.UInt128]*publisherFile),
+		clock:  clock,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Add a file to publish. It will be published on the next check
+func (publisher *Publisher) AddFile(file *SharedFile) {
+	publisher.access.Lock()
+	defer publisher.access.Unlock()
+
+	if _, exists := publisher.files[*file.Hash]; !exists {
+		publisher.files[*file.Hash] = &publisherFile{file: file}
+	}
+}
+
+// Stop publishing the file with [hash]
+func (publisher *Publisher) RemoveFile(hash *types.UInt128) {
+	publisher.access.Lock()
+	delete(publisher.files, *hash)
+	publisher.access.Unlock()
+}
+
+// Start publishing the files periodically
+func (publisher *Publisher) Start() {
+	publisher.done = make(chan struct{})
+	ticker := publisher.clock.NewTicker(publisherCheckPeriod)
+	go func() {
+		defer close(publisher.done)
+		defer ticker.Stop()
+
+		for {
+			publisher.publishPending()
+
+			select {
+			case <-ticker.C:
+			case <-publisher.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop the publisher, cancelling the publishes in progress
+func (publisher *Publisher) Close() {
+	publisher.cancel()
+	if publisher.done != nil {
+		<-publisher.done
+	}
+}
+
+// Publish the keywords and sources of the files that weren't published recently
+func (publisher *Publisher) publishPending() {
+	now := publisher.clock.Now()
+	keywords := make(map[string][]*publisherFile)
+	sources := make([]*publisherFile, 0)
+
+	publisher.access.Lock()
+	for _, entry := range publisher.files {
+		if now.Sub(entry.keywordPublished) >= keywordRepublishTime {
+			for _, keyword := range fileKeywords(entry.file.Name) {
+				keywords[keyword] = append(keywords[keyword], entry)
+			}
+		}
+		if now.Sub(entry.sourcePublished) >= sourceRepublishTime {
+			sources = append(sources, entry)
+		}
+	}
+	publisher.access.Unlock()
+
+	for keyword, entries := range keywords {
+		files := make([]*SharedFile, 0, len(entries))
+		for _, entry := range entries {
+			files = append(files, entry.file)
+		}
+
+		for start := 0; start < len(files); start += maxFilesPerKeywordPublish {
+			end := start + maxFilesPerKeywordPublish
+			if end > len(files) {
+				end = len(files)
+			}
+
+			if !publisher.run(func(ctx context.Context) (*PublishResult, error) {
+				return publisher.client.PublishKeyword(ctx, keyword, files[start:end])
+			}, "keyword "+keyword) {
+				return
+			}
+		}
+	}
+
+	for _, entry := range sources {
+		if !publisher.run(func(ctx context.Context) (*PublishResult, error) {
+			return publisher.client.PublishSource(ctx, entry.file)
+		}, "source of "+entry.file.Name) {
+			return
+		}
+	}
+
+	// The files are republished on the next period even if some publish failed
+	publisher.access.Lock()
+	for _, entries := range keywords {
+		for _, entry := range entries {
+			entry.keywordPublished = now
+		}
+	}
+	for _, entry := range sources {
+		entry.sourcePublished = now
+	}
+	publisher.access.Unlock()
+}
+
+// Run a publish with a time limit. Return false if the publisher was closed
+func (publisher *Publisher) run(publish func(ctx context.Context) (*PublishResult, error), description string) bool {
+	ctx, cancel := context.WithTimeout(publisher.ctx, publisherPublishTime)
+	defer cancel()
+
+	result, err := publish(ctx)
+	if err != nil {
+		log.Printf("Publish of %s error: %s", description, err)
+	} else {
+		log.Printf("Published %s on %d peers with %d%% load", description, result.Peers, result.Load)
+	}
+
+	return publisher.ctx.Err() == nil
+}
+
+// Get the distinct keywords of a file name
+func fileKeywords(name string) []string {
+	seen := make(map[string]bool)
+	keywords := make([]string, 0)
+	for _, keyword := range splitKeywords(name) {
+		if !seen[keyword] {
+			seen[keyword] = true
+			keywords = append(keywords, keyword)
+		}
+	}
+	return keywords
+}
@@ -2,6 +2,9 @@ package kad
 
 import (
 	"errors"
+	"math"
+	"net"
+	kadTypes "sleepy/network/kad/types"
 	"sleepy/types"
 )
 
@@ -10,6 +13,11 @@ type Reader struct {
 	offset int64
 }
 
+// Create a new reader over the [data] slice
+func NewReader(data []byte) *Reader {
+	return &Reader{data: data, offset: 0}
+}
+
 func (reader *Reader) Read(buffer []byte) (n int, err error) {
 	if reader.offset < int64(len(reader.data)) {
 		bytesRead := copy(buffer, reader.data[reader.offset:])
@@ -49,6 +57,15 @@ func (reader *Reader) ReadByte() (byte, error) {
 
 
 func (reader *Reader) ReadBytes(size uint) ([]byte, error) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+
+	// The size can come from the wire, check it before allocating the buffer
+	if remaining := int64(len(reader.data)) - reader.offset; remaining < 0 || uint64(size) > uint64(remaining) {
+		return nil, errors.New("size mismatch")
+	}
+
 	buffer := make([]byte, size)
 	count, err := reader.Read(buffer)
 	if err != nil {
@@ -69,6 +86,20 @@ func (reader *Reader) ReadUInt32() (uint32, error) {
 	}
 }
 
+func (reader *Reader) ReadUInt64() (uint64, error) {
+	low, err := reader.ReadUInt32()
+	if err != nil {
+		return 0, err
+	}
+
+	high, err := reader.ReadUInt32()
+	if err != nil {
+		return 0, err
+	} else {
+		return uint64(low) + uint64(high)<<32, nil
+	}
+}
+
 func (reader *Reader) ReadUInt16() (uint16, error) {
 	buffer, err := reader.ReadBytes(2)
 	if err != nil {
@@ -88,13 +119,63 @@ func (reader *Reader) ReadInt() (int, error) {
 	return int(value), err
 }
 
+func (reader *Reader) ReadFloat32() (float32, error) {
+	value, err := reader.ReadUInt32()
+	return math.Float32frombits(value), err
+}
+
 func (reader *Reader) ReadUInt128() (*types.UInt128, error) {
 	buffer, err := reader.ReadBytes(16)
 	if err != nil {
 		return nil, err
 	} else {
-		return types.NewUInt128FromByteArray(buffer)
+		return types.NewUInt128FromKadByteArray(buffer)
+	}
+}
+
+// Read an IPv4 address, sent by Kad as an uint32 in host byte order
+func (reader *Reader) ReadIPv4() (net.IP, error) {
+	value, err := reader.ReadUInt32()
+	if err != nil {
+		return nil, err
+	} else {
+		return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value)), nil
+	}
+}
+
+// Read a Kad2 contact: id, IP, UDP port, TCP port and version
+func (reader *Reader) ReadPeer() (*kadTypes.Peer, error) {
+	id, err := reader.ReadUInt128()
+	if err != nil {
+		return nil, err
+	}
+
+	ip, err := reader.ReadIPv4()
+	if err != nil {
+		return nil, err
+	}
+
+	udpPort, err := reader.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpPort, err := reader.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
 	}
+
+	peer := kadTypes.NewPeer(id)
+	peer.SetIP(ip, false)
+	peer.SetUDPPort(udpPort)
+	peer.SetTCPPort(tcpPort)
+	peer.SetProtocolVersion(version)
+	return peer, nil
 }
 
 func (reader *Reader) ReadString(txtSize uint) (string, error) {
@@ -106,70 +187,107 @@ func (reader *Reader) ReadString(txtSize uint) (string, error) {
 	}
 }
 
-func (reader *Reader) ReadTags() (map[interface{}]interface{}, error) {
-	tags := make(map[interface{}]interface{})
+// Read a string preceded by his length as uint16
+func (reader *Reader) ReadLengthString() (string, error) {
+	txtSize, err := reader.ReadUInt16()
+	if err != nil {
+		return "", err
+	} else {
+		return reader.ReadString(uint(txtSize))
+	}
+}
 
-	tagCount, err := reader.ReadUInt32()
+// Read a Kad tag list, preceded by his tag count as byte
+func (reader *Reader) ReadTags() (TagList, error) {
+	tagCount, err := reader.ReadByte()
 
 	if err != nil {
 		return nil, err
 	}
 
-	for ind := uint32(0); ind < tagCount; ind++ {
-		tagType, err := reader.ReadByte()
+	tags := make(TagList, 0, tagCount)
+
+	for ind := byte(0); ind < tagCount; ind++ {
+		tag, err := reader.ReadTag()
 
 		if err != nil {
 			return nil, err
 		}
 
-		var key interface{}
-		keySize, err := reader.ReadUInt16()
+		tags = append(tags, tag)
+	}
 
-		if err != nil {
-			return nil, err
-		} else if keySize == 1 {
-			byte, err := reader.ReadByte()
+	return tags, nil
+}
 
-			if err != nil {
-				return nil, err
-			} else {
-				key = uint8(byte)
-			}
-		} else {
-			key, err = reader.ReadString(uint(keySize))
+// Read a single Kad tag
+func (reader *Reader) ReadTag() (*Tag, error) {
+	tagType, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
 
-			if err != nil {
-				return nil, err
-			}
-		}
+	name, err := reader.ReadLengthString()
+	if err != nil {
+		return nil, err
+	}
 
-		switch tagType {
-		case 0x02:
-			valueSize, err := reader.ReadUInt16()
-			if err != nil {
-				return nil, err
-			}
-			tags[key], err = reader.ReadString(uint(valueSize))
-			if err != nil {
-				return nil, err
-			}
-			break
-		case 0x03:
-			tags[key], err = reader.ReadInt32()
-			if err != nil {
-				return nil, err
-			}
-			break
-		case 0x04:
-			tags[key], err = reader.ReadInt32() // FIXME: Float
-			if err != nil {
-				return nil, err
+	tag := &Tag{Name: name, Type: tagType}
+
+	switch {
+	case tagType == TagTypeHash16:
+		tag.Value, err = reader.ReadBytes(16)
+	case tagType == TagTypeString:
+		tag.Value, err = reader.ReadLengthString()
+	case tagType == TagTypeUInt32:
+		tag.Value, err = reader.ReadUInt32()
+	case tagType == TagTypeFloat32:
+		tag.Value, err = reader.ReadFloat32()
+	case tagType == TagTypeBool:
+		var value byte
+		value, err = reader.ReadByte()
+		tag.Value = value != 0
+	case tagType == TagTypeBoolArray:
+		var size uint16
+		var data []byte
+		size, err = reader.ReadUInt16()
+		if err == nil {
+			data, err = reader.ReadBytes(uint(size/8) + 1)
+		}
+		if err == nil {
+			values := make([]bool, size)
+			for i := range values {
+				values[i] = data[i/8]&(1<<uint(i%8)) != 0
 			}
-			break
-		default:
-			return nil, errors.New("unknown tag type")
+			tag.Value = values
+		}
+	case tagType == TagTypeBlob:
+		var size uint32
+		size, err = reader.ReadUInt32()
+		if err == nil {
+			tag.Value, err = reader.ReadBytes(uint(size))
+		}
+	case tagType == TagTypeUInt16:
+		tag.Value, err = reader.ReadUInt16()
+	case tagType == TagTypeUInt8:
+		tag.Value, err = reader.ReadByte()
+	case tagType == TagTypeBsob:
+		var size byte
+		size, err = reader.ReadByte()
+		if err == nil {
+			tag.Value, err = reader.ReadBytes(uint(size))
 		}
+	case tagType == TagTypeUInt64:
+		tag.Value, err = reader.ReadUInt64()
+	case tagType >= TagTypeStr1 && tagType <= TagTypeStr16:
+		tag.Value, err = reader.ReadString(uint(tagType - TagTypeStr1 + 1))
+	default:
+		return nil, errors.New("unknown tag type")
 	}
 
-	return tags, nil
+	if err != nil {
+		return nil, err
+	}
+
+	return tag, nil
 }
@@ -33,3 +33,45 @@ func TestReader_Correct(t *testing.T) {
 		t.Errorf("Must has read errors: %s", err)
 	}
 }
+
+func TestReader_ReadTags(t *testing.T) {
+	data := []byte{
+		0x02,                         // Tag count
+		0x09, 0x01, 0x00, 0xf2, 0x05, // TAG_KADMISCOPTIONS <uint8> 5
+		0x08, 0x01, 0x00, 0xfc, 0x36, 0x12, // TAG_SOURCEUPORT <uint16> 4662
+	}
+
+	reader := NewReader(data)
+	tags, err := reader.ReadTags()
+	if err != nil {
+		t.Fatalf("Read errors: %s", err)
+	}
+
+	if value, ok := tags.GetInt(TagKadMiscOptions); !ok || value != 5 {
+		t.Errorf("Misc options tag mismatch, got: %d, want: %d", value, 5)
+	}
+	if value, ok := tags.GetInt(TagSourceUDPPort); !ok || value != 4662 {
+		t.Errorf("UDP port tag mismatch, got: %d, want: %d", value, 4662)
+	}
+
+	_, err = NewReader([]byte{0x01, 0x30, 0x01, 0x00, 0x01}).ReadTags()
+	if err == nil {
+		t.Errorf("Must fail with unknown tag types")
+	}
+}
+
+func TestReader_ReadTagsHugeBlob(t *testing.T) {
+	data := []byte{
+		0x01,                   // Tag count
+		0x07, 0x01, 0x00, 0x01, // TAG_NAME <blob>
+		0xff, 0xff, 0xff, 0xff, // Size of 4 GiB
+		0x00,
+	}
+
+	if _, err := NewReader(data).ReadTags(); err == nil {
+		t.Errorf("Must fail with blobs bigger than the remaining data")
+	}
+	if _, err := NewReader([]byte{0x00, 0x01}).ReadBytes(3); err == nil {
+		t.Errorf("Must fail reading more bytes than the remaining")
+	}
+}
@@ -12,5 +12,9 @@ type Request struct {
 
 type UDPRequest struct {
 	Request
-	from *net.UDPAddr
-}
\ No newline at end of file
+	from              *net.UDPAddr
+	obfuscated        bool   // The datagram was received obfuscated
+	receiverVerifyKey uint32 // Key that the sender believes we gave him
+	senderVerifyKey   uint32 // Key that the sender gives us, to obfuscate the datagrams we send him
+	validReceiverKey  bool   // The receiver key is the one we gave to the sender IP
+}
@@ -1,5 +1,112 @@
 package kad
 
+import (
+	"errors"
+	"net"
+	"sleepy/network/ed2k"
+	"sleepy/types"
+)
+
+// Response is a Kad packet that will be sent back to the peer that sent the request
 type Response struct {
+	Writer
+	client    *Client
+	to        *net.UDPAddr
+	opcode    byte
+	compress  bool
+	obfuscate bool
+	targetId  *types.UInt128
+	targetKey uint32
+}
+
+// Create a response bound to the client socket and addressed to [to]
+func newResponse(client *Client, to *net.UDPAddr) *Response {
+	return &Response{
+		Writer:    Writer{data: make([]byte, 0, 64)},
+		client:    client,
+		to:        to,
+		opcode:    CommUnknown,
+		compress:  true,
+		obfuscate: false,
+		targetId:  nil,
+		targetKey: 0,
+	}
+}
+
+// Create a response to [request], obfuscated with the key that the peer gave us
+func newReply(client *Client, request *UDPRequest) *Response {
+	response := newResponse(client, request.from)
+	if request.senderVerifyKey != 0 {
+		response.SetObfuscation(nil, request.senderVerifyKey)
+	}
+	return response
+}
+
+// Get the address where the response will be sent
+func (response *Response) To() *net.UDPAddr {
+	return response.to
+}
+
+// Get the Kad command of the response
+func (response *Response) Opcode() byte {
+	return response.opcode
+}
+
+// Set the Kad command of the response
+func (response *Response) SetOpcode(opcode byte) {
+	response.opcode = opcode
+}
+
+// Set if the payload can be sent compressed. It will be compressed only when it is
+// bigger than compressionThreshold and compression saves space
+func (response *Response) SetCompression(enabled bool) {
+	response.compress = enabled
+}
+
+// Send the packet obfuscated with the Kad id of the receiver or, if [targetId] is nil,
+// with the verify key that the receiver gave us. Without both, it is sent in plain
+func (response *Response) SetObfuscation(targetId *types.UInt128, receiverKey uint32) {
+	response.obfuscate = targetId != nil || receiverKey != 0
+	response.targetId = targetId
+	response.targetKey = receiverKey
+}
+
+// Build the datagram with the header and the written payload
+func (response *Response) Packet() ([]byte, error) {
+	if response.opcode == CommUnknown {
+		return nil, errors.New("response opcode not set")
+	}
+
+	packet := NewWriter()
+	packet.WriteHeader(ed2k.ProtKadUDP, response.opcode)
+	packet.WriteBytes(response.Bytes())
+
+	if response.compress && response.Len() > compressionThreshold {
+		compressed, err := compressPayload(response.Bytes())
+		if err != nil {
+			return nil, err
+		}
+
+		if len(compressed) < response.Len() {
+			packet.Reset()
+			packet.WriteHeader(ed2k.ProtKadUDPCompress, response.opcode)
+			packet.WriteBytes(compressed)
+		}
+	}
+
+	if response.obfuscate {
+		return obfuscatePacket(packet.Bytes(), response.targetId, response.targetKey, response.client.UDPVerifyKey(response.to.IP))
+	}
+
+	return packet.Bytes(), nil
+}
+
+// Send the response to the requesting peer
+func (response *Response) Send() error {
+	packet, err := response.Packet()
+	if err != nil {
+		return err
+	}
 
+	return response.client.sendPacket(packet, response.to)
 }
@@ -0,0 +1,122 @@
+package kad
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"net"
+	"sleepy/network/ed2k"
+	"testing"
+	"time"
+)
+
+// Create a client listening on a random local port and a socket to receive its datagrams
+func newTestClientPair(t *testing.T) (*Client, *net.UDPConn) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+
+	peerConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+
+	client := NewClient(0, nil)
+	client.serverConn = serverConn
+	return client, peerConn
+}
+
+func receiveTestPacket(t *testing.T, conn *net.UDPConn) []byte {
+	buf := make([]byte, 8192)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Receive error: %s", err)
+	}
+	return buf[:n]
+}
+
+func TestResponse_Send(t *testing.T) {
+	client, peerConn := newTestClientPair(t)
+	defer client.serverConn.Close()
+	defer peerConn.Close()
+
+	response := newResponse(client, peerConn.LocalAddr().(*net.UDPAddr))
+	response.SetOpcode(CommKad2Pong)
+	response.WriteUInt16(4672)
+
+	if err := response.Send(); err != nil {
+		t.Fatalf("Send error: %s", err)
+	}
+
+	packet := receiveTestPacket(t, peerConn)
+	if !bytes.Equal(packet, []byte{ed2k.ProtKadUDP, CommKad2Pong, 0x40, 0x12}) {
+		t.Errorf("Packet mismatch, got: %x", packet)
+	}
+}
+
+func TestResponse_SendCompressed(t *testing.T) {
+	client, peerConn := newTestClientPair(t)
+	defer client.serverConn.Close()
+	defer peerConn.Close()
+
+	payload := bytes.Repeat([]byte("kad"), 100)
+	response := newResponse(client, peerConn.LocalAddr().(*net.UDPAddr))
+	response.SetOpcode(CommKad2SearchRes)
+	response.WriteBytes(payload)
+
+	if err := response.Send(); err != nil {
+		t.Fatalf("Send error: %s", err)
+	}
+
+	packet := receiveTestPacket(t, peerConn)
+	if packet[0] != ed2k.ProtKadUDPCompress || packet[1] != CommKad2SearchRes {
+		t.Fatalf("Header mismatch, got: %x", packet[:2])
+	}
+
+	zReader, err := zlib.NewReader(bytes.NewReader(packet[2:]))
+	if err != nil {
+		t.Fatalf("Decompress error: %s", err)
+	}
+	inflated, err := ioutil.ReadAll(zReader)
+	if err != nil {
+		t.Fatalf("Decompress error: %s", err)
+	} else if !bytes.Equal(inflated, payload) {
+		t.Errorf("Decompressed payload mismatch")
+	}
+}
+
+func TestResponse_PacketCompression(t *testing.T) {
+	response := newResponse(NewClient(0, nil), nil)
+	response.SetOpcode(CommKad2SearchRes)
+	response.WriteBytes(bytes.Repeat([]byte("kad"), 10))
+
+	packet, err := response.Packet()
+	if err != nil {
+		t.Fatalf("Packet error: %s", err)
+	} else if packet[0] != ed2k.ProtKadUDP {
+		t.Errorf("Small payloads must not be compressed")
+	}
+
+	response.WriteBytes(bytes.Repeat([]byte("kad"), 100))
+	response.SetCompression(false)
+
+	packet, err = response.Packet()
+	if err != nil {
+		t.Fatalf("Packet error: %s", err)
+	} else if packet[0] != ed2k.ProtKadUDP {
+		t.Errorf("Payloads must not be compressed with compression disabled")
+	}
+}
+
+func TestResponse_OpcodeRequired(t *testing.T) {
+	client, peerConn := newTestClientPair(t)
+	defer client.serverConn.Close()
+	defer peerConn.Close()
+
+	response := newResponse(client, peerConn.LocalAddr().(*net.UDPAddr))
+	if response.Send() == nil {
+		t.Errorf("Must fail without opcode")
+	}
+}
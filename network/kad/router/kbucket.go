@@ -8,28 +8,37 @@ import (
 	"sleepy/types"
 	"sort"
 	"sync"
+	"time"
 )
 
 const (
-	maxBucketSize = 16 // Max number of peers in each k-bucket
-	maxPeersPerIP = 3  // Number of peers permitted from same public IP
+	maxBucketSize        = 16               // Max number of peers in each k-bucket
+	maxReplacementPeers  = maxBucketSize    // Max number of candidates waiting for a place in each k-bucket
+	peerChallengeTimeout = 30 * time.Second // Time that the oldest peer has to answer before being replaced
 )
 
 // K-bucket is a queue of k peers ordered by TTL
 type kBucket struct {
-	peers       []*kadTypes.Peer
-	peersAccess sync.Mutex
+	peers            []*kadTypes.Peer
+	replacements     []*kadTypes.Peer // Candidates for the bucket when it's full, the most recently seen last
+	challenged       *kadTypes.Peer   // Oldest peer asked to prove that it's alive
+	challengeExpires time.Time
+	tracker          *peerTracker // Limits shared by all the buckets of the router, if any
+	peersAccess      sync.Mutex
 }
 
-func newKBucket() *kBucket {
+func newKBucket(tracker *peerTracker) *kBucket {
 	return &kBucket{
-		peers:       make([]*kadTypes.Peer, maxBucketSize),
+		peers:       make([]*kadTypes.Peer, 0, maxBucketSize),
+		tracker:     tracker,
 		peersAccess: sync.Mutex{},
 	}
 }
 
 // Count the number of peers on this k-bucket
 func (bucket *kBucket) CountPeers() int {
+	bucket.peersAccess.Lock()
+	defer bucket.peersAccess.Unlock()
 	return len(bucket.peers)
 }
 
@@ -46,15 +55,11 @@ func (bucket *kBucket) AddPeer(newPeer *kadTypes.Peer) error {
 
 	bucket.peersAccess.Lock()
 
-	sameNetwork := 0
 	for _, peer := range bucket.peers {
 		if peer.Equal(newPeer) {
 			bucket.peersAccess.Unlock()
 			return errors.New("kBucket already contains the passed peer")
 		}
-		if peer.IP().Equal(*newPeer.IP()) {
-			sameNetwork++
-		}
 	}
 
 	if len(bucket.peers) >= maxBucketSize {
@@ -62,17 +67,70 @@ func (bucket *kBucket) AddPeer(newPeer *kadTypes.Peer) error {
 		return errors.New("the current kBucket is full")
 	}
 
-	if sameNetwork >= maxPeersPerIP {
+	// Without router, the bucket keeps the IP limit by itself
+	if bucket.tracker == nil && bucket.countIP(*newPeer.IP(), nil) >= maxPeersPerIP {
 		bucket.peersAccess.Unlock()
 		return errors.New("many peers for the current IP")
 	}
 
+	if err := bucket.tracker.add(*newPeer.IP()); err != nil {
+		bucket.peersAccess.Unlock()
+		return err
+	}
+
 	bucket.peers = append(bucket.peers, newPeer)
 	bucket.peersAccess.Unlock()
-	// TODO: Adjust global tracking
 	return nil
 }
 
+// Update the contact data of a peer of the bucket from other instance with the same id, and
+// move it to the end as the most recently seen
+func (bucket *kBucket) UpdatePeer(newPeer *kadTypes.Peer) error {
+	peer, err := bucket.GetPeer(newPeer.Id())
+	if err != nil {
+		return err
+	}
+
+	// Like eMule, the packets that anybody can send don't move a verified peer, and a peer
+	// that gave us a verify key must send it again
+	keyIP := peer.UDPKeyIP()
+	if key := peer.UDPKey(keyIP); key != 0 && newPeer.UDPKey(keyIP) != key {
+		return errors.New("the sender verify key doesn't match the peer one")
+	}
+	if peer.IsIpVerified() && !peer.IP().Equal(*newPeer.IP()) {
+		return errors.New("the IP of a verified peer can't change")
+	}
+
+	// The new IP must fit in the limits of the router, or of the bucket without router
+	if bucket.tracker == nil {
+		bucket.peersAccess.Lock()
+		sameIP := bucket.countIP(*newPeer.IP(), peer)
+		bucket.peersAccess.Unlock()
+		if sameIP >= maxPeersPerIP {
+			return errors.New("many peers for the current IP")
+		}
+	}
+	if err := bucket.tracker.change(*peer.IP(), *newPeer.IP()); err != nil {
+		return err
+	}
+	if err := peer.Update(newPeer); err != nil {
+		bucket.tracker.change(*newPeer.IP(), *peer.IP())
+		return err
+	}
+	return bucket.pushToEnd(peer)
+}
+
+// Count the peers of the bucket with the [ip], except [ignored]. The lock must be held
+func (bucket *kBucket) countIP(ip net.IP, ignored *kadTypes.Peer) int {
+	count := 0
+	for _, peer := range bucket.peers {
+		if peer != ignored && peer.IP().Equal(ip) {
+			count++
+		}
+	}
+	return count
+}
+
 // Remove a peer from the bucket
 func (bucket *kBucket) RemovePeer(peer *kadTypes.Peer) error {
 	bucket.peersAccess.Lock()
@@ -80,6 +138,10 @@ func (bucket *kBucket) RemovePeer(peer *kadTypes.Peer) error {
 	for index, peertr := range bucket.peers {
 		if peertr.Equal(peer) {
 			bucket.peers = append(bucket.peers[0:index], bucket.peers[index+1:len(bucket.peers)]...)
+			bucket.tracker.remove(*peertr.IP())
+			if bucket.challenged != nil && bucket.challenged.Equal(peer) {
+				bucket.challenged = nil
+			}
 			bucket.peersAccess.Unlock()
 			return nil
 		}
@@ -124,6 +186,7 @@ func (bucket *kBucket) GetPeerByAddr(addr net.Addr) (*kadTypes.Peer, error) {
 		port = uint16(pAddr.Port)
 		isTcp = true
 	default:
+		bucket.peersAccess.Unlock()
 		return nil, errors.New("incompatible network type")
 	}
 
@@ -162,6 +225,9 @@ func (bucket *kBucket) GetRandomPeer() (*kadTypes.Peer, error) {
 
 // Return the oldest peer in the bucket or null if not exists
 func (bucket *kBucket) OldestPeer() *kadTypes.Peer {
+	bucket.peersAccess.Lock()
+	defer bucket.peersAccess.Unlock()
+
 	if len(bucket.peers) > 0 {
 		return bucket.peers[0]
 	} else {
@@ -175,6 +241,9 @@ func (bucket *kBucket) ContainsPeer(id *types.UInt128) bool {
 }
 
 func (bucket *kBucket) Peers() []*kadTypes.Peer {
+	bucket.peersAccess.Lock()
+	defer bucket.peersAccess.Unlock()
+
 	peerCpy := make([]*kadTypes.Peer, len(bucket.peers))
 	copy(peerCpy, bucket.peers)
 	return peerCpy
@@ -182,9 +251,9 @@ func (bucket *kBucket) Peers() []*kadTypes.Peer {
 
 // Get the closest [max] peers respect the [to] id.
 func (bucket *kBucket) GetClosestPeers(to *types.UInt128, max int) []*kadTypes.Peer {
-	if len(bucket.peers) > 0 {
+	if peers := bucket.Peers(); len(peers) > 0 {
 		// Filter to leave only the active peers
-		peerCpy := kadTypes.Filter(bucket.Peers(), func(peer *kadTypes.Peer) bool {
+		peerCpy := kadTypes.Filter(peers, func(peer *kadTypes.Peer) bool {
 			return peer.IsIpVerified() && peer.IsAlive()
 		})
 
@@ -234,5 +303,98 @@ func (bucket *kBucket) SetPeerAlive(id *types.UInt128) error {
 	}
 
 	inPeer.UpdateType()
+	bucket.endChallenge(inPeer)
 	return bucket.pushToEnd(inPeer)
 }
+
+// Keep a peer as candidate to replace a dead peer of the bucket. If the cache is full, the
+// least recently seen candidate is dropped
+func (bucket *kBucket) AddReplacement(newPeer *kadTypes.Peer) {
+	bucket.peersAccess.Lock()
+	defer bucket.peersAccess.Unlock()
+
+	for index, peer := range bucket.replacements {
+		if peer.Equal(newPeer) {
+			bucket.replacements = append(bucket.replacements[:index], bucket.replacements[index+1:]...)
+			break
+		}
+	}
+
+	bucket.replacements = append(bucket.replacements, newPeer)
+	if len(bucket.replacements) > maxReplacementPeers {
+		bucket.replacements = bucket.replacements[len(bucket.replacements)-maxReplacementPeers:]
+	}
+}
+
+// Get the candidates to replace the peers of the bucket
+func (bucket *kBucket) Replacements() []*kadTypes.Peer {
+	bucket.peersAccess.Lock()
+	defer bucket.peersAccess.Unlock()
+
+	peerCpy := make([]*kadTypes.Peer, len(bucket.replacements))
+	copy(peerCpy, bucket.replacements)
+	return peerCpy
+}
+
+// Start a challenge to the oldest peer, that must be seen again before [now] plus the challenge
+// timeout to keep its place. Return the challenged peer, or nil if a challenge is in progress
+func (bucket *kBucket) startChallenge(now time.Time) *kadTypes.Peer {
+	oldestPeer := bucket.OldestPeer()
+
+	bucket.peersAccess.Lock()
+	defer bucket.peersAccess.Unlock()
+
+	if bucket.challenged != nil || oldestPeer == nil {
+		return nil
+	}
+
+	bucket.challenged = oldestPeer
+	bucket.challengeExpires = now.Add(peerChallengeTimeout)
+	return oldestPeer
+}
+
+// End the challenge of [peer] if it's the challenged one. Only a packet received from the
+// peer proves that it's alive, so it keeps its place
+func (bucket *kBucket) endChallenge(peer *kadTypes.Peer) {
+	bucket.peersAccess.Lock()
+	defer bucket.peersAccess.Unlock()
+
+	if bucket.challenged != nil && bucket.challenged.Equal(peer) {
+		bucket.challenged = nil
+	}
+}
+
+// Replace the challenged peer with the most recently seen candidate if it didn't answer in
+// time. Return the removed peer, or nil if any
+func (bucket *kBucket) resolveChallenge(now time.Time) *kadTypes.Peer {
+	bucket.peersAccess.Lock()
+	challenged := bucket.challenged
+	if challenged == nil || now.Before(bucket.challengeExpires) {
+		bucket.peersAccess.Unlock()
+		return nil
+	}
+	bucket.peersAccess.Unlock()
+
+	if bucket.RemovePeer(challenged) != nil {
+		return nil
+	}
+	bucket.fillFromReplacements()
+	return challenged
+}
+
+// Move the most recently seen candidates to the bucket while it has free space
+func (bucket *kBucket) fillFromReplacements() {
+	for !bucket.IsFull() {
+		bucket.peersAccess.Lock()
+		if len(bucket.replacements) == 0 {
+			bucket.peersAccess.Unlock()
+			return
+		}
+		candidate := bucket.replacements[len(bucket.replacements)-1]
+		bucket.replacements = bucket.replacements[:len(bucket.replacements)-1]
+		bucket.peersAccess.Unlock()
+
+		// The candidates that can't be added, like the ones from a crowded IP, are discarded
+		bucket.AddPeer(candidate)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	types2 "sleepy/network/kad/types"
 	"sleepy/types"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestKBucket_AddPeer(t *testing.T) {
@@ -43,6 +45,74 @@ func TestKBucket_AddMultiplePeer(t *testing.T) {
 	}
 }
 
+func TestKBucket_AddPeerSameIP(t *testing.T) {
+	// A bucket without router keeps the IP limit by itself
+	kBucket := &kBucket{}
+	for i := 0; i <= maxPeersPerIP; i++ {
+		peer := types2.NewPeer(types.NewUInt128FromInt(i))
+		peer.SetIP(net.IPv4(80, 0, 0, 1), true)
+		if err := kBucket.AddPeer(peer); i < maxPeersPerIP && err != nil {
+			t.Errorf("Add error: %s", err)
+		} else if i == maxPeersPerIP && err == nil {
+			t.Errorf("Only %d peers with the same IP are allowed", maxPeersPerIP)
+		}
+	}
+
+	other := types2.NewPeer(types.NewUInt128FromInt(100))
+	other.SetIP(net.IPv4(80, 0, 0, 2), true)
+	kBucket.AddPeer(other)
+
+	moved := types2.NewPeer(types.NewUInt128FromInt(100))
+	moved.SetIP(net.IPv4(80, 0, 0, 1), true)
+	if kBucket.UpdatePeer(moved) == nil {
+		t.Errorf("A peer can't move to an IP with %d peers", maxPeersPerIP)
+	}
+
+	same := types2.NewPeer(types.NewUInt128FromInt(0))
+	same.SetIP(net.IPv4(80, 0, 0, 1), true)
+	if err := kBucket.UpdatePeer(same); err != nil {
+		t.Errorf("A peer can keep its IP: %s", err)
+	}
+}
+
+func TestKBucket_UpdatePeer(t *testing.T) {
+	kBucket := &kBucket{}
+	publicIP := net.IPv4(80, 0, 0, 100)
+	peer := types2.NewPeer(types.NewUInt128FromInt(1))
+	peer.SetIP(net.IPv4(80, 0, 0, 1), true)
+	peer.SetUDPKey(1234, publicIP)
+	kBucket.AddPeer(peer)
+
+	// An update from other IP can't move a verified peer
+	moved := types2.NewPeer(types.NewUInt128FromInt(1))
+	moved.SetIP(net.IPv4(80, 0, 0, 2), false)
+	moved.SetUDPKey(1234, publicIP)
+	if kBucket.UpdatePeer(moved) == nil {
+		t.Errorf("The IP of a verified peer can't change")
+	}
+
+	// The update must carry the verify key of the peer
+	forged := types2.NewPeer(types.NewUInt128FromInt(1))
+	forged.SetIP(net.IPv4(80, 0, 0, 1), false)
+	forged.SetUDPPort(1000)
+	if kBucket.UpdatePeer(forged) == nil {
+		t.Errorf("An update without the verify key of the peer must fail")
+	}
+	if !peer.IP().Equal(net.IPv4(80, 0, 0, 1)) || peer.UDPPort() == 1000 {
+		t.Errorf("The rejected updates can't change the peer")
+	}
+
+	same := types2.NewPeer(types.NewUInt128FromInt(1))
+	same.SetIP(net.IPv4(80, 0, 0, 1), false)
+	same.SetUDPPort(1000)
+	same.SetUDPKey(1234, publicIP)
+	if err := kBucket.UpdatePeer(same); err != nil {
+		t.Errorf("Update error: %s", err)
+	} else if peer.UDPPort() != 1000 {
+		t.Errorf("The update must change the port of the peer")
+	}
+}
+
 func TestKBucket_Count(t *testing.T) {
 	peer := types2.NewPeer(types.NewUInt128FromInt(1))
 	kBucket := &kBucket{}
@@ -143,7 +213,7 @@ func TestKBucket_RemovePeer(t *testing.T) {
 
 func TestKBucket_IsFull(t *testing.T) {
 	kBucket := &kBucket{}
-	var peers [maxBucketSize]types2.Peer
+	var peers [maxBucketSize]*types2.Peer
 
 	if kBucket.IsFull() {
 		t.Errorf("K-Bucket must not be full")
@@ -152,7 +222,7 @@ func TestKBucket_IsFull(t *testing.T) {
 	for i := 0; i < maxBucketSize; i++ {
 		newPeer := types2.NewPeer(types.NewUInt128FromInt(i))
 		newPeer.SetIP(net.ParseIP("100.101.102."+strconv.Itoa(i)), false) // Limit of peers with the same ip
-		peers[i] = *newPeer
+		peers[i] = newPeer
 		kBucket.AddPeer(newPeer)
 	}
 
@@ -198,3 +268,104 @@ func TestKBucket_GetRandomPeer(t *testing.T) {
 		t.Errorf("Probably not random, but hey!, nothing is impossible")
 	}
 }
+
+func TestKBucket_AddReplacement(t *testing.T) {
+	kBucket := &kBucket{}
+
+	for i := 0; i < maxReplacementPeers+2; i++ {
+		kBucket.AddReplacement(types2.NewPeer(types.NewUInt128FromInt(i)))
+	}
+	kBucket.AddReplacement(types2.NewPeer(types.NewUInt128FromInt(2)))
+
+	replacements := kBucket.Replacements()
+	if len(replacements) != maxReplacementPeers {
+		t.Fatalf("K-Bucket must keep %d candidates, %d found", maxReplacementPeers, len(replacements))
+	}
+	if replacements[0].Id().Equal(types.NewUInt128FromInt(0)) || replacements[0].Id().Equal(types.NewUInt128FromInt(1)) {
+		t.Errorf("The least recently seen candidates must be dropped")
+	}
+	if !replacements[len(replacements)-1].Id().Equal(types.NewUInt128FromInt(2)) {
+		t.Errorf("A candidate seen again must be moved to the end")
+	}
+}
+
+func TestKBucket_Challenge(t *testing.T) {
+	kBucket := &kBucket{}
+	for i := 0; i < maxBucketSize; i++ {
+		peer := types2.NewPeer(types.NewUInt128FromInt(i))
+		peer.SetIP(net.ParseIP("100.101.102."+strconv.Itoa(i)), false)
+		kBucket.AddPeer(peer)
+	}
+	candidate := types2.NewPeer(types.NewUInt128FromInt(100))
+	kBucket.AddReplacement(candidate)
+
+	now := time.Now()
+	oldest := kBucket.startChallenge(now)
+	if oldest == nil || !oldest.Equal(kBucket.peers[0]) {
+		t.Fatalf("The oldest peer must be challenged")
+	} else if kBucket.startChallenge(now) != nil {
+		t.Errorf("Only one challenge can be in progress")
+	}
+
+	// Moving the peer without an answer, like the update timer does, keeps the challenge
+	kBucket.pushToEnd(oldest)
+	if kBucket.challenged == nil || !kBucket.challenged.Equal(oldest) {
+		t.Errorf("Only an answer of the peer can end the challenge")
+	}
+
+	// The oldest peer answers and keeps its place
+	kBucket.SetPeerAlive(oldest.Id())
+	if kBucket.resolveChallenge(now.Add(peerChallengeTimeout)) != nil || !kBucket.ContainsPeer(oldest.Id()) {
+		t.Errorf("A peer that answers the challenge can't be replaced")
+	}
+
+	// The new oldest peer doesn't answer
+	oldest = kBucket.startChallenge(now)
+	if kBucket.resolveChallenge(now) != nil {
+		t.Errorf("The challenged peer can't be replaced before the timeout")
+	}
+	if removed := kBucket.resolveChallenge(now.Add(peerChallengeTimeout)); removed == nil || !removed.Equal(oldest) {
+		t.Fatalf("The challenged peer must be replaced after the timeout")
+	}
+	if kBucket.ContainsPeer(oldest.Id()) || !kBucket.ContainsPeer(candidate.Id()) {
+		t.Errorf("The challenged peer must be replaced by the candidate")
+	}
+	if len(kBucket.Replacements()) != 0 {
+		t.Errorf("The candidate must leave the replacement cache")
+	}
+}
+
+func TestKBucket_Concurrent(t *testing.T) {
+	kBucket := newKBucket(newPeerTracker())
+	target := types.NewUInt128FromInt(0)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				peer := types2.NewPeer(types.NewUInt128FromInt(i % maxBucketSize))
+				peer.SetIP(net.IPv4(80, byte(g), 0, byte(i%maxBucketSize)), true)
+
+				// Add, update, verify and expire the same peers from all the goroutines
+				if kBucket.AddPeer(peer) != nil {
+					kBucket.UpdatePeer(peer)
+				}
+				if inPeer, err := kBucket.GetPeer(peer.Id()); err == nil {
+					inPeer.VerifyIp(*peer.IP())
+					inPeer.UpdateExpiration()
+				}
+				kBucket.GetClosestPeers(target, 5)
+				if i%10 == 0 {
+					kBucket.RemovePeer(peer)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if kBucket.tracker.Count() != kBucket.CountPeers() {
+		t.Errorf("The bucket must track %d peers, %d found", kBucket.CountPeers(), kBucket.tracker.Count())
+	}
+}
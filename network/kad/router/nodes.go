@@ -0,0 +1,223 @@
+package router
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	types2 "sleepy/network/kad/types"
+	"sleepy/types"
+)
+
+const (
+	nodesFileVersion     = uint32(2) // Version of the nodes.dat files written
+	maxNodesFileVersion  = uint32(3) // Last version of nodes.dat that can be read
+	maxNodesFileContacts = 5000      // Max contacts read from a nodes.dat
+	bootstrapEdition     = uint32(1) // Edition of the version 3 files with only bootstrap contacts
+)
+
+// NodesFile is the content of an eMule nodes.dat file
+type NodesFile struct {
+	Peers         []*types2.Peer
+	BootstrapOnly bool // The peers must be used only to bootstrap, not as routing contacts
+}
+
+// Read a nodes.dat of the versions 0 to 3
+func ReadNodesFile(reader io.Reader) (*NodesFile, error) {
+	in := bufio.NewReader(reader)
+	nodes := &NodesFile{Peers: make([]*types2.Peer, 0)}
+
+	var count, version uint32
+	if err := binary.Read(in, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+
+	// Since version 1 the count is 0 and is followed by the version
+	if count == 0 {
+		if err := binary.Read(in, binary.LittleEndian, &version); err != nil {
+			return nil, err
+		} else if version < 1 || version > maxNodesFileVersion {
+			return nil, errors.New("unsupported nodes.dat version")
+		}
+
+		if version == 3 {
+			var edition uint32
+			if err := binary.Read(in, binary.LittleEndian, &edition); err != nil {
+				return nil, err
+			}
+			nodes.BootstrapOnly = edition == bootstrapEdition
+		}
+
+		if err := binary.Read(in, binary.LittleEndian, &count); err != nil {
+			return nil, err
+		}
+	}
+
+	// Like eMule, read only the first contacts of big files
+	if count > maxNodesFileContacts {
+		count = maxNodesFileContacts
+	}
+
+	for ind := uint32(0); ind < count; ind++ {
+		peer, valid, err := readNodesFilePeer(in, version, nodes.BootstrapOnly)
+		if err != nil {
+			return nil, err
+		} else if valid {
+			nodes.Peers = append(nodes.Peers, peer)
+		}
+	}
+
+	return nodes, nil
+}
+
+// Read a contact of a nodes.dat of [version]. Return if the contact can be used
+func readNodesFilePeer(in io.Reader, version uint32, bootstrapOnly bool) (*types2.Peer, bool, error) {
+	var contact struct {
+		Id      [16]byte
+		IP      uint32
+		UDPPort uint16
+		TCPPort uint16
+		Extra   uint8 // Type on version 0, and Kad version since version 1
+	}
+	if err := binary.Read(in, binary.LittleEndian, &contact); err != nil {
+		return nil, false, err
+	}
+
+	id, _ := types.NewUInt128FromKadByteArray(contact.Id[:])
+	peer := types2.NewPeer(id)
+	ip := net.IPv4(byte(contact.IP>>24), byte(contact.IP>>16), byte(contact.IP>>8), byte(contact.IP))
+	peer.SetUDPPort(contact.UDPPort)
+	peer.SetTCPPort(contact.TCPPort)
+
+	valid := contact.IP != 0 && contact.UDPPort != 0
+	verified := false
+	if version == 0 {
+		valid = valid && contact.Extra < types2.ExpiredPeerType
+	} else {
+		peer.SetProtocolVersion(contact.Extra)
+	}
+
+	if version >= 2 && !bootstrapOnly {
+		var keys struct {
+			UDPKey   uint32
+			UDPKeyIP uint32
+			Verified uint8
+		}
+		if err := binary.Read(in, binary.LittleEndian, &keys); err != nil {
+			return nil, false, err
+		}
+
+		// Unlike the contact IP, eMule keeps the key IP in network byte order
+		keyIP := net.IPv4(byte(keys.UDPKeyIP), byte(keys.UDPKeyIP>>8), byte(keys.UDPKeyIP>>16), byte(keys.UDPKeyIP>>24))
+		peer.SetUDPKey(keys.UDPKey, keyIP)
+		verified = keys.Verified != 0
+	}
+
+	peer.SetIP(ip, verified)
+	return peer, valid, nil
+}
+
+// Write [peers] as a nodes.dat of version 2
+func WriteNodesFile(writer io.Writer, peers []*types2.Peer) error {
+	out := bufio.NewWriter(writer)
+
+	header := []uint32{0, nodesFileVersion, uint32(len(peers))}
+	if err := binary.Write(out, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	for _, peer := range peers {
+		// Unlike the contact IP, eMule keeps the key IP in network byte order
+		var keyIP uint32
+		if ip := peer.UDPKeyIP().To4(); ip != nil {
+			keyIP = binary.LittleEndian.Uint32(ip)
+		}
+		var ip uint32
+		if peerIP := peer.IP().To4(); peerIP != nil {
+			ip = binary.BigEndian.Uint32(peerIP)
+		}
+		var verified uint8
+		if peer.IsIpVerified() {
+			verified = 1
+		}
+
+		var contact struct {
+			Id       [16]byte
+			IP       uint32
+			UDPPort  uint16
+			TCPPort  uint16
+			Version  uint8
+			UDPKey   uint32
+			UDPKeyIP uint32
+			Verified uint8
+		}
+		copy(contact.Id[:], peer.Id().ToKadBytes())
+		contact.IP = ip
+		contact.UDPPort = peer.UDPPort()
+		contact.TCPPort = peer.TCPPort()
+		contact.Version = peer.ProtocolVersion()
+		contact.UDPKey = peer.UDPKey(peer.UDPKeyIP())
+		contact.UDPKeyIP = keyIP
+		contact.Verified = verified
+
+		if err := binary.Write(out, binary.LittleEndian, &contact); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
+
+// Load a router zone tree from the nodes.dat on [path]. The contacts of a bootstrap only
+// nodes.dat aren't added to the routing table, see BootstrapContacts
+func LoadRouterFromFile(localId types.UInt128, path string) (*Router, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	nodes, err := ReadNodesFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	router := NewRouter(&localId)
+	if nodes.BootstrapOnly {
+		router.bootstrapContacts = nodes.Peers
+	} else {
+		for _, peer := range nodes.Peers {
+			router.AddPeer(peer)
+		}
+	}
+
+	return router, nil
+}
+
+// Save the live contacts of the routing table on [path] as a nodes.dat of version 2. The
+// expired contacts and the ones with an unverified IP are left out
+func (router *Router) SaveFile(path string) error {
+	peers := types2.Filter(router.Peers(), func(peer *types2.Peer) bool {
+		return peer.IsAlive() && peer.IsIpVerified()
+	})
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteNodesFile(file, peers); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Get the contacts loaded from a bootstrap only nodes.dat, that must be asked for contacts
+// to fill the routing table
+func (router *Router) BootstrapContacts() []*types2.Peer {
+	return router.bootstrapContacts
+}
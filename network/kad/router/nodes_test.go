@@ -0,0 +1,203 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	types2 "sleepy/network/kad/types"
+	"sleepy/types"
+	"testing"
+	"time"
+)
+
+func newTestNodesPeer(id int) *types2.Peer {
+	peer := types2.NewPeer(types.NewUInt128(uint64(id), uint64(id)<<32))
+	peer.SetIP(net.IPv4(10, 0, 0, byte(id)), id%2 == 0)
+	peer.SetUDPPort(4672)
+	peer.SetTCPPort(4662)
+	peer.SetProtocolVersion(8)
+	peer.SetUDPKey(uint32(id)*1000, net.IPv4(1, 2, 3, 4))
+	return peer
+}
+
+// Write the fields of a nodes.dat contact, in the order they are passed
+func writeTestNodesContact(buf *bytes.Buffer, id int, fields ...interface{}) {
+	buf.Write(types.NewUInt128FromInt(id).ToKadBytes())
+	for _, field := range fields {
+		binary.Write(buf, binary.LittleEndian, field)
+	}
+}
+
+func TestWriteNodesFile(t *testing.T) {
+	peers := []*types2.Peer{newTestNodesPeer(1), newTestNodesPeer(2)}
+
+	buf := new(bytes.Buffer)
+	if err := WriteNodesFile(buf, peers); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	nodes, err := ReadNodesFile(buf)
+	if err != nil {
+		t.Fatalf("Read error: %s", err)
+	}
+	if nodes.BootstrapOnly || len(nodes.Peers) != 2 {
+		t.Fatalf("The 2 peers must be read, %d found", len(nodes.Peers))
+	}
+
+	for ind, peer := range nodes.Peers {
+		expected := peers[ind]
+		if !peer.Id().Equal(expected.Id()) || !peer.IP().Equal(*expected.IP()) || peer.UDPPort() != 4672 ||
+			peer.TCPPort() != 4662 || peer.ProtocolVersion() != 8 {
+			t.Errorf("Peer %d mismatch", ind)
+		}
+		if peer.IsIpVerified() != expected.IsIpVerified() {
+			t.Errorf("Peer %d verified flag mismatch", ind)
+		}
+		if peer.UDPKey(net.IPv4(1, 2, 3, 4)) != expected.UDPKey(net.IPv4(1, 2, 3, 4)) || peer.UDPKey(net.IPv4(4, 3, 2, 1)) != 0 {
+			t.Errorf("Peer %d UDP key mismatch", ind)
+		}
+	}
+}
+
+func TestReadNodesFile_EMule(t *testing.T) {
+	// nodes.dat of version 2 with a contact, as eMule writes it
+	data, _ := hex.DecodeString("00000000" + "02000000" + "01000000" +
+		"33221100" + "77665544" + "bbaa9988" + "ffeeddcc" + // Id
+		"0100000a" + "4012" + "3612" + "08" + // 10.0.0.1, UDP 4672, TCP 4662, version 8
+		"78563412" + "01020304" + "01") // Key 0x12345678 for 1.2.3.4, verified
+
+	nodes, err := ReadNodesFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Read error: %s", err)
+	} else if len(nodes.Peers) != 1 {
+		t.Fatalf("The contact must be read, %d found", len(nodes.Peers))
+	}
+
+	peer := nodes.Peers[0]
+	if !peer.Id().Equal(types.NewUInt128(0x8899aabbccddeeff, 0x0011223344556677)) {
+		t.Errorf("Id mismatch, 0x%s found", peer.Id().ToHexString())
+	}
+	if !peer.IP().Equal(net.IPv4(10, 0, 0, 1)) || peer.UDPPort() != 4672 || peer.TCPPort() != 4662 || !peer.IsIpVerified() {
+		t.Errorf("Contact mismatch")
+	}
+	if peer.UDPKey(net.IPv4(1, 2, 3, 4)) != 0x12345678 {
+		t.Errorf("The UDP key must be bound to 1.2.3.4, %s found", peer.UDPKeyIP())
+	}
+
+	// Written back, the file is the same
+	buf := new(bytes.Buffer)
+	if err := WriteNodesFile(buf, nodes.Peers); err != nil {
+		t.Fatalf("Write error: %s", err)
+	} else if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("The written file must match the eMule one, %x found", buf.Bytes())
+	}
+}
+
+func TestReadNodesFile_Versions(t *testing.T) {
+	version0 := new(bytes.Buffer)
+	binary.Write(version0, binary.LittleEndian, uint32(2))
+	writeTestNodesContact(version0, 1, uint32(0x0a000001), uint16(4672), uint16(4662), uint8(types2.NewPeerType))
+	writeTestNodesContact(version0, 2, uint32(0x0a000002), uint16(4672), uint16(4662), uint8(types2.ExpiredPeerType))
+
+	version1 := new(bytes.Buffer)
+	binary.Write(version1, binary.LittleEndian, []uint32{0, 1, 1})
+	writeTestNodesContact(version1, 1, uint32(0x0a000001), uint16(4672), uint16(4662), uint8(6))
+
+	bootstrap := new(bytes.Buffer)
+	binary.Write(bootstrap, binary.LittleEndian, []uint32{0, 3, bootstrapEdition, 2})
+	writeTestNodesContact(bootstrap, 1, uint32(0x0a000001), uint16(4672), uint16(4662), uint8(8))
+	writeTestNodesContact(bootstrap, 2, uint32(0x0a000002), uint16(4672), uint16(4662), uint8(8))
+
+	tests := []struct {
+		name          string
+		data          []byte
+		peers         int
+		bootstrapOnly bool
+	}{
+		{"version 0", version0.Bytes(), 1, false},
+		{"version 1", version1.Bytes(), 1, false},
+		{"version 3 bootstrap", bootstrap.Bytes(), 2, true},
+	}
+
+	for _, test := range tests {
+		nodes, err := ReadNodesFile(bytes.NewReader(test.data))
+		if err != nil {
+			t.Errorf("Read %s error: %s", test.name, err)
+		} else if len(nodes.Peers) != test.peers || nodes.BootstrapOnly != test.bootstrapOnly {
+			t.Errorf("Read %s mismatch: %d peers, bootstrap %t", test.name, len(nodes.Peers), nodes.BootstrapOnly)
+		} else if !nodes.Peers[0].IP().Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Errorf("Read %s IP mismatch: %s", test.name, nodes.Peers[0].IP())
+		}
+	}
+
+	if _, err := ReadNodesFile(bytes.NewReader([]byte{0, 0, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0})); err == nil {
+		t.Errorf("Must fail with unknown versions")
+	}
+	if _, err := ReadNodesFile(bytes.NewReader(version1.Bytes()[:20])); err == nil {
+		t.Errorf("Must fail with truncated files")
+	}
+}
+
+func TestReadNodesFile_TooManyContacts(t *testing.T) {
+	// The file announces more contacts than the max, only the first ones are read
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, []uint32{0, 1, maxNodesFileContacts + 1000})
+	for i := 1; i <= maxNodesFileContacts; i++ {
+		writeTestNodesContact(buf, i, uint32(0x0a000000+i), uint16(4672), uint16(4662), uint8(8))
+	}
+
+	nodes, err := ReadNodesFile(buf)
+	if err != nil {
+		t.Fatalf("Read error: %s", err)
+	} else if len(nodes.Peers) != maxNodesFileContacts {
+		t.Errorf("The first %d contacts must be read, %d found", maxNodesFileContacts, len(nodes.Peers))
+	}
+}
+
+func TestRouter_SaveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kadnodes")
+	if err != nil {
+		t.Fatalf("Temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "nodes.dat")
+
+	localId := types.NewUInt128FromInt(0xff00ff)
+	router := NewRouter(localId)
+	defer router.Dispose()
+	for i := 1; i <= 6; i++ {
+		router.AddPeer(newTestNodesPeer(i))
+	}
+
+	// The peer 6 is verified but expired
+	expired, _ := router.GetPeer(newTestNodesPeer(6).Id())
+	expired.SetExpiration(time.Now().Add(-time.Minute))
+
+	if err := router.SaveFile(path); err != nil {
+		t.Fatalf("Save error: %s", err)
+	}
+
+	loaded, err := LoadRouterFromFile(*localId, path)
+	if err != nil {
+		t.Fatalf("Load error: %s", err)
+	}
+	defer loaded.Dispose()
+
+	// Only the live peers with a verified IP are saved
+	if loaded.CountPeers() != 2 || len(loaded.BootstrapContacts()) != 0 {
+		t.Errorf("The 2 live peers must be loaded as contacts, %d found", loaded.CountPeers())
+	}
+	for i := 1; i <= 6; i++ {
+		if saved := i == 2 || i == 4; loaded.ContainsPeer(newTestNodesPeer(i).Id()) != saved {
+			t.Errorf("The peer %d saved state mismatch, want: %t", i, saved)
+		}
+	}
+
+	if _, err := LoadRouterFromFile(*localId, filepath.Join(dir, "missing.dat")); err == nil {
+		t.Errorf("Must fail with missing files")
+	}
+}
@@ -1,52 +1,305 @@
 package router
 
 import (
+	"context"
 	"errors"
 	"math/rand"
+	"net"
 	types2 "sleepy/network/kad/types"
 	"sleepy/types"
+	"sleepy/utils/clock"
 	"sleepy/utils/event"
+	"sync"
 	"time"
 )
 
-// The router is the special zone in the root of a zone tree
+const (
+	updatePeersPeriod  = time.Minute      // Period of the check of the peers of each leaf (small timer)
+	randomLookupPeriod = time.Hour        // Period of the random lookup of each leaf (big timer)
+	randomLookupDelay  = 10 * time.Second // Min time between the random lookups of different leafs
+)
+
+// The router is the special zone in the root of a zone tree. Its methods are safe for
+// concurrent use, the ones of the inner zones are not
 type Router struct {
 	Zone
+	treeAccess             sync.RWMutex // Guards the zone tree, split on the peer insertions
+	disposed               bool
 	randomGenerator        *rand.Rand
 	peerUpdateRequestEvent *event.Emitter
 	peerLookupRequestEvent *event.Emitter
-}
-
-// Load a router zone tree from file
-func LoadRouterFromFile(localId types.UInt128, path string) (*Router, error) {
-	return nil, errors.New("not implemented yet")
+	bootstrapContacts      []*types2.Peer
+	tracker                *peerTracker
+	clock                  clock.Clock
+	ctx                    context.Context
+	cancel                 context.CancelFunc
+	done                   chan struct{}
 }
 
 // Create a new Zone tree (Router) from the local peer Id
 func NewRouter(id *types.UInt128) *Router {
+	return NewRouterWithClock(id, clock.System)
+}
+
+// Create a new Zone tree (Router) from the local peer Id, that runs the maintenance of the
+// zones following the [clock]
+func NewRouterWithClock(id *types.UInt128, clock clock.Clock) *Router {
+	tracker := newPeerTracker()
 	rz := &Router{
 		Zone: Zone{
-			localId:           *id.Clone(),
-			zoneIndex:         *types.NewUInt128FromInt(0),
-			parent:            nil,
-			leftChild:         nil,
-			rightChild:        nil,
-			level:             0,
-			bucket:            new(kBucket),
-			randomLookupTimer: nil,
+			localId:    *id.Clone(),
+			zoneIndex:  *types.NewUInt128FromInt(0),
+			parent:     nil,
+			leftChild:  nil,
+			rightChild: nil,
+			level:      0,
+			bucket:     newKBucket(tracker),
 		},
 		randomGenerator:        rand.New(rand.NewSource(time.Now().UnixNano())),
 		peerUpdateRequestEvent: event.NewEvent(),
 		peerLookupRequestEvent: event.NewEvent(),
+		tracker:                tracker,
+		clock:                  clock,
 	}
 
 	rz.Zone.root = rz
+	rz.ctx, rz.cancel = context.WithCancel(context.Background())
+	rz.done = make(chan struct{})
 
-	rz.startChecks()
+	// The tickers start with the router, not when the goroutine runs
+	go rz.runMaintenance(clock.NewTicker(updatePeersPeriod), clock.NewTicker(randomLookupDelay))
 
 	return rz
 }
 
+// Run the maintenance of all the zones until the router is closed
+func (router *Router) runMaintenance(updateTicker *clock.Ticker, lookupTicker *clock.Ticker) {
+	defer close(router.done)
+	defer updateTicker.Stop()
+	defer lookupTicker.Stop()
+
+	for {
+		select {
+		case <-updateTicker.C:
+			router.updatePeers()
+		case <-lookupTicker.C:
+			router.randomLookup(router.clock.Now())
+		case <-router.ctx.Done():
+			return
+		}
+	}
+}
+
+// Check the peers of all the leafs
+func (router *Router) updatePeers() {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return
+	}
+	for _, leaf := range router.leafs() {
+		leaf.onUpdatePeersTimer()
+	}
+}
+
+// Run the random lookup of the first leaf that needs it, only one each time to spread the
+// traffic
+func (router *Router) randomLookup(now time.Time) {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return
+	}
+	for _, leaf := range router.leafs() {
+		if leaf.nextRandomLookup.Before(now) {
+			leaf.nextRandomLookup = now.Add(randomLookupPeriod)
+			if leaf.onRandomLookupTimer() {
+				return
+			}
+		}
+	}
+}
+
+// Stop the maintenance of the zones. The peers are kept
+func (router *Router) Close() {
+	router.cancel()
+	<-router.done
+}
+
+// Stop the maintenance and dispose all the zones. The router is empty after it
+func (router *Router) Dispose() {
+	router.Close()
+
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if !router.disposed {
+		router.Zone.Dispose()
+		router.disposed = true
+	}
+}
+
+// Add peer to the route table
+func (router *Router) AddPeer(peer *types2.Peer) error {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return errors.New("the router is disposed")
+	}
+	return router.Zone.AddPeer(peer)
+}
+
+// Add peer to the route table only if it's unknown. The contacts that other peers give us
+// can't change the known ones
+func (router *Router) AddNewPeer(peer *types2.Peer) error {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return errors.New("the router is disposed")
+	}
+	return router.Zone.AddNewPeer(peer)
+}
+
+// Set the peer with the [addr] as alive, moving it to the end of its bucket as the most
+// recently seen. Return false if there is no peer with the address
+func (router *Router) SetAlive(addr *net.UDPAddr) bool {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	return !router.disposed && router.Zone.SetAlive(addr)
+}
+
+// Get a peer from his id
+func (router *Router) GetPeer(id *types.UInt128) (*types2.Peer, error) {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	if router.disposed {
+		return nil, errors.New("the router is disposed")
+	}
+	return router.Zone.GetPeer(id)
+}
+
+// Get a peer from his addr
+func (router *Router) GetPeerByAddr(addr net.Addr) (*types2.Peer, error) {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	if router.disposed {
+		return nil, errors.New("the router is disposed")
+	}
+	return router.Zone.GetPeerByAddr(addr)
+}
+
+// Get a random peer from a random branch
+func (router *Router) GetRandomPeer() (*types2.Peer, error) {
+	// The random generator isn't safe for concurrent use
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return nil, errors.New("the router is disposed")
+	}
+	return router.Zone.GetRandomPeer()
+}
+
+// Get a slice of all peers
+func (router *Router) Peers() []*types2.Peer {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	if router.disposed {
+		return nil
+	}
+	return router.Zone.Peers()
+}
+
+// Get a slice with the [maxPeers] top peers.
+func (router *Router) GetTopPeers(maxPeers int, maxDepth int) []*types2.Peer {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return nil
+	}
+	return router.Zone.GetTopPeers(maxPeers, maxDepth)
+}
+
+// Obtain peers from a random bucket located at least at the [depth] indicated on the Zone tree
+func (router *Router) GetDepthPeers(depth int) []*types2.Peer {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return nil
+	}
+	return router.Zone.GetDepthPeers(depth)
+}
+
+// Get the peers from a random child bucket
+func (router *Router) GetRandomBucketPeers() []*types2.Peer {
+	router.treeAccess.Lock()
+	defer router.treeAccess.Unlock()
+
+	if router.disposed {
+		return nil
+	}
+	return router.Zone.GetRandomBucketPeers()
+}
+
+// Get the closest [max] peers respect the [to] id.
+func (router *Router) GetClosestPeers(to *types.UInt128, max int) []*types2.Peer {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	if router.disposed {
+		return nil
+	}
+	return router.Zone.GetClosestPeers(to, max)
+}
+
+// Count the number of peers inside the router
+func (router *Router) CountPeers() int {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	if router.disposed {
+		return 0
+	}
+	return router.Zone.CountPeers()
+}
+
+// Check if exists a peer with a concrete id into the router
+func (router *Router) ContainsPeer(id *types.UInt128) bool {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	return !router.disposed && router.Zone.ContainsPeer(id)
+}
+
+// Set a peer as verified
+func (router *Router) VerifyPeer(id *types.UInt128, ip net.IP) bool {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	return !router.disposed && router.Zone.VerifyPeer(id, ip)
+}
+
+// Get the router max depth from the most length branch
+func (router *Router) MaxDepth() int {
+	router.treeAccess.RLock()
+	defer router.treeAccess.RUnlock()
+
+	if router.disposed {
+		return 0
+	}
+	return router.Zone.MaxDepth()
+}
+
 // Event fired when the router need update a peer information
 func (router *Router) PeerUpdateRequestEvent() *event.Handler {
 	return router.peerUpdateRequestEvent.GetHandler()
@@ -57,10 +310,6 @@ func (router *Router) PeerLookupRequestEvent() *event.Handler {
 	return router.peerLookupRequestEvent.GetHandler()
 }
 
-func (router *Router) SaveFile(path string) error {
-	return errors.New("not implemented yet")
-}
-
 // Get a list of peers of [max] size prepared to do a bootstrap
 func (router *Router) GetBootstrapPeers(max int) []*types2.Peer {
 	const BootstrapDepth = 5 // Defined as LOG_BASE_EXPONENT constant in protocol/defines.h
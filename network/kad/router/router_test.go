@@ -1,7 +1,15 @@
 package router
 
 import (
+	"math/rand"
+	"net"
+	types2 "sleepy/network/kad/types"
+	"sleepy/types"
+	"sleepy/utils/clock"
+	"sleepy/utils/event"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestRouter_getRoot(t *testing.T) {
@@ -15,3 +23,169 @@ func TestRouter_getRoot(t *testing.T) {
 		t.Errorf("The test zone parent must be the test router: %p %p", testZone.Root(), testRouter)
 	}
 }
+
+func TestRouter_Close(t *testing.T) {
+	router := NewRouter(types.NewUInt128FromInt(1))
+	router.Close()
+
+	select {
+	case <-router.done:
+	default:
+		t.Errorf("The maintenance must be stopped after close")
+	}
+
+	// Closing twice or disposing after close must be safe
+	router.Close()
+	router.Dispose()
+}
+
+func TestRouter_RandomLookup(t *testing.T) {
+	// The manual clock keeps the scheduler stopped while the test changes the leafs
+	testClock := clock.NewManual(time.Now())
+	router := NewRouterWithClock(types.NewUInt128(0, 0xf000000000000000), testClock)
+	defer router.Dispose()
+
+	lookups := make(chan types.UInt128, 4)
+	router.PeerLookupRequestEvent().Listen(func(sender interface{}, args event.Args) {
+		lookups <- args.(PeerIdEventArgs).Id
+	})
+
+	// Split the router to have branches
+	randGen := rand.New(rand.NewSource(0))
+	for i := 0; i < maxBucketSize*2; i++ {
+		peer := types2.NewPeer(types.NewUInt128(randGen.Uint64(), randGen.Uint64()))
+		peer.SetIP(net.IPv4(80, byte(i), 0, 1), true)
+		router.AddPeer(peer)
+	}
+	if router.isLeaf() {
+		t.Fatalf("The router must be split")
+	}
+	if router.onRandomLookupTimer() {
+		t.Errorf("The branches can't run random lookups")
+	}
+
+	now := time.Now()
+	router.randomLookup(now)
+	router.randomLookup(now)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-lookups:
+			leaf := getTestLeaf(&router.Zone, &id)
+			if leaf.nextRandomLookup.Before(now) {
+				t.Errorf("The lookup id must be inside the leaf that runs it")
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Each call must run the lookup of a leaf")
+		}
+	}
+
+	for _, leaf := range router.leafs() {
+		leaf.nextRandomLookup = now.Add(time.Minute)
+	}
+	router.randomLookup(now)
+	select {
+	case <-lookups:
+		t.Errorf("The leafs can't run a lookup before its period")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestZone_randomId(t *testing.T) {
+	router := NewRouter(types.NewUInt128(0x1234, 0xabcdef))
+	defer router.Dispose()
+
+	for _, isRight := range []bool{false, true} {
+		zone := newChildZone(&router.Zone, isRight)
+		zone = newChildZone(zone, true)
+		for i := 0; i < 10; i++ {
+			distance := types.Xor(zone.randomId(), &zone.localId)
+			distance.RightShift(uint(128 - zone.level))
+			if !distance.Equal(&zone.zoneIndex) {
+				t.Errorf("The random id must be inside the zone %s", zone.zoneIndex.ToHexString())
+			}
+		}
+	}
+}
+
+func TestRouter_MaintenanceClock(t *testing.T) {
+	testClock := clock.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	router := NewRouterWithClock(types.NewUInt128FromInt(0), testClock)
+	defer router.Dispose()
+
+	peer := types2.NewPeerWithClock(types.NewUInt128FromInt(1), testClock)
+	peer.SetIP(net.IPv4(80, 0, 0, 1), true)
+	router.AddPeer(peer)
+
+	// The first check sets an expiration to the peer that was never seen
+	testClock.Advance(updatePeersPeriod)
+	for start := time.Now(); peer.Expiration().IsZero(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("The peers must be checked after the update period of the clock")
+		}
+	}
+
+	// The next check removes it
+	testClock.Advance(updatePeersPeriod)
+	for start := time.Now(); router.ContainsPeer(peer.Id()); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("The expired peers must be removed on the next update period")
+		}
+	}
+}
+
+func TestRouter_Concurrent(t *testing.T) {
+	router := NewRouter(types.NewUInt128FromInt(0))
+	defer router.Dispose()
+
+	// The insertions split the zones while other goroutines walk the tree
+	added := make(chan bool, 400)
+	var wait sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			for i := 0; i < 100; i++ {
+				peer := types2.NewPeer(types.NewUInt128(rand.Uint64(), rand.Uint64()))
+				peer.SetIP(net.IPv4(80, byte(worker), byte(i), 1), true)
+				peer.SetUDPPort(4672)
+				added <- router.AddPeer(peer) == nil
+
+				router.SetAlive(&net.UDPAddr{IP: net.IPv4(80, byte(worker), byte(i), 1), Port: 4672})
+				router.GetClosestPeers(peer.Id(), 10)
+				router.GetBootstrapPeers(20)
+			}
+		}(worker)
+	}
+	wait.Wait()
+	close(added)
+
+	count := 0
+	for ok := range added {
+		if ok {
+			count++
+		}
+	}
+	if router.CountPeers() != count {
+		t.Errorf("The router must contain the %d peers added, %d found", count, router.CountPeers())
+	}
+}
+
+func TestRouter_Disposed(t *testing.T) {
+	router := NewRouter(types.NewUInt128FromInt(0))
+	peer := types2.NewPeer(types.NewUInt128FromInt(1))
+	peer.SetIP(net.IPv4(80, 0, 0, 1), true)
+	peer.SetUDPPort(4672)
+	router.AddPeer(peer)
+	router.Dispose()
+
+	if router.SetAlive(&net.UDPAddr{IP: net.IPv4(80, 0, 0, 1), Port: 4672}) {
+		t.Errorf("A disposed router can't contain peers")
+	}
+	if err := router.AddPeer(peer); err == nil {
+		t.Errorf("A disposed router can't accept peers")
+	}
+	if router.CountPeers() != 0 || len(router.GetClosestPeers(peer.Id(), 10)) != 0 {
+		t.Errorf("A disposed router must be empty")
+	}
+}
@@ -0,0 +1,135 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	maxPeers          = 5000 // Max number of peers in the whole routing table
+	maxPeersPerIP     = 3    // Number of peers permitted from same public IP
+	maxPeersPerSubnet = 10   // Number of peers permitted from same public /24 subnet
+)
+
+// Tracking of the peers stored in all the buckets of a router, to limit the number of
+// contacts that a single host or network can place in the routing table
+type peerTracker struct {
+	total   int
+	ips     map[string]int
+	subnets map[string]int
+	access  sync.Mutex
+}
+
+func newPeerTracker() *peerTracker {
+	return &peerTracker{
+		total:   0,
+		ips:     make(map[string]int),
+		subnets: make(map[string]int),
+		access:  sync.Mutex{},
+	}
+}
+
+// Get the key of the /24 subnet of an IPv4 address, or false if it hasn't a public IPv4
+func subnetKey(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || isLANIP(ip4) {
+		return "", false
+	}
+	return string(ip4.Mask(net.CIDRMask(24, 32))), true
+}
+
+// Check if the IP belongs to a local network, where many peers can share the subnet
+func isLANIP(ip net.IP) bool {
+	ip4 := ip.To4()
+	return ip.IsLoopback() || ip4 != nil && (ip4[0] == 10 ||
+		(ip4[0] == 172 && ip4[1]&0xf0 == 16) ||
+		(ip4[0] == 192 && ip4[1] == 168))
+}
+
+// Count the peers of the router
+func (tracker *peerTracker) Count() int {
+	if tracker == nil {
+		return 0
+	}
+
+	tracker.access.Lock()
+	defer tracker.access.Unlock()
+	return tracker.total
+}
+
+// Check the limits for a new peer with the [ip]. The lock must be held
+func (tracker *peerTracker) check(ip net.IP) error {
+	if tracker.total >= maxPeers {
+		return errors.New("the router contact limit is reached")
+	}
+	if tracker.ips[string(ip.To16())] >= maxPeersPerIP {
+		return errors.New("many peers for the current IP")
+	}
+	if subnet, ok := subnetKey(ip); ok && tracker.subnets[subnet] >= maxPeersPerSubnet {
+		return errors.New("many peers for the current subnet")
+	}
+	return nil
+}
+
+// Update the counters of the [ip] by [delta]. The lock must be held
+func (tracker *peerTracker) track(ip net.IP, delta int) {
+	tracker.total += delta
+	if key := string(ip.To16()); tracker.ips[key]+delta > 0 {
+		tracker.ips[key] += delta
+	} else {
+		delete(tracker.ips, key)
+	}
+	if subnet, ok := subnetKey(ip); ok {
+		if tracker.subnets[subnet]+delta > 0 {
+			tracker.subnets[subnet] += delta
+		} else {
+			delete(tracker.subnets, subnet)
+		}
+	}
+}
+
+// Track a new peer with the [ip] if the limits allow it
+func (tracker *peerTracker) add(ip net.IP) error {
+	if tracker == nil {
+		return nil
+	}
+
+	tracker.access.Lock()
+	defer tracker.access.Unlock()
+
+	if err := tracker.check(ip); err != nil {
+		return err
+	}
+	tracker.track(ip, 1)
+	return nil
+}
+
+// Stop tracking a peer with the [ip]
+func (tracker *peerTracker) remove(ip net.IP) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.access.Lock()
+	tracker.track(ip, -1)
+	tracker.access.Unlock()
+}
+
+// Move a tracked peer from the [oldIP] to the [newIP] if the limits allow it
+func (tracker *peerTracker) change(oldIP net.IP, newIP net.IP) error {
+	if tracker == nil || oldIP.Equal(newIP) {
+		return nil
+	}
+
+	tracker.access.Lock()
+	defer tracker.access.Unlock()
+
+	tracker.track(oldIP, -1)
+	if err := tracker.check(newIP); err != nil {
+		tracker.track(oldIP, 1)
+		return err
+	}
+	tracker.track(newIP, 1)
+	return nil
+}
@@ -0,0 +1,115 @@
+package router
+
+import (
+	"net"
+	types2 "sleepy/network/kad/types"
+	"sleepy/types"
+	"testing"
+)
+
+func TestPeerTracker_IPLimit(t *testing.T) {
+	tracker := newPeerTracker()
+	ip := net.IPv4(80, 1, 2, 3)
+
+	for i := 0; i < maxPeersPerIP; i++ {
+		if err := tracker.add(ip); err != nil {
+			t.Fatalf("Unexpected error when add peer: %s", err.Error())
+		}
+	}
+	if tracker.add(ip) == nil {
+		t.Errorf("Only %d peers with the same IP are allowed", maxPeersPerIP)
+	}
+
+	tracker.remove(ip)
+	if err := tracker.add(ip); err != nil {
+		t.Errorf("The removed peers must free their IP: %s", err.Error())
+	}
+	if tracker.Count() != maxPeersPerIP {
+		t.Errorf("The tracker must count %d peers, %d found", maxPeersPerIP, tracker.Count())
+	}
+}
+
+func TestPeerTracker_SubnetLimit(t *testing.T) {
+	tracker := newPeerTracker()
+
+	for i := 0; i < maxPeersPerSubnet; i++ {
+		if err := tracker.add(net.IPv4(80, 1, 2, byte(i))); err != nil {
+			t.Fatalf("Unexpected error when add peer: %s", err.Error())
+		}
+	}
+	if tracker.add(net.IPv4(80, 1, 2, 200)) == nil {
+		t.Errorf("Only %d peers with the same subnet are allowed", maxPeersPerSubnet)
+	}
+	if err := tracker.add(net.IPv4(80, 1, 3, 200)); err != nil {
+		t.Errorf("Other subnets must be allowed: %s", err.Error())
+	}
+
+	// The local networks don't have subnet limits
+	for i := 0; i <= maxPeersPerSubnet; i++ {
+		if err := tracker.add(net.IPv4(192, 168, 0, byte(i))); err != nil {
+			t.Errorf("Unexpected error when add a LAN peer: %s", err.Error())
+		}
+	}
+}
+
+func TestPeerTracker_Change(t *testing.T) {
+	tracker := newPeerTracker()
+	full := net.IPv4(80, 1, 2, 3)
+	for i := 0; i < maxPeersPerIP; i++ {
+		tracker.add(full)
+	}
+
+	other := net.IPv4(80, 4, 5, 6)
+	tracker.add(other)
+	if tracker.change(other, full) == nil {
+		t.Errorf("A peer can't move to an IP without free places")
+	}
+	if err := tracker.change(full, other); err != nil {
+		t.Errorf("Unexpected error when change the IP: %s", err.Error())
+	}
+	if tracker.Count() != maxPeersPerIP+1 {
+		t.Errorf("The changes can't modify the count, %d found", tracker.Count())
+	}
+	if err := tracker.add(full); err != nil {
+		t.Errorf("The old IP must be freed: %s", err.Error())
+	}
+}
+
+func TestRouter_PeerLimits(t *testing.T) {
+	router := NewRouter(types.NewUInt128FromInt(0))
+	defer router.Dispose()
+
+	// The peers with the same IP are spread in different buckets
+	for i := 0; i <= maxPeersPerIP; i++ {
+		peer := types2.NewPeer(types.NewUInt128(0, uint64(i)<<62|1))
+		peer.SetIP(net.IPv4(80, 1, 2, 3), true)
+		err := router.AddPeer(peer)
+		if i < maxPeersPerIP && err != nil {
+			t.Errorf("Unexpected error when add peer: %s", err.Error())
+		} else if i == maxPeersPerIP && err == nil {
+			t.Errorf("Only %d peers with the same IP are allowed in the router", maxPeersPerIP)
+		}
+	}
+
+	// Force some splits
+	for i := 0; i < maxBucketSize*4; i++ {
+		peer := types2.NewPeer(types.NewUInt128(uint64(i), uint64(i)<<58))
+		peer.SetIP(net.IPv4(81, byte(i), 0, 1), true)
+		router.AddPeer(peer)
+	}
+	if router.isLeaf() {
+		t.Fatalf("The router must be split")
+	}
+	if router.tracker.Count() != router.CountPeers() {
+		t.Errorf("The router must track %d peers, %d found", router.CountPeers(), router.tracker.Count())
+	}
+
+	// An updated peer can't move to a full IP
+	peer := types2.NewPeer(types.NewUInt128(1, 1<<58))
+	peer.SetIP(net.IPv4(80, 1, 2, 3), true)
+	if !router.ContainsPeer(peer.Id()) {
+		t.Fatalf("The router must contain the peer 0x%s", peer.Id().ToHexString())
+	} else if router.AddPeer(peer) == nil {
+		t.Errorf("A peer can't change to an IP without free places")
+	}
+}
@@ -2,7 +2,6 @@ package router
 
 import (
 	"errors"
-	"fmt"
 	"math/rand"
 	"net"
 	"sleepy/network/ed2k"
@@ -14,7 +13,8 @@ import (
 )
 
 const (
-	maxLevels = 6
+	maxLevels          = 6
+	randomLookupLevels = 4 // Levels closer to the local id that are always refreshed (KBASE)
 )
 
 type PeerEventArgs struct {
@@ -37,14 +37,12 @@ type Zone struct {
 	rightChild        *Zone
 	level             uint8
 	bucket            *kBucket
-	updatePeersTimer  *time.Ticker
-	randomLookupTimer *time.Ticker
-	checkStopFlag     bool
+	nextRandomLookup  time.Time
 	zoneAccess sync.Mutex
 }
 
 // Create a child zone from a parent instance
-func newChildZone(parent Zone, isRightChild bool) *Zone {
+func newChildZone(parent *Zone, isRightChild bool) *Zone {
 	zoneIndexCalculated := parent.zoneIndex.Clone()
 	zoneIndexCalculated.LeftShift(1)
 	if isRightChild {
@@ -54,30 +52,25 @@ func newChildZone(parent Zone, isRightChild bool) *Zone {
 	rz := &Zone{
 		localId:    parent.localId,
 		zoneIndex:  *zoneIndexCalculated,
-		parent:     &parent,
+		parent:     parent,
 		root:       parent.Root(),
 		leftChild:  nil,
 		rightChild: nil,
 		level:      parent.level + 1,
-		bucket:     newKBucket(),
-		updatePeersTimer:  nil,
-		randomLookupTimer: nil,
+		bucket:     newKBucket(parent.Root().tracker),
 	}
 
-	rz.startChecks()
-
 	return rz
 }
 
 // Create the two child zones from the parent instance
-func newChildZones(parent Zone) (*Zone, *Zone) {
+func newChildZones(parent *Zone) (*Zone, *Zone) {
 	return newChildZone(parent, false), newChildZone(parent, true)
 }
 
 // Dispose resources
 func (zone *Zone) Dispose() {
 	if zone.isLeaf() {
-		zone.stopChecks()
 		zone.bucket = nil
 	} else {
 		zone.leftChild.Dispose()
@@ -97,18 +90,6 @@ func (zone *Zone) Parent() *Zone {
 	return zone.parent
 }
 
-// Start all check subroutines
-func (zone *Zone) startChecks() {
-	zone.checkStopFlag = false
-	go zone.runUpdatePeersTimer()
-	go zone.runRandomLookupTimer()
-}
-
-// Stop all check subroutines
-func (zone *Zone) stopChecks() {
-	zone.checkStopFlag = true
-}
-
 // Check if the object is a leaf (is not, is a branch)
 func (zone *Zone) isLeaf() bool {
 	return zone.bucket != nil
@@ -132,70 +113,76 @@ func (zone *Zone) maxDepth() int {
 	}
 }
 
-// Run a timer to do random lookup of peers
-func (zone *Zone) runRandomLookupTimer() {
-	zone.randomLookupTimer = time.NewTicker(10 * time.Second)
-	for range zone.randomLookupTimer.C {
-		if zone.checkStopFlag {
-			// TODO: Find other immediate way to stop
-			break
-		} else {
-			zone.onRandomLookupTimer()
-		}
+// Get the leafs of this branch
+func (zone *Zone) leafs() []*Zone {
+	zone.zoneAccess.Lock()
+	defer zone.zoneAccess.Unlock()
+
+	if zone.isLeaf() {
+		return []*Zone{zone}
+	} else {
+		return append(zone.leftChild.leafs(), zone.rightChild.leafs()...)
 	}
 }
 
-// Handle the RandomLookup timer and run a lookup of a random peer inside each leaf (onBigTimer)
-func (zone *Zone) onRandomLookupTimer() {
-	zone.zoneAccess.Lock()
-	if zone.isLeaf() && zone.level < maxLevels || float32(zone.bucket.CountPeers()) >= (maxBucketSize*0.8) {
-		// Generate a random ID inside this zone
-		randId := zone.zoneIndex.Clone()
-		randId.LeftShift(uint(zone.level))
-		randId.Xor(&zone.localId)
-
-		// Emit event. The KAD client will insert the peer if it finds it
-		zone.Root().peerLookupRequestEvent.Emit(zone, PeerIdEventArgs{Id: *randId})
-	}
-	zone.zoneAccess.Unlock()
+// Generate a random id that would be stored in this zone
+func (zone *Zone) randomId() *types.UInt128 {
+	// The first bits of the distance are the zone index, the rest are random
+	prefix := zone.zoneIndex.Clone()
+	prefix.LeftShift(uint(128 - zone.level))
+
+	generator := zone.Root().randomGenerator
+	randId := types.NewUInt128(generator.Uint64(), generator.Uint64())
+	randId.RightShift(uint(zone.level))
+	randId.Or(prefix)
+
+	randId.Xor(&zone.localId)
+	return randId
 }
 
-// Run a timer to do periodic check of the peers
-func (zone *Zone) runUpdatePeersTimer() {
-	idLow, _ := zone.localId.ToUInt64()
-	zone.updatePeersTimer = time.NewTicker(time.Duration(idLow) * time.Second)
-	for range zone.updatePeersTimer.C {
-		if zone.checkStopFlag {
-			// TODO: Find other immediate way to stop
-			break
-		} else {
-			zone.onUpdatePeersTimer()
-		}
+// Handle the RandomLookup timer and run a lookup of a random peer inside the leaf if it's close to
+// the local id or almost empty (onBigTimer). Return false if the lookup isn't needed
+func (zone *Zone) onRandomLookupTimer() bool {
+	zone.zoneAccess.Lock()
+	defer zone.zoneAccess.Unlock()
+
+	if !zone.isLeaf() || !(zone.level < randomLookupLevels || float32(zone.bucket.CountRemainingPeers()) >= maxBucketSize*0.8) {
+		return false
 	}
+
+	// Emit event. The KAD client will insert the peer if it finds it
+	zone.Root().peerLookupRequestEvent.Emit(zone, PeerIdEventArgs{Id: *zone.randomId()})
+	return true
 }
 
 // Handle the UpdatePeers timer and run a check and update of the peers inside each leaf (onSmallTimer)
 func (zone *Zone) onUpdatePeersTimer() {
 	zone.zoneAccess.Lock()
 	if zone.isLeaf() {
+		now := zone.Root().clock.Now()
+
 		// Remove dead entries
 		for _, peer := range zone.bucket.Peers() {
 			// If peer is not alive
-			if !peer.IsAlive() {
+			if !peer.UpdateExpiration() {
 				if !peer.InUse() {
 					zone.bucket.RemovePeer(peer)
 				}
 			} else if peer.Expiration().Equal(time.Time{}) {
-				peer.SetExpiration(time.Now().Add(time.Microsecond))
+				peer.SetExpiration(now.Add(time.Microsecond))
 			}
 		}
 
+		// Replace the dead and the challenged peers that didn't answer with the candidates
+		zone.bucket.resolveChallenge(now)
+		zone.bucket.fillFromReplacements()
+
 		// Update the oldest peer
 		oldestPeer := zone.bucket.OldestPeer()
 
 		if oldestPeer != nil {
 			// FIXME: pContact->GetType() == 4 ???
-			if !oldestPeer.IsAlive() || oldestPeer.Expiration().After(time.Now()) {
+			if !oldestPeer.IsAlive() || oldestPeer.Expiration().After(now) {
 				zone.bucket.pushToEnd(oldestPeer)
 				oldestPeer = nil
 			}
@@ -206,7 +193,8 @@ func (zone *Zone) onUpdatePeersTimer() {
 			if oldestPeer.ProtocolVersion() >= ed2k.ProtocolVersion2 {
 				// FIXME: The version 2 or 6 send different data, see RoutingZone.cpp:937
 				router := zone.Root()
-				router.peerUpdateRequestEvent.EmitSync(zone, PeerEventArgs{Peer: oldestPeer})
+				// Asynchronous, the listeners can use the router, locked during the maintenance
+				router.peerUpdateRequestEvent.Emit(zone, PeerEventArgs{Peer: oldestPeer})
 			}
 		}
 	}
@@ -215,7 +203,10 @@ func (zone *Zone) onUpdatePeersTimer() {
 
 // Check if the current leaf can be splitted in a branch with 2 leafs
 func (zone *Zone) canSplit() bool {
-	// TODO: Check if the global contact limit is reached
+	// The new buckets would be useless if the router can't store more peers
+	if zone.Root().tracker.Count() >= maxPeers {
+		return false
+	}
 
 	// Max levels allowed reached
 	if zone.level >= 127 {
@@ -234,6 +225,7 @@ func (zone *Zone) canSplit() bool {
 func (zone *Zone) consolidate() {
 	zone.zoneAccess.Lock()
 	if zone.isLeaf() {
+		zone.zoneAccess.Unlock()
 		return
 	} else {
 		if zone.leftChild.isLeaf() {
@@ -244,25 +236,23 @@ func (zone *Zone) consolidate() {
 		}
 		if zone.leftChild.isLeaf() && zone.rightChild.isLeaf() && zone.CountPeers() < (maxBucketSize/2) {
 			// Initialize leaf variables
-			zone.bucket = new(kBucket)
+			zone.bucket = newKBucket(zone.Root().tracker)
 
-			// Stop left child, get contacts and dispose
-			zone.leftChild.stopChecks()
-			for _, currPeer := range zone.leftChild.bucket.peers {
+			// Move the contacts of the left child and dispose
+			for _, currPeer := range zone.leftChild.bucket.Peers() {
+				zone.leftChild.bucket.RemovePeer(currPeer)
 				zone.bucket.AddPeer(currPeer)
 			}
 			zone.leftChild.Dispose()
 			zone.leftChild = nil
 
-			// Stop right child, get contacts and dispose
-			zone.rightChild.stopChecks()
-			for _, currPeer := range zone.rightChild.bucket.peers {
+			// Move the contacts of the right child and dispose
+			for _, currPeer := range zone.rightChild.bucket.Peers() {
+				zone.rightChild.bucket.RemovePeer(currPeer)
 				zone.bucket.AddPeer(currPeer)
 			}
 			zone.rightChild = nil
 
-			// Restart checks
-			zone.startChecks()
 		}
 	}
 	zone.zoneAccess.Unlock()
@@ -271,15 +261,16 @@ func (zone *Zone) consolidate() {
 // Split a leaf into a branch with two leafs
 func (zone *Zone) split() error {
 	if zone.canSplit() {
-		zone.stopChecks()
-		zone.leftChild, zone.rightChild = newChildZones(*zone)
+		zone.leftChild, zone.rightChild = newChildZones(zone)
 
+		// Move the peers to the buckets of the children, keeping the router tracking
 		for _, currPeer := range zone.bucket.Peers() {
+			zone.bucket.RemovePeer(currPeer)
 			distance := currPeer.GetDistance(&zone.localId)
 			if distance.GetBit(zone.Level()) == 0 {
-				zone.leftChild.AddPeer(currPeer)
+				zone.leftChild.bucket.AddPeer(currPeer)
 			} else {
-				zone.rightChild.AddPeer(currPeer)
+				zone.rightChild.bucket.AddPeer(currPeer)
 			}
 		}
 
@@ -311,40 +302,58 @@ func (zone *Zone) MaxDepth() int {
 	}
 }
 
-// Add peer to the route table
+// Add peer to the route table, or update it if it's already known
 func (zone *Zone) AddPeer(peer *types2.Peer) error {
+	return zone.addPeer(peer, true)
+}
+
+// Add peer to the route table only if it's unknown. The contacts that other peers give us
+// can't change the known ones
+func (zone *Zone) AddNewPeer(peer *types2.Peer) error {
+	return zone.addPeer(peer, false)
+}
+
+// Add peer to the route table. A known peer is updated only if [update] is set
+func (zone *Zone) addPeer(peer *types2.Peer, update bool) error {
 	// TODO: Filter IPs and protocol versions
 
 	if !zone.isLeaf() {
 		// If the zone isn't leaf, insert in the indicated child zone
 		if peer.GetDistance(&zone.localId).GetBit(int(zone.level)) == 0 {
-			return zone.leftChild.AddPeer(peer)
+			return zone.leftChild.addPeer(peer, update)
 		} else {
-			return zone.rightChild.AddPeer(peer)
+			return zone.rightChild.addPeer(peer, update)
 		}
 	} else {
 		if !zone.localId.Equal(peer.Id()) {
+			zone.bucket.resolveChallenge(zone.Root().clock.Now())
 			locPeer, err := zone.bucket.GetPeer(peer.Id())
 
-			if err == nil && locPeer != nil {
-				// If the peer already exists, update
-				return locPeer.Update(peer)
+			if err == nil && locPeer != nil && !update {
+				return errors.New("the peer is already known")
+			} else if err == nil && locPeer != nil {
+				// If the peer already exists, update and move to the end as most recently seen
+				return zone.bucket.UpdatePeer(peer)
 			} else if !zone.bucket.IsFull() {
 				// If not exists, but leaf has free space, insert
 				return zone.bucket.AddPeer(peer)
 			} else if zone.canSplit() {
 				// If don't have free space but can be split and retry
 				zone.split()
-				return zone.AddPeer(peer)
+				return zone.addPeer(peer, update)
 			} else {
+				// Keep the peer as candidate and ask the oldest peer if it's still alive. It will
+				// be replaced if it doesn't answer in time
+				zone.bucket.AddReplacement(peer)
+				if oldestPeer := zone.bucket.startChallenge(zone.Root().clock.Now()); oldestPeer != nil {
+					zone.Root().peerUpdateRequestEvent.Emit(zone, PeerEventArgs{Peer: oldestPeer})
+				}
 				return errors.New("the peer can't be added. bucket full and can't be split")
 			}
 		} else {
 			return errors.New("the router can't contains itself")
 		}
 	}
-
-	return nil
 }
 
 // Get a peer from his id
@@ -376,13 +385,31 @@ func (zone *Zone) GetPeerByAddr(addr net.Addr) (*types2.Peer, error) {
 	}
 }
 
+// Set the peer with the [addr] as alive, moving it to the end of its bucket as the most
+// recently seen. Return false if there is no peer with the address
+func (zone *Zone) SetAlive(addr *net.UDPAddr) bool {
+	if zone.isLeaf() {
+		peer, err := zone.bucket.GetPeerByAddr(addr)
+		if err != nil {
+			return false
+		}
+
+		peer.UpdateType()
+		zone.bucket.endChallenge(peer)
+		zone.bucket.pushToEnd(peer)
+		return true
+	} else {
+		return zone.leftChild.SetAlive(addr) || zone.rightChild.SetAlive(addr)
+	}
+}
+
 // Get a random peer from a random branch
 func (zone *Zone) GetRandomPeer() (*types2.Peer, error) {
 	if zone.isLeaf() {
 		return zone.bucket.GetRandomPeer()
 	} else {
 		childs := [2]*Zone{zone.leftChild, zone.rightChild}
-		rPos := rand.Intn(1)
+		rPos := rand.Intn(2)
 
 		peer, err := childs[rPos].GetRandomPeer()
 		if err != nil {
@@ -396,7 +423,7 @@ func (zone *Zone) GetRandomPeer() (*types2.Peer, error) {
 // Get a slice of all peers
 func (zone *Zone) Peers() []*types2.Peer {
 	if zone.isLeaf() {
-		return zone.bucket.peers
+		return zone.bucket.Peers()
 	} else {
 		return append(zone.leftChild.Peers(), zone.rightChild.Peers()...)
 	}
@@ -412,7 +439,6 @@ func (zone *Zone) GetTopPeers(maxPeers int, maxDepth int) []*types2.Peer {
 	} else if maxDepth <= 0 {
 		peers = zone.GetRandomBucketPeers()
 	} else {
-		fmt.Println(zone.leftChild)
 		peers = zone.leftChild.GetTopPeers(maxPeers, maxDepth-1)
 
 		if len(peers) < maxPeers {
@@ -444,7 +470,7 @@ func (zone *Zone) GetRandomBucketPeers() []*types2.Peer {
 	if zone.isLeaf() {
 		return zone.bucket.Peers()
 	} else {
-		if zone.Root().randomGenerator.Intn(1) == 0 {
+		if zone.Root().randomGenerator.Intn(2) == 0 {
 			return zone.leftChild.GetRandomBucketPeers()
 		} else {
 			return zone.rightChild.GetRandomBucketPeers()
@@ -458,8 +484,9 @@ func (zone *Zone) GetClosestPeers(to *types.UInt128, max int) []*types2.Peer {
 		// If leaf, get from bucket
 		return zone.bucket.GetClosestPeers(to, max)
 	} else {
+		// Children are split by the distance to the local id, not by the id itself
 		children := [2]*Zone{zone.leftChild, zone.rightChild}
-		rPos := to.GetBit(int(zone.level))
+		rPos := types.Xor(&zone.localId, to).GetBit(int(zone.level))
 
 		// Get from the closest branch
 		peers := children[rPos].GetClosestPeers(to, max)
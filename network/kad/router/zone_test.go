@@ -5,7 +5,10 @@ import (
 	"net"
 	types2 "sleepy/network/kad/types"
 	"sleepy/types"
+	"sleepy/utils/clock"
+	"sleepy/utils/event"
 	"testing"
+	"time"
 )
 
 func TestZone_AddPeer(t *testing.T) {
@@ -90,3 +93,183 @@ func TestZone_CountPeers(t *testing.T) {
 		}
 	}
 }
+
+func TestZone_GetClosestPeers(t *testing.T) {
+	routerId := types.NewUInt128(0, 0xff00000000000000)
+	randGen := rand.New(rand.NewSource(0))
+	zone := NewRouter(routerId)
+	defer zone.Dispose()
+
+	var peers []*types2.Peer
+	for i := 0; i < maxBucketSize*3; i++ {
+		peer := types2.NewPeer(types.NewUInt128(randGen.Uint64(), randGen.Uint64()))
+		peer.SetIP(net.IPv4(byte(randGen.Intn(255)), byte(randGen.Intn(255)), byte(randGen.Intn(255)), byte(randGen.Intn(255))), true)
+		if zone.AddPeer(peer) == nil {
+			peers = append(peers, peer)
+		}
+	}
+
+	target := types.NewUInt128(randGen.Uint64(), randGen.Uint64())
+	closest := zone.GetClosestPeers(target, 5)
+	if len(closest) != 5 {
+		t.Fatalf("Must return 5 peers, %d found", len(closest))
+	}
+
+	for _, peer := range peers {
+		if peer.GetDistance(target).Compare(closest[len(closest)-1].GetDistance(target)) < 0 {
+			found := false
+			for _, closePeer := range closest {
+				found = found || closePeer.Equal(peer)
+			}
+			if !found {
+				t.Errorf("Peer 0x%s is closer than the returned ones", peer.Id().ToHexString())
+			}
+		}
+	}
+}
+
+// Get the leaf of the [zone] tree where the peer with the [id] is stored
+func getTestLeaf(zone *Zone, id *types.UInt128) *Zone {
+	for !zone.isLeaf() {
+		if types.Xor(&zone.localId, id).GetBit(zone.Level()) == 0 {
+			zone = zone.leftChild
+		} else {
+			zone = zone.rightChild
+		}
+	}
+	return zone
+}
+
+func TestZone_AddPeerFullBucket(t *testing.T) {
+	router := NewRouter(types.NewUInt128FromInt(0))
+	defer router.Dispose()
+
+	challenges := make(chan *types2.Peer, 1)
+	router.PeerUpdateRequestEvent().Listen(func(sender interface{}, args event.Args) {
+		challenges <- args.(PeerEventArgs).Peer
+	})
+
+	// All the peers share the prefix of the distance, so they go to a bucket that can't be split
+	for i := 0; i < maxBucketSize; i++ {
+		peer := types2.NewPeer(types.NewUInt128(uint64(i), 0xf800000000000000))
+		peer.SetIP(net.IPv4(10, 0, 0, byte(i)), true)
+		peer.SetUDPPort(4672)
+		peer.SetProtocolVersion(8)
+		if err := router.AddPeer(peer); err != nil {
+			t.Fatalf("Unexpected error when add peer: %s", err.Error())
+		}
+	}
+
+	candidate := types2.NewPeer(types.NewUInt128(100, 0xf800000000000000))
+	candidate.SetIP(net.IPv4(10, 0, 1, 1), true)
+	if router.AddPeer(candidate) == nil {
+		t.Fatalf("The peer can't be added to a full bucket")
+	}
+
+	leaf := getTestLeaf(&router.Zone, candidate.Id())
+	if leaf.Level() != maxLevels-1 {
+		t.Fatalf("The bucket must be at level %d, %d found", maxLevels-1, leaf.Level())
+	}
+	if replacements := leaf.bucket.Replacements(); len(replacements) != 1 || !replacements[0].Equal(candidate) {
+		t.Errorf("The peer must be kept as candidate")
+	}
+
+	var oldest *types2.Peer
+	select {
+	case oldest = <-challenges:
+	case <-time.After(time.Second):
+		t.Fatalf("The oldest peer must be challenged")
+	}
+	if !oldest.Id().Equal(types.NewUInt128(0, 0xf800000000000000)) {
+		t.Errorf("The challenged peer must be the oldest, 0x%s found", oldest.Id().ToHexString())
+	}
+
+	// The update timer moves the peer to the end, but it didn't answer yet
+	router.onUpdatePeersTimer()
+	if leaf.bucket.challenged == nil || !leaf.bucket.challenged.Equal(oldest) {
+		t.Fatalf("The update timer can't end the challenge")
+	}
+
+	// Other nodes still list the peer, but only a packet of the peer proves that it's alive
+	listed := types2.NewPeer(oldest.Id())
+	listed.SetIP(*oldest.IP(), false)
+	listed.SetUDPPort(oldest.UDPPort())
+	router.AddPeer(listed)
+	if leaf.bucket.challenged == nil || !leaf.bucket.challenged.Equal(oldest) {
+		t.Fatalf("An update of the peer can't end the challenge")
+	}
+
+	// The oldest peer doesn't answer in time
+	leaf.bucket.challengeExpires = time.Now()
+	other := types2.NewPeer(types.NewUInt128(101, 0xf800000000000000))
+	other.SetIP(net.IPv4(10, 0, 1, 2), true)
+	router.AddPeer(other)
+
+	if router.ContainsPeer(oldest.Id()) {
+		t.Errorf("The challenged peer must be removed")
+	}
+	if !router.ContainsPeer(candidate.Id()) {
+		t.Errorf("The candidate must replace the challenged peer")
+	}
+}
+
+func TestZone_UpdatePeersTimer(t *testing.T) {
+	testClock := clock.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	router := NewRouterWithClock(types.NewUInt128FromInt(0), testClock)
+	defer router.Dispose()
+
+	unseen := types2.NewPeerWithClock(types.NewUInt128FromInt(1), testClock)
+	unseen.SetIP(net.IPv4(80, 0, 0, 1), true)
+	seen := types2.NewPeerWithClock(types.NewUInt128FromInt(2), testClock)
+	seen.SetIP(net.IPv4(80, 0, 0, 2), true)
+	router.AddPeer(unseen)
+	router.AddPeer(seen)
+	seen.UpdateType()
+
+	// The peers that were never seen expire in the next check
+	router.onUpdatePeersTimer()
+	testClock.Advance(updatePeersPeriod)
+	router.onUpdatePeersTimer()
+	if router.ContainsPeer(unseen.Id()) {
+		t.Errorf("The peers never seen must be removed")
+	}
+
+	testClock.Advance(30 * time.Minute)
+	router.onUpdatePeersTimer()
+	if !router.ContainsPeer(seen.Id()) {
+		t.Fatalf("The peers seen must be kept until its expiration")
+	}
+
+	testClock.Advance(time.Hour)
+	router.onUpdatePeersTimer()
+	if router.ContainsPeer(seen.Id()) {
+		t.Errorf("The expired peers must be removed")
+	}
+}
+
+func TestZone_SetAliveEndsChallenge(t *testing.T) {
+	router := NewRouter(types.NewUInt128FromInt(0))
+	defer router.Dispose()
+
+	for i := 0; i < maxBucketSize; i++ {
+		peer := types2.NewPeer(types.NewUInt128(uint64(i), 0xf800000000000000))
+		peer.SetIP(net.IPv4(10, 0, 0, byte(i)), true)
+		peer.SetUDPPort(4672)
+		router.AddPeer(peer)
+	}
+	candidate := types2.NewPeer(types.NewUInt128(100, 0xf800000000000000))
+	candidate.SetIP(net.IPv4(10, 0, 1, 1), true)
+	router.AddPeer(candidate)
+
+	leaf := getTestLeaf(&router.Zone, candidate.Id())
+	oldest := leaf.bucket.challenged
+	if oldest == nil {
+		t.Fatalf("The oldest peer must be challenged")
+	}
+
+	// A packet from the address of the challenged peer proves that it's alive
+	router.SetAlive(&net.UDPAddr{IP: *oldest.IP(), Port: int(oldest.UDPPort())})
+	if leaf.bucket.challenged != nil {
+		t.Errorf("A packet of the challenged peer must end the challenge")
+	}
+}
@@ -0,0 +1,357 @@
+package kad
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sleepy/types"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	maxSearchResponses   = 64               // Responses buffered for each in-flight search
+	searchLifetime       = 45 * time.Second // Max duration of a search
+	maxKeywordResults    = 300              // Max results returned by a keyword search
+	minKeywordLength     = 3                // Min length in bytes of the searchable keywords
+	keywordSeparators    = " ()[]{}<>,._-!?:;\\/\""
+	searchExprFollowFlag = 0x8000  // Set on the start position when a search expression follows
+	searchTolerance      = 1 << 24 // Max distance, in the high 32 bits, of the targets that we answer
+	maxEntriesPerPacket  = 50      // Max entries sent on each KADEMLIA2_SEARCH_RES
+)
+
+// An entry of a KADEMLIA2_SEARCH_RES: the answer id and its tags
+type searchEntry struct {
+	id   *types.UInt128
+	tags TagList
+}
+
+// Entries received on a KADEMLIA2_SEARCH_RES
+type searchResponse struct {
+	from    *net.UDPAddr
+	entries []searchEntry
+}
+
+// Search waiting for KADEMLIA2_SEARCH_RES, with the addresses of the peers that it asked
+type searchWaiter struct {
+	responses chan searchResponse
+	queried   map[string]bool
+}
+
+// In-flight searches waiting for KADEMLIA2_SEARCH_RES, by target. The responses don't
+// carry the request type, so they are routed to the searches that asked the sender. When
+// searches of several types ask the same peer, each one drops the entries of the others
+type searchRegistry struct {
+	searches map[types.UInt128][]*searchWaiter
+	access   sync.Mutex
+}
+
+// Register a search for [target] and get the waiter where the responses will be delivered
+func (registry *searchRegistry) register(target *types.UInt128) *searchWaiter {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	if registry.searches == nil {
+		registry.searches = make(map[types.UInt128][]*searchWaiter)
+	}
+
+	waiter := &searchWaiter{
+		responses: make(chan searchResponse, maxSearchResponses),
+		queried:   make(map[string]bool),
+	}
+	registry.searches[*target] = append(registry.searches[*target], waiter)
+	return waiter
+}
+
+// Remove the [waiter] of a search for [target]
+func (registry *searchRegistry) unregister(target *types.UInt128, waiter *searchWaiter) {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	waiters := registry.searches[*target]
+	for index := range waiters {
+		if waiters[index] == waiter {
+			waiters = append(waiters[:index:index], waiters[index+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(registry.searches, *target)
+	} else {
+		registry.searches[*target] = waiters
+	}
+}
+
+// Record that the search of [waiter] asked the peer on [addr], so its responses are expected
+func (registry *searchRegistry) query(waiter *searchWaiter, addr *net.UDPAddr) {
+	registry.access.Lock()
+	waiter.queried[addr.String()] = true
+	registry.access.Unlock()
+}
+
+// Deliver a response to the searches for [target] that asked its sender. Return false if
+// nobody is waiting for it
+func (registry *searchRegistry) deliver(target *types.UInt128, response searchResponse) bool {
+	registry.access.Lock()
+	defer registry.access.Unlock()
+
+	if response.from == nil {
+		return false
+	}
+
+	delivered := false
+	for _, waiter := range registry.searches[*target] {
+		// The results can be split on several packets, so the peer can answer again
+		if !waiter.queried[response.from.String()] {
+			continue
+		}
+
+		select {
+		case waiter.responses <- response:
+			delivered = true
+		default:
+		}
+	}
+	return delivered
+}
+
+// KeywordResult is a file found by a keyword search
+type KeywordResult struct {
+	Hash         *types.UInt128 // Its ToBytes() is the ed2k file hash
+	Name         string
+	Size         uint64
+	Type         string
+	Availability uint32
+	Tags         TagList
+}
+
+// Create a keyword result from the entry of a search response
+func newKeywordResult(entry searchEntry) (*KeywordResult, error) {
+	name, ok := entry.tags.GetString(TagFileName)
+	if !ok || name == "" {
+		return nil, errors.New("keyword result without file name")
+	}
+
+	size, ok := entry.tags.GetInt(TagFileSize)
+	if !ok {
+		return nil, errors.New("keyword result without file size")
+	}
+	if sizeHi, ok := entry.tags.GetInt(TagFileSizeHi); ok {
+		size |= sizeHi << 32
+	}
+
+	fileType, _ := entry.tags.GetString(TagFileType)
+	availability, _ := entry.tags.GetInt(TagSources)
+
+	return &KeywordResult{
+		Hash:         entry.id,
+		Name:         name,
+		Size:         size,
+		Type:         fileType,
+		Availability: uint32(availability),
+		Tags:         entry.tags,
+	}, nil
+}
+
+// Split a search query in the keywords that can be searched on Kad, in lower case
+func splitKeywords(query string) []string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return strings.ContainsRune(keywordSeparators, r)
+	})
+
+	keywords := make([]string, 0, len(words))
+	for _, word := range words {
+		if len(word) >= minKeywordLength {
+			keywords = append(keywords, word)
+		}
+	}
+	return keywords
+}
+
+// Get the Kad id where a keyword is published: the MD4 of the lower case keyword
+func KeywordHash(keyword string) *types.UInt128 {
+	hash := md4.New()
+	hash.Write([]byte(strings.ToLower(keyword)))
+	id, _ := types.NewUInt128FromByteArray(hash.Sum(nil))
+	return id
+}
+
+// Search files by keywords. The first keyword of the [query] is searched on Kad and the
+// others are sent as search expression. The results are streamed over the returned
+// channel, that is closed when the search ends
+func (client *Client) SearchKeyword(ctx context.Context, query string) (<-chan *KeywordResult, error) {
+	keywords := splitKeywords(query)
+	if len(keywords) == 0 {
+		return nil, errors.New("the query doesn't contain any searchable keyword")
+	}
+
+	var expr *SearchExpr
+	for _, keyword := range keywords[1:] {
+		if expr == nil {
+			expr = SearchKeywordExpr(keyword)
+		} else {
+			expr = SearchAndExpr(expr, SearchKeywordExpr(keyword))
+		}
+	}
+	if expr != nil {
+		expr = SearchAndExpr(SearchKeywordExpr(keywords[0]), expr)
+	}
+
+	return client.SearchKeywordExpr(ctx, keywords[0], expr)
+}
+
+// Search files published on Kad with [keyword] that match the search expression [expr],
+// that can be nil. See SearchKeyword
+func (client *Client) SearchKeywordExpr(ctx context.Context, keyword string, expr *SearchExpr) (<-chan *KeywordResult, error) {
+	payload := NewWriter()
+	target := KeywordHash(keyword)
+	payload.WriteUInt128(target)
+	if expr == nil {
+		payload.WriteUInt16(0)
+	} else {
+		payload.WriteUInt16(searchExprFollowFlag)
+		if err := payload.WriteSearchExpr(expr); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make(chan *KeywordResult)
+	err := client.streamSearchResults(ctx, target, CommKad2SearchKeyReq, payload.Bytes(), maxKeywordResults, func(ctx context.Context, entry searchEntry) bool {
+		result, err := newKeywordResult(entry)
+		if err != nil {
+			return false
+		}
+
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+		return true
+	}, func() { close(results) })
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Run a search of [target] with the request [opcode] and [payload], and pass to [emit] the
+// entries not seen before, up to [limit] entries. [emit] returns if it took the entry as a
+// result, and must stop sending when its context ends. [closeResults] is called when the
+// search ends
+func (client *Client) streamSearchResults(ctx context.Context, target *types.UInt128, opcode byte, payload []byte, limit int, emit func(ctx context.Context, entry searchEntry) bool, closeResults func()) error {
+	ctx, cancel := context.WithTimeout(ctx, searchLifetime)
+	responses, err := client.startSearch(ctx, target, opcode, payload)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	go func() {
+		defer cancel()
+		defer closeResults()
+
+		// The entries of other searches of the same target are dropped by [emit], so they
+		// don't count as seen
+		seen := make(map[types.UInt128]bool)
+		for response := range responses {
+			for _, entry := range response.entries {
+				if seen[*entry.id] || len(seen) >= limit {
+					continue
+				}
+
+				if emit(ctx, entry) {
+					seen[*entry.id] = true
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Run a lookup of [target] and send the search request [opcode] with [payload] to the
+// closest peers. The responses are delivered over the returned channel until [ctx] ends
+func (client *Client) startSearch(ctx context.Context, target *types.UInt128, opcode byte, payload []byte) (<-chan searchResponse, error) {
+	waiter := client.searches.register(target)
+
+	peers, err := client.Lookup(ctx, target, LookupFindValue)
+	if err != nil {
+		client.searches.unregister(target, waiter)
+		return nil, err
+	}
+
+	sent := 0
+	for _, peer := range peers {
+		client.searches.query(waiter, peerAddr(peer))
+		if client.sendToPeer(peer, opcode, payload) == nil {
+			sent++
+		}
+	}
+
+	if sent == 0 {
+		client.searches.unregister(target, waiter)
+		return nil, errors.New("the search request can't be sent to any peer")
+	}
+
+	output := make(chan searchResponse)
+	go func() {
+		defer close(output)
+		defer client.searches.unregister(target, waiter)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case response := <-waiter.responses:
+				select {
+				case output <- response:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// Check if [target] is close enough to our id to store and answer values for it
+func (client *Client) isInTolerance(target *types.UInt128) bool {
+	_, high := types.Xor(&client.id, target).ToUInt64()
+	return high>>32 <= searchTolerance
+}
+
+// Answer the search [request] for [target] with the [entries] found, splitting them in
+// KADEMLIA2_SEARCH_RES packets
+func (client *Client) answerSearch(request *UDPRequest, target *types.UInt128, entries []searchEntry) error {
+	for start := 0; start < len(entries); start += maxEntriesPerPacket {
+		end := start + maxEntriesPerPacket
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		response := newReply(client, request)
+		response.SetOpcode(CommKad2SearchRes)
+		response.WriteUInt128(&client.id)
+		response.WriteUInt128(target)
+		response.WriteUInt16(uint16(end - start))
+		for _, entry := range entries[start:end] {
+			response.WriteUInt128(entry.id)
+			if err := response.WriteTags(entry.tags); err != nil {
+				return err
+			}
+		}
+
+		if err := response.Send(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package kad
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"sleepy/types"
+	"testing"
+	"time"
+)
+
+// Receive the next datagram of [to], obfuscated or not, and get its opcode and payload
+func receiveTestRequest(t *testing.T, to *Client) (byte, *Reader, *net.UDPAddr) {
+	buf := make([]byte, 8192)
+	to.serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := to.serverConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("Receive error: %s", err)
+	}
+
+	packet := buf[:n]
+	if !isProtocolMarker(packet[0]) {
+		if packet, _, _, err = deobfuscatePacket(packet, &to.id, to.UDPVerifyKey(addr.IP)); err != nil {
+			t.Fatalf("Deobfuscation error: %s", err)
+		}
+	}
+	if len(packet) < 2 {
+		t.Fatalf("Packet too short: %x", packet)
+	}
+
+	return packet[1], NewReader(packet[2:]), addr
+}
+
+// Answer a search for [target] with [entries] from [from]
+func sendTestSearchResponse(t *testing.T, from *Client, to *net.UDPAddr, target *types.UInt128, entries []searchEntry) {
+	response := newResponse(from, to)
+	response.SetOpcode(CommKad2SearchRes)
+	response.WriteUInt128(from.Id())
+	response.WriteUInt128(target)
+	response.WriteUInt16(uint16(len(entries)))
+	for _, entry := range entries {
+		response.WriteUInt128(entry.id)
+		if err := response.WriteTags(entry.tags); err != nil {
+			t.Fatalf("Tags write error: %s", err)
+		}
+	}
+
+	if err := response.Send(); err != nil {
+		t.Fatalf("Send error: %s", err)
+	}
+}
+
+func TestSplitKeywords(t *testing.T) {
+	keywords := splitKeywords("The.Big_Lebowski (1998) [DVD] - by.Coen")
+	expected := []string{"the", "big", "lebowski", "1998", "dvd", "coen"}
+	if !reflect.DeepEqual(keywords, expected) {
+		t.Errorf("Keywords mismatch, got %v", keywords)
+	}
+
+	if keywords := splitKeywords("a b. c-d"); len(keywords) != 0 {
+		t.Errorf("Short words are not keywords, got %v", keywords)
+	}
+}
+
+func TestKeywordHash(t *testing.T) {
+	if hash := KeywordHash("ABC"); hash.ToHexString() != "a448017aaf21d8525fc10ae87aa6729d" {
+		t.Errorf("Hash mismatch, got %s", hash.ToHexString())
+	}
+}
+
+func TestWriter_WriteSearchExpr(t *testing.T) {
+	expr := SearchAndExpr(
+		SearchKeywordExpr("kad"),
+		SearchNumericExpr(TagFileSize, SearchGreater, 0x100000000),
+	)
+
+	writer := NewWriter()
+	if err := writer.WriteSearchExpr(expr); err != nil {
+		t.Fatalf("Write error: %s", err)
+	}
+
+	expected := []byte{
+		searchExprOperator, SearchAnd,
+		searchExprString, 0x03, 0x00, 'k', 'a', 'd',
+		searchExprUInt64, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, SearchGreater, 0x01, 0x00, 0x02,
+	}
+	if !bytes.Equal(writer.Bytes(), expected) {
+		t.Errorf("Expression mismatch, got %x", writer.Bytes())
+	}
+
+	if err := writer.WriteSearchExpr(SearchAndExpr(SearchKeywordExpr("kad"), nil)); err == nil {
+		t.Errorf("Must fail with incomplete expressions")
+	}
+}
+
+func TestClient_SearchKeyword(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+	peer := newTestClient(t)
+	defer closeTestClient(peer)
+
+	client.router.AddPeer(newTestClientPeer(peer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type searchStart struct {
+		results <-chan *KeywordResult
+		err     error
+	}
+	started := make(chan searchStart)
+	go func() {
+		results, err := client.SearchKeyword(ctx, "Kademlia networks")
+		started <- searchStart{results, err}
+	}()
+
+	// The peer answers the lookup and then receives the search
+	relayTestPacket(t, peer)
+	opcode, request, addr := receiveTestRequest(t, peer)
+	if opcode != CommKad2SearchKeyReq {
+		t.Fatalf("Search request expected, got opcode %x", opcode)
+	}
+
+	target, _ := request.ReadUInt128()
+	if !target.Equal(KeywordHash("kademlia")) {
+		t.Errorf("The search target must be the hash of the first keyword")
+	}
+	if start, _ := request.ReadUInt16(); start != searchExprFollowFlag {
+		t.Errorf("The other keywords must be sent as search expression")
+	}
+
+	start := <-started
+	if start.err != nil {
+		t.Fatalf("Search error: %s", start.err)
+	}
+
+	file := searchEntry{id: types.NewUInt128FromInt(7), tags: TagList{
+		NewStringTag(TagFileName, "kademlia networks.pdf"),
+		NewIntTag(TagFileSize, 5000),
+		NewStringTag(TagFileType, "Doc"),
+		NewIntTag(TagSources, 12),
+	}}
+	invalid := searchEntry{id: types.NewUInt128FromInt(8), tags: TagList{NewIntTag(TagFileSize, 1)}}
+	sendTestSearchResponse(t, peer, addr, target, []searchEntry{file, invalid})
+	sendTestSearchResponse(t, peer, addr, target, []searchEntry{file})
+
+	result := <-start.results
+	if result == nil {
+		t.Fatalf("A result must be received")
+	}
+	if !result.Hash.Equal(file.id) || result.Name != "kademlia networks.pdf" || result.Size != 5000 ||
+		result.Type != "Doc" || result.Availability != 12 {
+		t.Errorf("Result mismatch: %+v", result)
+	}
+
+	cancel()
+	for result := range start.results {
+		t.Errorf("Duplicated and invalid results must be dropped, got %+v", result)
+	}
+}
+
+func TestReader_ReadSearchExpr(t *testing.T) {
+	expr := SearchOrExpr(
+		SearchNotExpr(SearchKeywordExpr("Kad"), SearchMetaExpr(TagFileType, "Video")),
+		SearchNumericExpr(TagFileSize, SearchLess, 100),
+	)
+
+	writer := NewWriter()
+	writer.WriteSearchExpr(expr)
+
+	read, err := NewReader(writer.Bytes()).ReadSearchExpr()
+	if err != nil {
+		t.Fatalf("Read error: %s", err)
+	}
+	if read.operator != SearchOr || read.left.operator != SearchNot || read.left.left.text != "kad" ||
+		read.left.right.tag != TagFileType || read.right.number != 100 || read.right.operator != SearchLess {
+		t.Errorf("Expression mismatch: %+v", read)
+	}
+
+	// A chain of operators without terms
+	deep := bytes.Repeat([]byte{searchExprOperator, SearchAnd}, maxSearchExprDepth+2)
+	if _, err := NewReader(deep).ReadSearchExpr(); err == nil {
+		t.Errorf("Must fail with too deep expressions")
+	}
+}
@@ -0,0 +1,233 @@
+package kad
+
+import (
+	"errors"
+	"strings"
+)
+
+// Boolean operators of search expressions
+const (
+	SearchAnd = byte(0x00)
+	SearchOr  = byte(0x01)
+	SearchNot = byte(0x02) // Left AND NOT right
+)
+
+// Comparisons of numeric search terms
+const (
+	SearchEqual        = byte(0x00)
+	SearchGreater      = byte(0x01)
+	SearchLess         = byte(0x02)
+	SearchGreaterEqual = byte(0x03)
+	SearchLessEqual    = byte(0x04)
+	SearchNotEqual     = byte(0x05)
+)
+
+// Node types of the search expressions, as sent on the wire
+const (
+	searchExprOperator = byte(0x00)
+	searchExprString   = byte(0x01)
+	searchExprMeta     = byte(0x02)
+	searchExprUInt32   = byte(0x03)
+	searchExprUInt64   = byte(0x08)
+
+	maxSearchExprDepth = 24
+)
+
+// SearchExpr is a node of the search expression tree sent on keyword searches
+type SearchExpr struct {
+	kind     byte
+	operator byte // Boolean operator or numeric comparison
+	left     *SearchExpr
+	right    *SearchExpr
+	tag      string // Tag name of meta and numeric terms
+	text     string // Value of string and meta terms
+	number   uint64 // Value of numeric terms
+}
+
+// Create an expression that matches the files that match both [left] and [right]
+func SearchAndExpr(left *SearchExpr, right *SearchExpr) *SearchExpr {
+	return &SearchExpr{kind: searchExprOperator, operator: SearchAnd, left: left, right: right}
+}
+
+// Create an expression that matches the files that match [left] or [right]
+func SearchOrExpr(left *SearchExpr, right *SearchExpr) *SearchExpr {
+	return &SearchExpr{kind: searchExprOperator, operator: SearchOr, left: left, right: right}
+}
+
+// Create an expression that matches the files that match [left] but not [right]
+func SearchNotExpr(left *SearchExpr, right *SearchExpr) *SearchExpr {
+	return &SearchExpr{kind: searchExprOperator, operator: SearchNot, left: left, right: right}
+}
+
+// Create an expression that matches the files with the [keyword] in the name
+func SearchKeywordExpr(keyword string) *SearchExpr {
+	return &SearchExpr{kind: searchExprString, text: keyword}
+}
+
+// Create an expression that matches the files with the string [tag] equal to [value]
+func SearchMetaExpr(tag string, value string) *SearchExpr {
+	return &SearchExpr{kind: searchExprMeta, tag: tag, text: value}
+}
+
+// Create an expression that compares the numeric [tag] of the files with [value]
+func SearchNumericExpr(tag string, comparison byte, value uint64) *SearchExpr {
+	kind := searchExprUInt32
+	if value > 0xffffffff {
+		kind = searchExprUInt64
+	}
+	return &SearchExpr{kind: kind, operator: comparison, tag: tag, number: value}
+}
+
+// Write a search expression tree
+func (writer *Writer) WriteSearchExpr(expr *SearchExpr) error {
+	if expr == nil {
+		return errors.New("search expression can't be null")
+	}
+
+	writer.WriteByte(expr.kind)
+
+	switch expr.kind {
+	case searchExprOperator:
+		writer.WriteByte(expr.operator)
+		if err := writer.WriteSearchExpr(expr.left); err != nil {
+			return err
+		}
+		return writer.WriteSearchExpr(expr.right)
+	case searchExprString:
+		return writer.WriteLengthString(expr.text)
+	case searchExprMeta:
+		if err := writer.WriteLengthString(expr.text); err != nil {
+			return err
+		}
+		return writer.WriteLengthString(expr.tag)
+	case searchExprUInt32, searchExprUInt64:
+		if expr.kind == searchExprUInt32 {
+			writer.WriteUInt32(uint32(expr.number))
+		} else {
+			writer.WriteUInt64(expr.number)
+		}
+		writer.WriteByte(expr.operator)
+		return writer.WriteLengthString(expr.tag)
+	default:
+		return errors.New("unknown search expression type")
+	}
+}
+
+// Read a search expression tree
+func (reader *Reader) ReadSearchExpr() (*SearchExpr, error) {
+	return reader.readSearchExpr(0)
+}
+
+func (reader *Reader) readSearchExpr(depth int) (*SearchExpr, error) {
+	if depth > maxSearchExprDepth {
+		return nil, errors.New("search expression too deep")
+	}
+
+	kind, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	expr := &SearchExpr{kind: kind}
+
+	switch kind {
+	case searchExprOperator:
+		if expr.operator, err = reader.ReadByte(); err != nil {
+			return nil, err
+		} else if expr.operator > SearchNot {
+			return nil, errors.New("unknown search operator")
+		}
+		if expr.left, err = reader.readSearchExpr(depth + 1); err != nil {
+			return nil, err
+		}
+		if expr.right, err = reader.readSearchExpr(depth + 1); err != nil {
+			return nil, err
+		}
+	case searchExprString:
+		text, err := reader.ReadLengthString()
+		if err != nil {
+			return nil, err
+		}
+		expr.text = strings.ToLower(text)
+	case searchExprMeta:
+		text, err := reader.ReadLengthString()
+		if err != nil {
+			return nil, err
+		}
+		expr.text = strings.ToLower(text)
+		if expr.tag, err = reader.ReadLengthString(); err != nil {
+			return nil, err
+		}
+	case searchExprUInt32, searchExprUInt64:
+		if kind == searchExprUInt32 {
+			value, err := reader.ReadUInt32()
+			if err != nil {
+				return nil, err
+			}
+			expr.number = uint64(value)
+		} else if expr.number, err = reader.ReadUInt64(); err != nil {
+			return nil, err
+		}
+		if expr.operator, err = reader.ReadByte(); err != nil {
+			return nil, err
+		} else if expr.operator > SearchNotEqual {
+			return nil, errors.New("unknown search comparison")
+		}
+		if expr.tag, err = reader.ReadLengthString(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unknown search expression type")
+	}
+
+	return expr, nil
+}
+
+// Check if a file with the [tags] matches the expression
+func (expr *SearchExpr) Matches(tags TagList) bool {
+	switch expr.kind {
+	case searchExprOperator:
+		switch expr.operator {
+		case SearchAnd:
+			return expr.left.Matches(tags) && expr.right.Matches(tags)
+		case SearchOr:
+			return expr.left.Matches(tags) || expr.right.Matches(tags)
+		default:
+			return expr.left.Matches(tags) && !expr.right.Matches(tags)
+		}
+	case searchExprString:
+		name, ok := tags.GetString(TagFileName)
+		if !ok {
+			return false
+		}
+		name = strings.ToLower(name)
+		for _, word := range strings.Fields(strings.ToLower(expr.text)) {
+			if !strings.Contains(name, word) {
+				return false
+			}
+		}
+		return true
+	case searchExprMeta:
+		value, ok := tags.GetString(expr.tag)
+		return ok && strings.EqualFold(value, expr.text)
+	default:
+		value, ok := tags.GetInt(expr.tag)
+		if !ok {
+			return false
+		}
+		switch expr.operator {
+		case SearchEqual:
+			return value == expr.number
+		case SearchGreater:
+			return value > expr.number
+		case SearchLess:
+			return value < expr.number
+		case SearchGreaterEqual:
+			return value >= expr.number
+		case SearchLessEqual:
+			return value <= expr.number
+		default:
+			return value != expr.number
+		}
+	}
+}
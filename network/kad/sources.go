@@ -0,0 +1,148 @@
+package kad
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sleepy/types"
+)
+
+// Source types, as published on TagSourceType
+const (
+	SourceTypeHighId          = byte(1) // Reachable source
+	SourceTypeFirewalled      = byte(3) // Firewalled source reachable through its buddy
+	SourceTypeHighIdLarge     = byte(4) // Reachable source that supports files bigger than 4GB
+	SourceTypeFirewalledLarge = byte(5) // Firewalled source with buddy that supports files bigger than 4GB
+	SourceTypeDirectCallback  = byte(6) // Firewalled source that accepts direct UDP callbacks
+)
+
+const (
+	maxSourceResults = 300 // Max results returned by a source search
+)
+
+// SourceBuddy is the peer that relays the connections to a firewalled source
+type SourceBuddy struct {
+	Id   *types.UInt128
+	IP   net.IP
+	Port uint16
+}
+
+// SourceResult is a peer that shares the searched file
+type SourceResult struct {
+	Id         *types.UInt128 // User hash of the source
+	Type       byte
+	IP         net.IP
+	TCPPort    uint16
+	UDPPort    uint16
+	Encryption byte         // Crypt options of the source
+	Buddy      *SourceBuddy // Only for firewalled sources
+	Tags       TagList
+}
+
+// Check if the source can't receive incoming connections
+func (source *SourceResult) IsFirewalled() bool {
+	return source.Type == SourceTypeFirewalled || source.Type == SourceTypeFirewalledLarge ||
+		source.Type == SourceTypeDirectCallback
+}
+
+// Create a source result from the entry of a search response
+func newSourceResult(entry searchEntry) (*SourceResult, error) {
+	sourceType, ok := entry.tags.GetInt(TagSourceType)
+	if !ok {
+		return nil, errors.New("source result without type")
+	}
+
+	ip, ok := entry.tags.GetIP(TagSourceIP)
+	if !ok {
+		return nil, errors.New("source result without ip")
+	}
+
+	tcpPort, _ := entry.tags.GetInt(TagSourcePort)
+	udpPort, _ := entry.tags.GetInt(TagSourceUDPPort)
+	encryption, _ := entry.tags.GetInt(TagEncryption)
+
+	source := &SourceResult{
+		Id:         entry.id,
+		Type:       byte(sourceType),
+		IP:         ip,
+		TCPPort:    uint16(tcpPort),
+		UDPPort:    uint16(udpPort),
+		Encryption: byte(encryption),
+		Tags:       entry.tags,
+	}
+
+	switch source.Type {
+	case SourceTypeHighId, SourceTypeHighIdLarge:
+		if source.TCPPort == 0 {
+			return nil, errors.New("reachable source without tcp port")
+		}
+	case SourceTypeFirewalled, SourceTypeFirewalledLarge:
+		buddy, err := newSourceBuddy(entry.tags)
+		if err != nil {
+			return nil, err
+		}
+		source.Buddy = buddy
+	case SourceTypeDirectCallback:
+		if source.UDPPort == 0 {
+			return nil, errors.New("direct callback source without udp port")
+		}
+	default:
+		return nil, errors.New("unknown source type")
+	}
+
+	return source, nil
+}
+
+// Read the buddy of a firewalled source from its tags
+func newSourceBuddy(tags TagList) (*SourceBuddy, error) {
+	hexHash, ok := tags.GetString(TagBuddyHash)
+	if !ok {
+		return nil, errors.New("firewalled source without buddy")
+	}
+
+	hash, err := hex.DecodeString(hexHash)
+	if err != nil || len(hash) != 16 {
+		return nil, errors.New("invalid buddy hash")
+	}
+	id, _ := types.NewUInt128FromByteArray(hash)
+
+	ip, ok := tags.GetIP(TagServerIP)
+	if !ok {
+		return nil, errors.New("firewalled source without buddy ip")
+	}
+
+	port, ok := tags.GetInt(TagServerPort)
+	if !ok {
+		return nil, errors.New("firewalled source without buddy port")
+	}
+
+	return &SourceBuddy{Id: id, IP: ip, Port: uint16(port)}, nil
+}
+
+// Search the peers that share the file with the ed2k [fileHash] and [size]. The results
+// are streamed over the returned channel, that is closed when the search ends
+func (client *Client) SearchSources(ctx context.Context, fileHash *types.UInt128, size uint64) (<-chan *SourceResult, error) {
+	payload := NewWriter()
+	payload.WriteUInt128(fileHash)
+	payload.WriteUInt16(0) // Start position
+	payload.WriteUInt64(size)
+
+	results := make(chan *SourceResult)
+	err := client.streamSearchResults(ctx, fileHash, CommKad2SearchSourceReq, payload.Bytes(), maxSourceResults, func(ctx context.Context, entry searchEntry) bool {
+		result, err := newSourceResult(entry)
+		if err != nil {
+			return false
+		}
+
+		select {
+		case results <- result:
+		case <-ctx.Done():
+		}
+		return true
+	}, func() { close(results) })
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,104 @@
+package kad
+
+import (
+	"context"
+	"net"
+	"sleepy/types"
+	"testing"
+	"time"
+)
+
+func TestNewSourceResult(t *testing.T) {
+	id := types.NewUInt128FromInt(5)
+	sourceIP := NewIPTag(TagSourceIP, net.IPv4(10, 0, 0, 1))
+
+	source, err := newSourceResult(searchEntry{id: id, tags: TagList{
+		NewIntTag(TagSourceType, uint64(SourceTypeHighId)), sourceIP,
+		NewIntTag(TagSourcePort, 4662), NewIntTag(TagSourceUDPPort, 4672),
+	}})
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+	if !source.IP.Equal(net.IPv4(10, 0, 0, 1)) || source.TCPPort != 4662 || source.UDPPort != 4672 {
+		t.Errorf("Source mismatch: %+v", source)
+	}
+	if source.IsFirewalled() || source.Buddy != nil {
+		t.Errorf("High id sources don't have buddy")
+	}
+
+	source, err = newSourceResult(searchEntry{id: id, tags: TagList{
+		NewIntTag(TagSourceType, uint64(SourceTypeFirewalled)), sourceIP,
+		NewStringTag(TagBuddyHash, "000102030405060708090a0b0c0d0e0f"),
+		NewIPTag(TagServerIP, net.IPv4(10, 0, 0, 2)), NewIntTag(TagServerPort, 4665),
+	}})
+	if err != nil {
+		t.Fatalf("Parse error: %s", err)
+	}
+	if !source.IsFirewalled() || source.Buddy == nil {
+		t.Fatalf("Firewalled sources must have buddy")
+	}
+	if source.Buddy.Id.ToHexString() != "000102030405060708090a0b0c0d0e0f" ||
+		!source.Buddy.IP.Equal(net.IPv4(10, 0, 0, 2)) || source.Buddy.Port != 4665 {
+		t.Errorf("Buddy mismatch: %+v", source.Buddy)
+	}
+
+	if _, err := newSourceResult(searchEntry{id: id, tags: TagList{
+		NewIntTag(TagSourceType, uint64(SourceTypeFirewalled)), sourceIP,
+	}}); err == nil {
+		t.Errorf("Must fail with firewalled sources without buddy")
+	}
+	if _, err := newSourceResult(searchEntry{id: id, tags: TagList{sourceIP}}); err == nil {
+		t.Errorf("Must fail without source type")
+	}
+}
+
+func TestClient_SearchSources(t *testing.T) {
+	client := startTestClient(t)
+	defer closeTestClient(client)
+	peer := newTestClient(t)
+	defer closeTestClient(peer)
+
+	client.router.AddPeer(newTestClientPeer(peer))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	fileHash := types.NewUInt128FromInt(0xf11e)
+	started := make(chan (<-chan *SourceResult))
+	go func() {
+		results, err := client.SearchSources(ctx, fileHash, 0x100000000)
+		if err != nil {
+			t.Errorf("Search error: %s", err)
+		}
+		started <- results
+	}()
+
+	relayTestPacket(t, peer)
+	opcode, request, addr := receiveTestRequest(t, peer)
+	if opcode != CommKad2SearchSourceReq {
+		t.Fatalf("Source search request expected, got opcode %x", opcode)
+	}
+
+	target, _ := request.ReadUInt128()
+	start, _ := request.ReadUInt16()
+	size, _ := request.ReadUInt64()
+	if !target.Equal(fileHash) || start != 0 || size != 0x100000000 {
+		t.Errorf("Request mismatch, target: %s, start: %d, size: %d", target.ToHexString(), start, size)
+	}
+
+	results := <-started
+	if results == nil {
+		t.FailNow()
+	}
+
+	sendTestSearchResponse(t, peer, addr, target, []searchEntry{{id: types.NewUInt128FromInt(9), tags: TagList{
+		NewIntTag(TagSourceType, uint64(SourceTypeHighIdLarge)),
+		NewIPTag(TagSourceIP, net.IPv4(10, 0, 0, 1)),
+		NewIntTag(TagSourcePort, 4662),
+	}}})
+
+	source := <-results
+	if source == nil || !source.Id.Equal(types.NewUInt128FromInt(9)) || source.TCPPort != 4662 {
+		t.Errorf("Source mismatch: %+v", source)
+	}
+}
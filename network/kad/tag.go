@@ -0,0 +1,191 @@
+package kad
+
+import (
+	"net"
+)
+
+// Tag value types, as defined by eMule in opcodes.h
+const (
+	TagTypeHash16    = byte(0x01)
+	TagTypeString    = byte(0x02)
+	TagTypeUInt32    = byte(0x03)
+	TagTypeFloat32   = byte(0x04)
+	TagTypeBool      = byte(0x05)
+	TagTypeBoolArray = byte(0x06)
+	TagTypeBlob      = byte(0x07)
+	TagTypeUInt16    = byte(0x08)
+	TagTypeUInt8     = byte(0x09)
+	TagTypeBsob      = byte(0x0A)
+	TagTypeUInt64    = byte(0x0B)
+	TagTypeStr1      = byte(0x11) // Compact strings of 1 to 16 bytes, without length
+	TagTypeStr16     = byte(0x20)
+)
+
+// Well known tag names. Kad sends the one byte eMule tag ids as names
+const (
+	TagFileName       = "\x01" // <string>
+	TagFileSize       = "\x02" // <uint32/uint64>
+	TagFileType       = "\x03" // <string>
+	TagFileFormat     = "\x04" // <string>
+	TagDescription    = "\x0B" // <string>
+	TagVersion        = "\x11" // <uint32>
+	TagSources        = "\x15" // <uint32> Availability of a file
+	TagPublishInfo    = "\x33" // <uint32>
+	TagFileSizeHi     = "\x3A" // <uint32>
+	TagMediaArtist    = "\xD0" // <string>
+	TagMediaAlbum     = "\xD1" // <string>
+	TagMediaTitle     = "\xD2" // <string>
+	TagMediaLength    = "\xD3" // <uint32>
+	TagMediaBitrate   = "\xD4" // <uint32>
+	TagMediaCodec     = "\xD5" // <string>
+	TagKadMiscOptions = "\xF2" // <uint8>
+	TagEncryption     = "\xF3" // <uint8>
+	TagFileRating     = "\xF7" // <uint8>
+	TagBuddyHash      = "\xF8" // <string>
+	TagClientLowId    = "\xF9" // <uint32>
+	TagServerPort     = "\xFA" // <uint16>
+	TagServerIP       = "\xFB" // <uint32>
+	TagSourceUDPPort  = "\xFC" // <uint16>
+	TagSourcePort     = "\xFD" // <uint16>
+	TagSourceIP       = "\xFE" // <uint32>
+	TagSourceType     = "\xFF" // <uint8>
+)
+
+// Tag is a typed and named value attached to Kad packets
+type Tag struct {
+	Name  string
+	Type  byte
+	Value interface{}
+}
+
+// Create a string tag
+func NewStringTag(name string, value string) *Tag {
+	return &Tag{Name: name, Type: TagTypeString, Value: value}
+}
+
+// Create an integer tag using the smallest type that can store the value
+func NewIntTag(name string, value uint64) *Tag {
+	if value <= 0xff {
+		return &Tag{Name: name, Type: TagTypeUInt8, Value: uint8(value)}
+	} else if value <= 0xffff {
+		return &Tag{Name: name, Type: TagTypeUInt16, Value: uint16(value)}
+	} else if value <= 0xffffffff {
+		return &Tag{Name: name, Type: TagTypeUInt32, Value: uint32(value)}
+	} else {
+		return &Tag{Name: name, Type: TagTypeUInt64, Value: value}
+	}
+}
+
+// Create a float tag
+func NewFloatTag(name string, value float32) *Tag {
+	return &Tag{Name: name, Type: TagTypeFloat32, Value: value}
+}
+
+// Create a boolean tag
+func NewBoolTag(name string, value bool) *Tag {
+	return &Tag{Name: name, Type: TagTypeBool, Value: value}
+}
+
+// Create a tag with a 16 bytes hash
+func NewHashTag(name string, value []byte) *Tag {
+	return &Tag{Name: name, Type: TagTypeHash16, Value: value}
+}
+
+// Create a binary tag
+func NewBlobTag(name string, value []byte) *Tag {
+	return &Tag{Name: name, Type: TagTypeBlob, Value: value}
+}
+
+// Create a tag with an IPv4 address, stored as an integer in host order
+func NewIPTag(name string, ip net.IP) *Tag {
+	var value uint32
+	if ip4 := ip.To4(); ip4 != nil {
+		value = uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3])
+	}
+	return &Tag{Name: name, Type: TagTypeUInt32, Value: value}
+}
+
+// Get the value of any integer tag
+func (tag *Tag) IntValue() (uint64, bool) {
+	switch value := tag.Value.(type) {
+	case uint8:
+		return uint64(value), true
+	case uint16:
+		return uint64(value), true
+	case uint32:
+		return uint64(value), true
+	case uint64:
+		return value, true
+	default:
+		return 0, false
+	}
+}
+
+// Get the value of a string tag
+func (tag *Tag) StringValue() (string, bool) {
+	value, ok := tag.Value.(string)
+	return value, ok
+}
+
+// Get the value of a float tag
+func (tag *Tag) FloatValue() (float32, bool) {
+	value, ok := tag.Value.(float32)
+	return value, ok
+}
+
+// Get the value of a boolean tag
+func (tag *Tag) BoolValue() (bool, bool) {
+	value, ok := tag.Value.(bool)
+	return value, ok
+}
+
+// Get the value of a hash, blob or bsob tag
+func (tag *Tag) BytesValue() ([]byte, bool) {
+	value, ok := tag.Value.([]byte)
+	return value, ok
+}
+
+// TagList is the ordered list of tags of a packet
+type TagList []*Tag
+
+// Get the first tag with the passed name, or nil if not exists
+func (tags TagList) Get(name string) *Tag {
+	for _, tag := range tags {
+		if tag.Name == name {
+			return tag
+		}
+	}
+	return nil
+}
+
+// Get the integer value of the tag with the passed name
+func (tags TagList) GetInt(name string) (uint64, bool) {
+	tag := tags.Get(name)
+	if tag == nil {
+		return 0, false
+	}
+	return tag.IntValue()
+}
+
+// Get the string value of the tag with the passed name
+func (tags TagList) GetString(name string) (string, bool) {
+	tag := tags.Get(name)
+	if tag == nil {
+		return "", false
+	}
+	return tag.StringValue()
+}
+
+// Get the IPv4 address stored on the integer tag with the passed name
+func (tags TagList) GetIP(name string) (net.IP, bool) {
+	value, ok := tags.GetInt(name)
+	if !ok || value > 0xffffffff {
+		return nil, false
+	}
+	return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value)), true
+}
+
+// Check if the list contains a tag with the passed name
+func (tags TagList) Contains(name string) bool {
+	return tags.Get(name) != nil
+}
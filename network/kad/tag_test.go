@@ -0,0 +1,53 @@
+package kad
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewIntTag(t *testing.T) {
+	tests := []struct {
+		value   uint64
+		tagType byte
+	}{
+		{0xff, TagTypeUInt8},
+		{0x100, TagTypeUInt16},
+		{0x10000, TagTypeUInt32},
+		{0x100000000, TagTypeUInt64},
+	}
+
+	for _, test := range tests {
+		tag := NewIntTag(TagFileSize, test.value)
+		if tag.Type != test.tagType {
+			t.Errorf("Tag type for %d mismatch, got: %d, want: %d", test.value, tag.Type, test.tagType)
+		}
+		if value, ok := tag.IntValue(); !ok || value != test.value {
+			t.Errorf("Tag value mismatch, got: %d, want: %d", value, test.value)
+		}
+	}
+}
+
+func TestTagList_Get(t *testing.T) {
+	tags := TagList{NewStringTag(TagFileName, "file.txt"), NewIntTag(TagFileSize, 10)}
+
+	if name, ok := tags.GetString(TagFileName); !ok || name != "file.txt" {
+		t.Errorf("File name mismatch, got: %s", name)
+	}
+	if _, ok := tags.GetString(TagFileSize); ok {
+		t.Errorf("File size is not a string tag")
+	}
+	if tags.Contains(TagSourceIP) || tags.Get(TagSourceIP) != nil {
+		t.Errorf("Tag list must not contains the source ip tag")
+	}
+}
+
+func TestTagList_GetIP(t *testing.T) {
+	tags := TagList{NewIPTag(TagSourceIP, net.IPv4(192, 168, 0, 1))}
+
+	if value, _ := tags.GetInt(TagSourceIP); value != 0xc0a80001 {
+		t.Errorf("The IP must be stored in host order, got: %x", value)
+	}
+	if ip, ok := tags.GetIP(TagSourceIP); !ok || !ip.Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Errorf("IP mismatch, got: %s", ip)
+	}
+}
@@ -3,7 +3,9 @@ package types
 import (
 	"errors"
 	"sleepy/types"
+	"sleepy/utils/clock"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -15,6 +17,8 @@ const (
 	LongTimePeerType = byte(0x00)
 )
 
+// Peer of the Kad network. It's safe for concurrent use, the id never changes and the rest
+// of the state is protected by the access lock
 type Peer struct {
 	id              types.UInt128
 	ip              net.IP
@@ -27,9 +31,13 @@ type Peer struct {
 	typeCode        byte
 	typeUpdated     time.Time
 	useCounter      uint
+	udpKey          uint32
+	udpKeyIP        net.IP
+	clock           clock.Clock
+	access          sync.RWMutex
 }
 
-func newEmptyPeer() *Peer {
+func newEmptyPeer(clock clock.Clock) *Peer {
 	return &Peer{
 		id:              *types.NewUInt128FromInt(0),
 		ip:              net.IPv4zero,
@@ -37,21 +45,37 @@ func newEmptyPeer() *Peer {
 		tcpPort:         0,
 		protocolVersion: 0,
 		ipVerified:      false,
-		created:         time.Now(),
+		created:         clock.Now(),
 		expires:         time.Time{},
 		typeCode:        NewPeerType,
-		typeUpdated:     time.Now(),
+		typeUpdated:     clock.Now(),
 		useCounter:      0,
+		udpKey:          0,
+		udpKeyIP:        nil,
+		clock:           clock,
 	}
 }
 
 // Create a new user from his Id
 func NewPeer(id *types.UInt128) *Peer {
-	newPeer := newEmptyPeer()
+	return NewPeerWithClock(id, clock.System)
+}
+
+// Create a new user from his Id, that ages following the [clock]
+func NewPeerWithClock(id *types.UInt128, clock clock.Clock) *Peer {
+	newPeer := newEmptyPeer(clock)
 	newPeer.id = *id.Clone()
 	return newPeer
 }
 
+// Get the current time of the peer clock
+func (peer *Peer) now() time.Time {
+	if peer.clock == nil {
+		return time.Now()
+	}
+	return peer.clock.Now()
+}
+
 // Get the current peer Id
 func (peer *Peer) Id() *types.UInt128 {
 	return peer.id.Clone()
@@ -59,6 +83,9 @@ func (peer *Peer) Id() *types.UInt128 {
 
 // Set the current [ip] for the peer, and will set it as [verified] or not
 func (peer *Peer) SetIP(ip net.IP, verified bool) {
+	peer.access.Lock()
+	defer peer.access.Unlock()
+
 	peer.ip = make(net.IP, len(ip))
 	copy(peer.ip, ip)
 	peer.ipVerified = verified
@@ -66,6 +93,9 @@ func (peer *Peer) SetIP(ip net.IP, verified bool) {
 
 // Get the current IP of the peer
 func (peer *Peer) IP() *net.IP {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
+
 	cpy := make(net.IP, len(peer.ip))
 	copy(cpy, peer.ip)
 	return &cpy
@@ -73,50 +103,111 @@ func (peer *Peer) IP() *net.IP {
 
 // Set a peer as verified if the provided IP is equal than saved
 func (peer *Peer) VerifyIp(ip net.IP) bool {
-	if !ip.Equal(*peer.IP()) {
-		peer.ipVerified = false
-		return false
-	} else {
-		peer.ipVerified = true
-		return true
-	}
+	peer.access.Lock()
+	defer peer.access.Unlock()
+
+	peer.ipVerified = ip.Equal(peer.ip)
+	return peer.ipVerified
 }
 
 // Check if the current IP is verified
 func (peer *Peer) IsIpVerified() bool {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
 	return peer.ipVerified
 }
 
 // Set the UDP port of the peer
 func (peer *Peer) SetUDPPort(port uint16) {
+	peer.access.Lock()
 	peer.udpPort = port
+	peer.access.Unlock()
 }
 
 // Get the UDP port of the peer
 func (peer *Peer) UDPPort() uint16 {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
 	return peer.udpPort
 }
 
 // Set the TCP port of the peer
 func (peer *Peer) SetTCPPort(port uint16) {
+	peer.access.Lock()
 	peer.tcpPort = port
+	peer.access.Unlock()
 }
 
 // Get the TCP port of the peer
 func (peer *Peer) TCPPort() uint16 {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
 	return peer.tcpPort
 }
 
+// Set the UDP verify key that the peer gave us, valid only while our public IP is [ip]
+func (peer *Peer) SetUDPKey(key uint32, ip net.IP) {
+	peer.access.Lock()
+	defer peer.access.Unlock()
+	peer.setUDPKey(key, ip)
+}
+
+// Set the UDP verify key. The lock must be held
+func (peer *Peer) setUDPKey(key uint32, ip net.IP) {
+	peer.udpKey = key
+	peer.udpKeyIP = nil
+	if ip != nil {
+		peer.udpKeyIP = make(net.IP, len(ip))
+		copy(peer.udpKeyIP, ip)
+	}
+}
+
+// Get the UDP verify key to obfuscate the packets for this peer, or 0 if the peer didn't
+// give us one for our public [ip]
+func (peer *Peer) UDPKey(ip net.IP) uint32 {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
+
+	if peer.udpKeyIP != nil && !peer.udpKeyIP.Equal(ip) {
+		return 0
+	}
+	return peer.udpKey
+}
+
+// Get the public IP for which the UDP verify key of the peer is valid, or nil if any
+func (peer *Peer) UDPKeyIP() net.IP {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
+
+	if peer.udpKeyIP == nil {
+		return nil
+	}
+	ip := make(net.IP, len(peer.udpKeyIP))
+	copy(ip, peer.udpKeyIP)
+	return ip
+}
+
 // Calculate the peer distance between this and the other
 func (peer *Peer) GetDistance(id *types.UInt128) *types.UInt128 {
 	return types.Xor(&peer.id, id)
 }
 
-// Check if the peer is alive
+// Check if the peer is alive, without changing its state (see UpdateExpiration)
 func (peer *Peer) IsAlive() bool {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
+
+	return peer.typeCode < ExpiredPeerType && (peer.expires.Equal(time.Time{}) || !peer.expires.Before(peer.now()))
+}
+
+// Set the peer as expired if its expiration time is past, and check if it's still alive
+func (peer *Peer) UpdateExpiration() bool {
+	peer.access.Lock()
+	defer peer.access.Unlock()
+
 	if peer.typeCode < ExpiredPeerType {
 		// If expiration time is past
-		if peer.expires.Before(time.Now()) && peer.Expiration().After(time.Time{}) {
+		if peer.expires.Before(peer.now()) && peer.expires.After(time.Time{}) {
 			peer.typeCode = ExpiredPeerType
 			return false
 		} else {
@@ -125,44 +216,66 @@ func (peer *Peer) IsAlive() bool {
 	} else {
 		// If expiration time is not setted, set an instant of the past
 		if peer.expires.Equal(time.Time{}) {
-			peer.expires = time.Now().Add(-time.Microsecond)
+			peer.expires = peer.now().Add(-time.Microsecond)
 		}
 		return false
 	}
 }
 
+// Get the type of the peer, from LongTimePeerType to ExpiredPeerType
+func (peer *Peer) Type() byte {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
+	return peer.typeCode
+}
+
 // Get the expiration time
 func (peer *Peer) Expiration() time.Time {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
 	return peer.expires
 }
 
 // Set the expiration time
 func (peer *Peer) SetExpiration(expires time.Time) {
+	peer.access.Lock()
 	peer.expires = expires
+	peer.access.Unlock()
 }
 
 // Get the protocol version
 func (peer *Peer) ProtocolVersion() uint8 {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
 	return peer.protocolVersion
 }
 
 // Set the protocol version
 func (peer *Peer) SetProtocolVersion(version uint8) {
+	peer.access.Lock()
 	peer.protocolVersion = version
+	peer.access.Unlock()
 }
 
 // Check if the peer is in use
 func (peer *Peer) InUse() bool {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
 	return peer.useCounter > 0
 }
 
 // Add a use flag
 func (peer *Peer) AddUse() {
+	peer.access.Lock()
 	peer.useCounter++
+	peer.access.Unlock()
 }
 
 // Remove a use flag
 func (peer *Peer) RemoveUse() {
+	peer.access.Lock()
+	defer peer.access.Unlock()
+
 	if peer.useCounter > 0 {
 		peer.useCounter--
 	} else {
@@ -178,12 +291,16 @@ func (peer *Peer) Equal(otherPeer *Peer) bool {
 
 // Degrade the type of node
 func (peer *Peer) DegradeType() {
+	peer.access.Lock()
+	defer peer.access.Unlock()
+
 	// If type rechecked less than 10 seconds ago or is expired, ignore
-	if time.Now().Sub(peer.typeUpdated) < time.Second*10 || peer.typeCode == ExpiredPeerType {
+	now := peer.now()
+	if now.Sub(peer.typeUpdated) < time.Second*10 || peer.typeCode == ExpiredPeerType {
 		return
 	}
 
-	peer.typeUpdated = time.Now()
+	peer.typeUpdated = now
 	if peer.typeCode < ExpiredPeerType {
 		peer.typeCode++
 	}
@@ -191,22 +308,33 @@ func (peer *Peer) DegradeType() {
 
 // Update peer type based on internal times
 func (peer *Peer) UpdateType() {
-	hoursOnline := time.Now().Sub(peer.created)
+	peer.access.Lock()
+	defer peer.access.Unlock()
+	peer.updateType()
+}
+
+// Update peer type. The lock must be held
+func (peer *Peer) updateType() {
+	now := peer.now()
+	hoursOnline := now.Sub(peer.created)
 
 	if hoursOnline > 2*time.Hour {
 		peer.typeCode = LongTimePeerType
-		peer.expires = time.Now().Add(time.Hour * 2)
+		peer.expires = now.Add(time.Hour * 2)
 	} else if hoursOnline > time.Hour {
 		peer.typeCode = TwoHourPeerType
-		peer.expires = time.Now().Add(time.Hour + (time.Minute * 30))
+		peer.expires = now.Add(time.Hour + (time.Minute * 30))
 	} else {
 		peer.typeCode = OneHourPeerType
-		peer.expires = time.Now().Add(time.Hour)
+		peer.expires = now.Add(time.Hour)
 	}
 }
 
 // Get the time on which peer has been viewed last time
 func (peer *Peer) LastSeen() time.Time {
+	peer.access.RLock()
+	defer peer.access.RUnlock()
+
 	if !peer.expires.Equal(time.Time{}) {
 		if peer.typeCode == OneHourPeerType {
 			return peer.expires.Add(-time.Hour)
@@ -219,22 +347,36 @@ func (peer *Peer) LastSeen() time.Time {
 	return time.Time{}
 }
 
-// Update peer instance from other
+// Update the contact data of the peer from other instance with the same id, and set it as alive.
+// The verified state is kept while the IP doesn't change
 func (peer *Peer) Update(otherPeer *Peer) error {
-	if peer.Equal(otherPeer) {
-		peer.ip = *otherPeer.IP()
-		peer.udpPort = otherPeer.udpPort
-		peer.tcpPort = otherPeer.tcpPort
-		peer.protocolVersion = otherPeer.protocolVersion
-		peer.ipVerified = otherPeer.ipVerified
-		peer.created = otherPeer.created
-		peer.expires = otherPeer.expires
-		peer.typeCode = otherPeer.typeCode
-		peer.typeUpdated = otherPeer.typeUpdated
-		return nil
-	} else {
+	if !peer.Equal(otherPeer) {
 		return errors.New("the peer information only can be updated with the information of other peer with the same id")
 	}
+
+	// Read the other peer first, so both locks are never held at once
+	otherPeer.access.RLock()
+	ip := make(net.IP, len(otherPeer.ip))
+	copy(ip, otherPeer.ip)
+	ipVerified := otherPeer.ipVerified
+	udpPort, tcpPort := otherPeer.udpPort, otherPeer.tcpPort
+	protocolVersion := otherPeer.protocolVersion
+	udpKey, udpKeyIP := otherPeer.udpKey, otherPeer.udpKeyIP
+	otherPeer.access.RUnlock()
+
+	peer.access.Lock()
+	defer peer.access.Unlock()
+
+	peer.ipVerified = ipVerified || (peer.ipVerified && peer.ip.Equal(ip))
+	peer.ip = ip
+	peer.udpPort = udpPort
+	peer.tcpPort = tcpPort
+	peer.protocolVersion = protocolVersion
+	if udpKey != 0 {
+		peer.setUDPKey(udpKey, udpKeyIP)
+	}
+	peer.updateType()
+	return nil
 }
 
 // Filter a peer slice with a evaluation function
@@ -3,7 +3,10 @@ package types
 import (
 	"net"
 	"sleepy/types"
+	"sleepy/utils/clock"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPeer_GetIP(t *testing.T) {
@@ -30,3 +33,178 @@ func TestPeer_SetIP(t *testing.T) {
 		t.Errorf("IP os verify state missmatch")
 	}
 }
+
+func TestPeer_UDPKey(t *testing.T) {
+	publicIp := net.ParseIP("100.101.102.103")
+	peer := NewPeer(types.NewUInt128FromInt(1))
+
+	if peer.UDPKey(publicIp) != 0 {
+		t.Errorf("A new peer must not have an UDP key")
+	}
+
+	peer.SetUDPKey(1234, publicIp)
+
+	if peer.UDPKey(publicIp) != 1234 {
+		t.Errorf("UDP key mismatch, got: %d, want: %d", peer.UDPKey(publicIp), 1234)
+	} else if peer.UDPKey(net.ParseIP("100.101.102.104")) != 0 {
+		t.Errorf("The UDP key only is valid for the IP that was given")
+	}
+}
+
+func TestPeer_Update(t *testing.T) {
+	testIp := net.ParseIP("100.101.102.103")
+	peer := NewPeer(types.NewUInt128FromInt(1))
+	peer.SetIP(testIp, true)
+
+	otherPeer := NewPeer(types.NewUInt128FromInt(1))
+	otherPeer.SetIP(testIp, false)
+	otherPeer.SetUDPPort(4672)
+
+	if err := peer.Update(otherPeer); err != nil {
+		t.Fatalf("Update error: %s", err)
+	} else if peer.UDPPort() != 4672 {
+		t.Errorf("UDP port must be updated")
+	} else if !peer.IsIpVerified() {
+		t.Errorf("The verified state must be kept if the IP doesn't change")
+	} else if peer.Expiration().Equal(time.Time{}) {
+		t.Errorf("An updated peer must be set as alive")
+	}
+
+	otherPeer.SetIP(net.ParseIP("100.101.102.104"), false)
+	peer.Update(otherPeer)
+	if peer.IsIpVerified() {
+		t.Errorf("The verified state must be lost if the IP changes")
+	}
+
+	if peer.Update(NewPeer(types.NewUInt128FromInt(2))) == nil {
+		t.Errorf("Must fail with peers of other id")
+	}
+}
+
+func TestPeer_Lifecycle(t *testing.T) {
+	testClock := clock.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := NewPeerWithClock(types.NewUInt128FromInt(1), testClock)
+
+	if peer.Type() != NewPeerType || !peer.IsAlive() {
+		t.Errorf("A new peer must be alive with type %d, %d found", NewPeerType, peer.Type())
+	} else if !peer.LastSeen().Equal(time.Time{}) {
+		t.Errorf("A new peer can't be seen")
+	}
+
+	expected := []struct {
+		online   time.Duration
+		typeCode byte
+		expires  time.Duration
+	}{
+		{30 * time.Minute, OneHourPeerType, time.Hour},
+		{90 * time.Minute, TwoHourPeerType, 90 * time.Minute},
+		{150 * time.Minute, LongTimePeerType, 2 * time.Hour},
+	}
+	created := testClock.Now()
+	for _, step := range expected {
+		testClock.Advance(created.Add(step.online).Sub(testClock.Now()))
+		peer.UpdateType()
+
+		if peer.Type() != step.typeCode {
+			t.Errorf("After %s online the type must be %d, %d found", step.online, step.typeCode, peer.Type())
+		} else if !peer.Expiration().Equal(testClock.Now().Add(step.expires)) {
+			t.Errorf("After %s online the peer must expire in %s", step.online, step.expires)
+		} else if !peer.LastSeen().Equal(testClock.Now()) {
+			t.Errorf("The peer must be seen now, %s found", peer.LastSeen())
+		}
+	}
+
+	testClock.Advance(2*time.Hour - time.Second)
+	if !peer.IsAlive() {
+		t.Errorf("The peer must be alive before the expiration")
+	}
+	testClock.Advance(2 * time.Second)
+	if peer.IsAlive() {
+		t.Errorf("The peer can't be alive after the expiration")
+	} else if peer.Type() != LongTimePeerType {
+		t.Errorf("The alive check can't change the type, %d found", peer.Type())
+	}
+	if peer.UpdateExpiration() || peer.Type() != ExpiredPeerType {
+		t.Errorf("The peer must expire after the expiration, type %d found", peer.Type())
+	}
+}
+
+func TestPeer_DegradeType(t *testing.T) {
+	testClock := clock.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := NewPeerWithClock(types.NewUInt128FromInt(1), testClock)
+	testClock.Advance(3 * time.Hour)
+	peer.UpdateType()
+
+	peer.DegradeType()
+	if peer.Type() != TwoHourPeerType {
+		t.Fatalf("The type must be degraded to %d, %d found", TwoHourPeerType, peer.Type())
+	}
+
+	testClock.Advance(5 * time.Second)
+	peer.DegradeType()
+	if peer.Type() != TwoHourPeerType {
+		t.Errorf("The type can't be degraded twice in 10 seconds")
+	}
+
+	for i := 0; i < 5; i++ {
+		testClock.Advance(10 * time.Second)
+		peer.DegradeType()
+	}
+	if peer.Type() != ExpiredPeerType {
+		t.Errorf("The type must be degraded until expired, %d found", peer.Type())
+	}
+}
+
+func TestPeer_Concurrent(t *testing.T) {
+	testClock := clock.NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	peer := NewPeerWithClock(types.NewUInt128FromInt(1), testClock)
+	peer.SetIP(net.ParseIP("100.101.102.103"), false)
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// Add and update
+	run(func(i int) {
+		other := NewPeerWithClock(types.NewUInt128FromInt(1), testClock)
+		other.SetIP(net.IPv4(100, 101, 102, byte(i%2+103)), i%3 == 0)
+		other.SetUDPPort(uint16(4672 + i))
+		other.SetUDPKey(uint32(i+1), net.ParseIP("1.2.3.4"))
+		peer.Update(other)
+		other.Update(peer)
+	})
+	// Verify
+	run(func(i int) {
+		peer.VerifyIp(net.ParseIP("100.101.102.103"))
+		peer.IsIpVerified()
+		peer.UDPKey(net.ParseIP("1.2.3.4"))
+	})
+	// Expire
+	run(func(i int) {
+		testClock.Advance(time.Minute)
+		peer.DegradeType()
+		peer.UpdateExpiration()
+		peer.IsAlive()
+		peer.LastSeen()
+	})
+	// Use
+	run(func(i int) {
+		peer.AddUse()
+		peer.InUse()
+		peer.RemoveUse()
+	})
+	wg.Wait()
+
+	if peer.InUse() {
+		t.Errorf("All the uses must be removed")
+	} else if peer.UDPKey(net.ParseIP("1.2.3.4")) == 0 {
+		t.Errorf("The UDP key must be kept")
+	}
+}
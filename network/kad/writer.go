@@ -0,0 +1,236 @@
+package kad
+
+import (
+	"errors"
+	"math"
+	"net"
+	kadTypes "sleepy/network/kad/types"
+	"sleepy/types"
+)
+
+// Writer serializes the Kad primitives in the same format that Reader parses them
+type Writer struct {
+	data []byte
+}
+
+// Create a new empty writer
+func NewWriter() *Writer {
+	return &Writer{data: make([]byte, 0, 64)}
+}
+
+// Get the bytes written
+func (writer *Writer) Bytes() []byte {
+	return writer.data
+}
+
+// Get the number of bytes written
+func (writer *Writer) Len() int {
+	return len(writer.data)
+}
+
+// Clear the written data to reuse the writer
+func (writer *Writer) Reset() {
+	writer.data = writer.data[:0]
+}
+
+func (writer *Writer) Write(buffer []byte) (n int, err error) {
+	writer.data = append(writer.data, buffer...)
+	return len(buffer), nil
+}
+
+// Write the protocol and the opcode that starts each packet
+func (writer *Writer) WriteHeader(protocol byte, opcode byte) {
+	writer.data = append(writer.data, protocol, opcode)
+}
+
+func (writer *Writer) WriteByte(value byte) error {
+	writer.data = append(writer.data, value)
+	return nil
+}
+
+func (writer *Writer) WriteBytes(buffer []byte) {
+	writer.data = append(writer.data, buffer...)
+}
+
+func (writer *Writer) WriteUInt32(value uint32) {
+	writer.data = append(writer.data, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+func (writer *Writer) WriteUInt64(value uint64) {
+	writer.WriteUInt32(uint32(value))
+	writer.WriteUInt32(uint32(value >> 32))
+}
+
+func (writer *Writer) WriteUInt16(value uint16) {
+	writer.data = append(writer.data, byte(value), byte(value>>8))
+}
+
+func (writer *Writer) WriteInt32(value int32) {
+	writer.WriteUInt32(uint32(value))
+}
+
+func (writer *Writer) WriteInt(value int) {
+	writer.WriteUInt32(uint32(value))
+}
+
+func (writer *Writer) WriteFloat32(value float32) {
+	writer.WriteUInt32(math.Float32bits(value))
+}
+
+func (writer *Writer) WriteUInt128(value *types.UInt128) {
+	writer.data = append(writer.data, value.ToKadBytes()...)
+}
+
+// Write an IPv4 address as an uint32 in host byte order, like Kad does
+func (writer *Writer) WriteIPv4(ip net.IP) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+	}
+
+	writer.WriteUInt32(uint32(ip4[0])<<24 | uint32(ip4[1])<<16 | uint32(ip4[2])<<8 | uint32(ip4[3]))
+}
+
+// Write a Kad2 contact: id, IP, UDP port, TCP port and version
+func (writer *Writer) WritePeer(peer *kadTypes.Peer) {
+	writer.WriteUInt128(peer.Id())
+	writer.WriteIPv4(*peer.IP())
+	writer.WriteUInt16(peer.UDPPort())
+	writer.WriteUInt16(peer.TCPPort())
+	writer.WriteByte(peer.ProtocolVersion())
+}
+
+// Write the string bytes without any length information
+func (writer *Writer) WriteString(value string) {
+	writer.data = append(writer.data, value...)
+}
+
+// Write the string preceded by his length as uint16
+func (writer *Writer) WriteLengthString(value string) error {
+	if len(value) > 0xffff {
+		return errors.New("string too long to be written")
+	}
+
+	writer.WriteUInt16(uint16(len(value)))
+	writer.WriteString(value)
+	return nil
+}
+
+// Write a Kad tag list, preceded by his tag count as byte
+func (writer *Writer) WriteTags(tags TagList) error {
+	if len(tags) > 0xff {
+		return errors.New("too many tags to be written")
+	}
+
+	start := writer.Len()
+	writer.WriteByte(byte(len(tags)))
+
+	for _, tag := range tags {
+		err := writer.WriteTag(tag)
+		if err != nil {
+			writer.data = writer.data[:start]
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write a single Kad tag
+func (writer *Writer) WriteTag(tag *Tag) error {
+	var err error
+	ok := true
+	start := writer.Len()
+
+	writer.WriteByte(tag.Type)
+	if err = writer.WriteLengthString(tag.Name); err != nil {
+		return err
+	}
+
+	switch {
+	case tag.Type == TagTypeHash16:
+		var value []byte
+		value, ok = tag.Value.([]byte)
+		if ok && len(value) != 16 {
+			err = errors.New("hash tags must contain 16 bytes")
+		}
+		writer.WriteBytes(value)
+	case tag.Type == TagTypeString:
+		var value string
+		if value, ok = tag.Value.(string); ok {
+			err = writer.WriteLengthString(value)
+		}
+	case tag.Type == TagTypeUInt32:
+		var value uint32
+		value, ok = tag.Value.(uint32)
+		writer.WriteUInt32(value)
+	case tag.Type == TagTypeFloat32:
+		var value float32
+		value, ok = tag.Value.(float32)
+		writer.WriteFloat32(value)
+	case tag.Type == TagTypeBool:
+		var value bool
+		value, ok = tag.Value.(bool)
+		if value {
+			writer.WriteByte(1)
+		} else {
+			writer.WriteByte(0)
+		}
+	case tag.Type == TagTypeBoolArray:
+		var values []bool
+		if values, ok = tag.Value.([]bool); ok && len(values) > 0xffff {
+			err = errors.New("bool array too long to be written")
+		} else if ok {
+			data := make([]byte, len(values)/8+1)
+			for i, value := range values {
+				if value {
+					data[i/8] |= 1 << uint(i%8)
+				}
+			}
+			writer.WriteUInt16(uint16(len(values)))
+			writer.WriteBytes(data)
+		}
+	case tag.Type == TagTypeBlob:
+		var value []byte
+		value, ok = tag.Value.([]byte)
+		writer.WriteUInt32(uint32(len(value)))
+		writer.WriteBytes(value)
+	case tag.Type == TagTypeUInt16:
+		var value uint16
+		value, ok = tag.Value.(uint16)
+		writer.WriteUInt16(value)
+	case tag.Type == TagTypeUInt8:
+		var value uint8
+		value, ok = tag.Value.(uint8)
+		writer.WriteByte(value)
+	case tag.Type == TagTypeBsob:
+		var value []byte
+		if value, ok = tag.Value.([]byte); ok && len(value) > 0xff {
+			err = errors.New("bsob too long to be written")
+		}
+		writer.WriteByte(byte(len(value)))
+		writer.WriteBytes(value)
+	case tag.Type == TagTypeUInt64:
+		var value uint64
+		value, ok = tag.Value.(uint64)
+		writer.WriteUInt64(value)
+	case tag.Type >= TagTypeStr1 && tag.Type <= TagTypeStr16:
+		var value string
+		if value, ok = tag.Value.(string); ok && len(value) != int(tag.Type-TagTypeStr1+1) {
+			err = errors.New("compact string length mismatch")
+		}
+		writer.WriteString(value)
+	default:
+		err = errors.New("unknown tag type")
+	}
+
+	if err == nil && !ok {
+		err = errors.New("tag value doesn't match the tag type")
+	}
+
+	if err != nil {
+		writer.data = writer.data[:start]
+	}
+
+	return err
+}
@@ -0,0 +1,143 @@
+package kad
+
+import (
+	"bytes"
+	"reflect"
+	"sleepy/types"
+	"testing"
+)
+
+func TestWriter_WriteHeader(t *testing.T) {
+	writer := NewWriter()
+	writer.WriteHeader(0xe4, CommKad2Ping)
+
+	if !bytes.Equal(writer.Bytes(), []byte{0xe4, CommKad2Ping}) {
+		t.Errorf("Header mismatch, got: %x", writer.Bytes())
+	}
+}
+
+func TestWriter_Integers(t *testing.T) {
+	writer := NewWriter()
+	writer.WriteByte(0x7f)
+	writer.WriteUInt16(0xbeef)
+	writer.WriteUInt32(0xdeadbeef)
+	writer.WriteInt32(-5)
+	writer.WriteInt(1234567)
+
+	if !bytes.Equal(writer.Bytes()[1:3], []byte{0xef, 0xbe}) {
+		t.Errorf("uint16 must be written in little endian, got: %x", writer.Bytes()[1:3])
+	}
+
+	reader := NewReader(writer.Bytes())
+	if read, err := reader.ReadByte(); err != nil || read != 0x7f {
+		t.Errorf("Read byte error, got: %d, want: %d (%v)", read, 0x7f, err)
+	}
+	if read, err := reader.ReadUInt16(); err != nil || read != 0xbeef {
+		t.Errorf("Read uint16 error, got: %d, want: %d (%v)", read, 0xbeef, err)
+	}
+	if read, err := reader.ReadUInt32(); err != nil || read != 0xdeadbeef {
+		t.Errorf("Read uint32 error, got: %d, want: %d (%v)", read, uint32(0xdeadbeef), err)
+	}
+	if read, err := reader.ReadInt32(); err != nil || read != -5 {
+		t.Errorf("Read int32 error, got: %d, want: %d (%v)", read, -5, err)
+	}
+	if read, err := reader.ReadInt(); err != nil || read != 1234567 {
+		t.Errorf("Read int error, got: %d, want: %d (%v)", read, 1234567, err)
+	}
+}
+
+func TestWriter_WriteUInt128(t *testing.T) {
+	value := types.NewUInt128(0x0123456789abcdef, 0xfedcba9876543210)
+	writer := NewWriter()
+	writer.WriteUInt128(value)
+
+	if writer.Len() != 16 {
+		t.Errorf("UInt128 must use 16 bytes, %d found", writer.Len())
+	}
+
+	read, err := NewReader(writer.Bytes()).ReadUInt128()
+	if err != nil {
+		t.Errorf("Read errors: %s", err)
+	} else if !read.Equal(value) {
+		t.Errorf("UInt128 mismatch, 0x%s expected, 0x%s found", value.ToHexString(), read.ToHexString())
+	}
+}
+
+func TestWriter_WriteStrings(t *testing.T) {
+	writer := NewWriter()
+	writer.WriteString("raw")
+	err := writer.WriteLengthString("prefixed")
+	if err != nil {
+		t.Errorf("Write errors: %s", err)
+	}
+	writer.WriteLengthString("")
+
+	reader := NewReader(writer.Bytes())
+	if read, err := reader.ReadString(3); err != nil || read != "raw" {
+		t.Errorf("Read string error, got: %s (%v)", read, err)
+	}
+	if read, err := reader.ReadLengthString(); err != nil || read != "prefixed" {
+		t.Errorf("Read string error, got: %s (%v)", read, err)
+	}
+	if read, err := reader.ReadLengthString(); err != nil || read != "" {
+		t.Errorf("Read empty string error, got: %s (%v)", read, err)
+	}
+
+	if writer.WriteLengthString(string(make([]byte, 0x10000))) == nil {
+		t.Errorf("Must fail with strings longer than uint16")
+	}
+}
+
+func TestWriter_WriteTags(t *testing.T) {
+	tags := TagList{
+		NewHashTag("hash", bytes.Repeat([]byte{0xab}, 16)),
+		NewStringTag(TagFileName, "file.txt"),
+		NewIntTag(TagFileSize, 0x1ffffffff),
+		NewIntTag(TagSourcePort, 4662),
+		NewIntTag(TagSourceType, 1),
+		NewIntTag(TagSources, 70000),
+		NewFloatTag("float", 1.5),
+		NewBoolTag("bool", true),
+		{Name: "boolarray", Type: TagTypeBoolArray, Value: []bool{true, false, false, true, true, false, false, false, true}},
+		NewBlobTag("blob", []byte{0x01, 0x02, 0x03}),
+		{Name: "bsob", Type: TagTypeBsob, Value: []byte{0x04, 0x05}},
+		{Name: "str", Type: TagTypeStr1 + 2, Value: "abc"},
+	}
+
+	writer := NewWriter()
+	err := writer.WriteTags(tags)
+	if err != nil {
+		t.Fatalf("Write errors: %s", err)
+	}
+
+	read, err := NewReader(writer.Bytes()).ReadTags()
+	if err != nil {
+		t.Fatalf("Read errors: %s", err)
+	} else if len(read) != len(tags) {
+		t.Fatalf("Tag count mismatch, %d expected, %d found", len(tags), len(read))
+	}
+
+	for i, tag := range tags {
+		if read[i].Name != tag.Name || read[i].Type != tag.Type || !reflect.DeepEqual(read[i].Value, tag.Value) {
+			t.Errorf("Tag %d mismatch, %v expected, %v found", i, tag, read[i])
+		}
+	}
+}
+
+func TestWriter_WriteTagsErrors(t *testing.T) {
+	invalid := []*Tag{
+		{Name: "bad", Type: TagTypeUInt32, Value: "text"},
+		{Name: "bad", Type: 0x50, Value: uint32(1)},
+		{Name: "bad", Type: TagTypeHash16, Value: []byte{0x01}},
+		{Name: "bad", Type: TagTypeStr1, Value: "too long"},
+	}
+
+	for _, tag := range invalid {
+		writer := NewWriter()
+		if writer.WriteTags(TagList{NewIntTag("ok", 1), tag}) == nil {
+			t.Errorf("Must fail with invalid tag %v", tag)
+		} else if writer.Len() != 0 {
+			t.Errorf("Writer must discard the partial tag list, %d bytes found", writer.Len())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -53,6 +54,29 @@ func NewUInt128FromByteArray(data []byte) (*UInt128, error) {
 	return num, nil
 }
 
+// Create a random UInt128 from a cryptographically secure source
+func NewRandomUInt128() (*UInt128, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+
+	return NewUInt128FromByteArray(data)
+}
+
+// Create a UInt128 from the 16 bytes used by Kad on the wire, that are four 32 bit
+// little endian words with the most significant word first
+func NewUInt128FromKadByteArray(data []byte) (*UInt128, error) {
+	if len(data) != 16 {
+		return nil, errors.New("UInt128 only can be parsed from 16 byte length array")
+	}
+
+	num := new(UInt128)
+	num.hi = uint64(binary.LittleEndian.Uint32(data[0:4]))<<32 | uint64(binary.LittleEndian.Uint32(data[4:8]))
+	num.lo = uint64(binary.LittleEndian.Uint32(data[8:12]))<<32 | uint64(binary.LittleEndian.Uint32(data[12:16]))
+	return num, nil
+}
+
 // Create a instance copy
 func (uint128 *UInt128) Clone() *UInt128 {
 	return &UInt128{
@@ -283,6 +307,16 @@ func (uint128 *UInt128) ToBytes() []byte {
 	return append(hi, lo...)
 }
 
+// Get the 16 bytes of the number in the Kad wire order (see NewUInt128FromKadByteArray)
+func (uint128 *UInt128) ToKadBytes() []byte {
+	data := make([]byte, 16)
+	binary.LittleEndian.PutUint32(data[0:4], uint32(uint128.hi>>32))
+	binary.LittleEndian.PutUint32(data[4:8], uint32(uint128.hi))
+	binary.LittleEndian.PutUint32(data[8:12], uint32(uint128.lo>>32))
+	binary.LittleEndian.PutUint32(data[12:16], uint32(uint128.lo))
+	return data
+}
+
 // Convert to the hexadecimal string representation
 func (uint128 *UInt128) ToHexString() string {
 	loStr := strconv.FormatUint(uint128.lo, 16)
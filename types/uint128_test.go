@@ -282,3 +282,32 @@ func TestUInt128_ToHexString(t *testing.T) {
 		}
 	}
 }
+
+func TestUInt128_KadBytes(t *testing.T) {
+	kadData := []byte{0x03, 0x02, 0x01, 0x00, 0x07, 0x06, 0x05, 0x04, 0x0b, 0x0a, 0x09, 0x08, 0x0f, 0x0e, 0x0d, 0x0c}
+	uint1, err1 := NewUInt128FromKadByteArray(kadData)
+	uint2, err2 := NewUInt128FromByteArray([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f})
+
+	if err1 != nil || err2 != nil {
+		t.Errorf("Error while construct the uint128 numbers")
+	} else if !uint1.Equal(uint2) {
+		t.Errorf("Kad byte order parse failed, 0x%s expected, 0x%s found", uint2.ToHexString(), uint1.ToHexString())
+	} else if string(uint1.ToKadBytes()) != string(kadData) {
+		t.Errorf("Kad byte order conversion failed")
+	}
+
+	if _, err := NewUInt128FromKadByteArray(kadData[1:]); err == nil {
+		t.Errorf("Must fail with less than 16 bytes")
+	}
+}
+
+func TestNewRandomUInt128(t *testing.T) {
+	uint1, err1 := NewRandomUInt128()
+	uint2, err2 := NewRandomUInt128()
+
+	if err1 != nil || err2 != nil {
+		t.Errorf("Error while generate random uint128 numbers")
+	} else if uint1.Equal(uint2) {
+		t.Errorf("Two random numbers must be different")
+	}
+}
@@ -0,0 +1,138 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of the current time, that can be replaced to control the time in tests
+type Clock interface {
+	Now() time.Time
+	NewTicker(period time.Duration) *Ticker
+	After(duration time.Duration) <-chan time.Time
+}
+
+// Ticker delivers the time on C after each period, dropping the ticks of slow receivers
+// like time.Ticker
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop the ticker. C is not closed
+func (ticker *Ticker) Stop() {
+	ticker.stop()
+}
+
+type systemClock struct{}
+
+// Get the current system time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Create a ticker that follows the system time
+func (systemClock) NewTicker(period time.Duration) *Ticker {
+	ticker := time.NewTicker(period)
+	return &Ticker{C: ticker.C, stop: ticker.Stop}
+}
+
+// Get a channel that receives the system time after [duration]
+func (systemClock) After(duration time.Duration) <-chan time.Time {
+	return time.After(duration)
+}
+
+// Clock that follows the system time
+var System Clock = systemClock{}
+
+// Ticker or timer of a manual clock, that fires when the clock reaches its deadline
+type manualWaiter struct {
+	deadline time.Time
+	period   time.Duration // 0 for the timers, that fire once
+	c        chan time.Time
+}
+
+// Clock that only moves when it's advanced
+type Manual struct {
+	now     time.Time
+	waiters []*manualWaiter
+	access  sync.Mutex
+}
+
+// Create a manual clock stopped at [now]
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now}
+}
+
+// Get the current time of the clock
+func (clock *Manual) Now() time.Time {
+	clock.access.Lock()
+	defer clock.access.Unlock()
+	return clock.now
+}
+
+// Create a ticker that fires each time the clock is advanced over a period
+func (clock *Manual) NewTicker(period time.Duration) *Ticker {
+	if period <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	waiter := clock.addWaiter(period, period)
+	return &Ticker{C: waiter.c, stop: func() { clock.removeWaiter(waiter) }}
+}
+
+// Get a channel that receives the time when the clock is advanced over [duration]
+func (clock *Manual) After(duration time.Duration) <-chan time.Time {
+	return clock.addWaiter(duration, 0).c
+}
+
+func (clock *Manual) addWaiter(duration time.Duration, period time.Duration) *manualWaiter {
+	clock.access.Lock()
+	defer clock.access.Unlock()
+
+	waiter := &manualWaiter{deadline: clock.now.Add(duration), period: period, c: make(chan time.Time, 1)}
+	clock.waiters = append(clock.waiters, waiter)
+	return waiter
+}
+
+func (clock *Manual) removeWaiter(removed *manualWaiter) {
+	clock.access.Lock()
+	defer clock.access.Unlock()
+
+	for index, waiter := range clock.waiters {
+		if waiter == removed {
+			clock.waiters = append(clock.waiters[:index], clock.waiters[index+1:]...)
+			return
+		}
+	}
+}
+
+// Move the clock forward by [duration], firing the tickers and timers that reach their deadline
+func (clock *Manual) Advance(duration time.Duration) {
+	clock.access.Lock()
+	defer clock.access.Unlock()
+
+	clock.now = clock.now.Add(duration)
+
+	pending := clock.waiters[:0]
+	for _, waiter := range clock.waiters {
+		if waiter.deadline.After(clock.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+
+		select {
+		case waiter.c <- clock.now:
+		default:
+		}
+
+		// The tickers skip the periods that were advanced at once
+		if waiter.period > 0 {
+			for !waiter.deadline.After(clock.now) {
+				waiter.deadline = waiter.deadline.Add(waiter.period)
+			}
+			pending = append(pending, waiter)
+		}
+	}
+	clock.waiters = pending
+}
@@ -0,0 +1,65 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManual_NewTicker(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManual(start)
+	ticker := clock.NewTicker(time.Minute)
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-ticker.C:
+		t.Errorf("The ticker can't fire before the period")
+	default:
+	}
+
+	clock.Advance(30 * time.Second)
+	select {
+	case now := <-ticker.C:
+		if !now.Equal(start.Add(time.Minute)) {
+			t.Errorf("Tick time mismatch, got: %s", now)
+		}
+	default:
+		t.Errorf("The ticker must fire after the period")
+	}
+
+	// Several periods at once fire only one tick
+	clock.Advance(3 * time.Minute)
+	<-ticker.C
+	select {
+	case <-ticker.C:
+		t.Errorf("The ticks of a slow receiver must be dropped")
+	default:
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case <-ticker.C:
+		t.Errorf("A stopped ticker can't fire")
+	default:
+	}
+}
+
+func TestManual_After(t *testing.T) {
+	clock := NewManual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	timer := clock.After(time.Minute)
+
+	clock.Advance(time.Minute)
+	select {
+	case <-timer:
+	default:
+		t.Errorf("The timer must fire after the duration")
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-timer:
+		t.Errorf("The timer only fires once")
+	default:
+	}
+}